@@ -0,0 +1,133 @@
+/*
+
+悟空持久存储的管理工具
+
+	wukong-admin -folder <目录> [-shards 8] [-storage_engine bolt] stats|check|compact
+
+	stats    输出每个分片的文档数和占用的磁盘空间
+	check    检查每个文档能否解码，有无法解码的文档时退出码为1
+	compact  将每个分片复制到新文件，释放删除文档后留下的空间
+
+folder和shards即EngineInitOptions中的PersistentStorageFolder和PersistentStorageShards。
+运行时不能有引擎在使用这个目录。
+
+check只能使用内置的编码方式，并且不知道自定义评分字段的类型：gob编码时类型没有注册，
+BinaryCodec没有NewFields，这些文档会被报告为无法解码。这种情况请在自己的程序中注册类型
+或者设置EngineInitOptions.Codec，然后调用engine.CheckStorage。
+
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/huichen/wukong/engine"
+	"github.com/huichen/wukong/types"
+)
+
+var (
+	folder         = flag.String("folder", "", "持久存储数据库保存的目录")
+	shards         = flag.Int("shards", 0, "持久数据库存储裂分数目，为0时使用引擎的默认值")
+	storage_engine = flag.String("storage_engine", "", "存储引擎（bolt或kv），为空时使用环境变量WUKONG_STORAGE_ENGINE")
+	max_doc_ids    = flag.Int("max_doc_ids", 20, "check时每个分片最多输出多少个无法解码的文档编号")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "用法：%s -folder <目录> [选项] stats|check|compact\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *folder == "" || flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *storage_engine != "" {
+		os.Setenv("WUKONG_STORAGE_ENGINE", *storage_engine)
+	}
+	options := types.EngineInitOptions{
+		PersistentStorageFolder: *folder,
+		PersistentStorageShards: *shards,
+	}
+
+	switch flag.Arg(0) {
+	case "stats":
+		stats, err := engine.StorageStats(options)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printStats(stats)
+	case "check":
+		stats, err := engine.CheckStorage(options)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printStats(stats)
+		if !printInvalid(stats) {
+			os.Exit(1)
+		}
+		fmt.Println("全部文档都可以解码")
+	case "compact":
+		before, err := engine.StorageStats(options)
+		if err != nil {
+			log.Fatal(err)
+		}
+		after, err := engine.CompactStorage(options)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "分片\t文件\t文档数\t压缩前\t压缩后")
+		var sizeBefore, sizeAfter int64
+		for i, s := range after {
+			fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%d\n", s.Shard, s.Path, s.NumDocuments, before[i].Size, s.Size)
+			sizeBefore += before[i].Size
+			sizeAfter += s.Size
+		}
+		fmt.Fprintf(w, "合计\t\t\t%d\t%d\n", sizeBefore, sizeAfter)
+		w.Flush()
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// 输出每个分片的文档数和磁盘空间
+func printStats(stats []types.StorageShardStats) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "分片\t文件\t文档数\t字节数")
+	numDocuments, size := 0, int64(0)
+	for _, s := range stats {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\n", s.Shard, s.Path, s.NumDocuments, s.Size)
+		numDocuments += s.NumDocuments
+		size += s.Size
+	}
+	fmt.Fprintf(w, "合计\t\t%d\t%d\n", numDocuments, size)
+	w.Flush()
+}
+
+// 输出无法解码的文档和无效的键，全部有效时返回true
+func printInvalid(stats []types.StorageShardStats) bool {
+	valid := true
+	for _, s := range stats {
+		if len(s.InvalidDocIds) == 0 && s.NumInvalidKeys == 0 {
+			continue
+		}
+		valid = false
+		fmt.Printf("分片%d有%d个文档无法解码，%d个键不是文档编号\n",
+			s.Shard, len(s.InvalidDocIds), s.NumInvalidKeys)
+		docIds := s.InvalidDocIds
+		if len(docIds) > *max_doc_ids {
+			docIds = docIds[:*max_doc_ids]
+		}
+		if len(docIds) > 0 {
+			fmt.Println("  文档编号：", docIds)
+		}
+	}
+	return valid
+}
@@ -0,0 +1,274 @@
+package core
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/huichen/wukong/types"
+)
+
+const (
+	// 压缩格式中每块的文档数
+	postingBlockSize = 128
+
+	// 压缩格式中词频的精度为1/frequencyScale
+	frequencyScale = 16
+)
+
+// 压缩格式的反向索引表的一行
+//
+// 文档按DocId从小到大每postingBlockSize个分为一块，每块依次存储：
+//
+//	除第一个文档外每个DocId与前一个的差值（varint）
+//	IndexType == FrequenciesIndex时，每个文档的词频乘以frequencyScale取整（varint）
+//	IndexType == LocationsIndex时，每个文档的位置个数和各个位置与前一个位置的差值（varint）
+//
+// 每块的第一个和最后一个DocId不压缩，作为跳表用于查找时跳过不相关的块。
+type compressedPostings struct {
+	length      int
+	firstDocIds []uint64
+	lastDocIds  []uint64
+	offsets     []int
+	data        []byte
+}
+
+// 解码后的一块
+type decodedBlock struct {
+	index       int
+	docIds      []uint64
+	frequencies []float32
+	locations   [][]int
+}
+
+func compressPostings(ti *KeywordIndices, indexType int) *compressedPostings {
+	length := len(ti.docIds)
+	numBlocks := (length + postingBlockSize - 1) / postingBlockSize
+	c := &compressedPostings{
+		length:      length,
+		firstDocIds: make([]uint64, numBlocks),
+		lastDocIds:  make([]uint64, numBlocks),
+		offsets:     make([]int, numBlocks),
+	}
+	buffer := make([]byte, binary.MaxVarintLen64)
+	var data []byte
+	putUvarint := func(value uint64) {
+		data = append(data, buffer[:binary.PutUvarint(buffer, value)]...)
+	}
+	putVarint := func(value int64) {
+		data = append(data, buffer[:binary.PutVarint(buffer, value)]...)
+	}
+
+	for b := 0; b < numBlocks; b++ {
+		start := b * postingBlockSize
+		end := start + postingBlockSize
+		if end > length {
+			end = length
+		}
+		c.firstDocIds[b] = ti.docIds[start]
+		c.lastDocIds[b] = ti.docIds[end-1]
+		c.offsets[b] = len(data)
+		for i := start + 1; i < end; i++ {
+			putUvarint(ti.docIds[i] - ti.docIds[i-1])
+		}
+		switch indexType {
+		case types.FrequenciesIndex:
+			for i := start; i < end; i++ {
+				putUvarint(uint64(ti.frequencies[i]*frequencyScale + 0.5))
+			}
+		case types.LocationsIndex:
+			for i := start; i < end; i++ {
+				putUvarint(uint64(len(ti.locations[i])))
+				previous := 0
+				for _, location := range ti.locations[i] {
+					// 位置在索引时已经排序（见sortedLocations），差值仍按有符号数存储以兼容旧的数据
+					putVarint(int64(location - previous))
+					previous = location
+				}
+			}
+		}
+	}
+
+	// 去掉多余的容量
+	c.data = make([]byte, len(data))
+	copy(c.data, data)
+	return c
+}
+
+func (c *compressedPostings) numBlocks() int {
+	return len(c.firstDocIds)
+}
+
+func (c *compressedPostings) blockLength(b int) int {
+	if b == c.numBlocks()-1 {
+		return c.length - b*postingBlockSize
+	}
+	return postingBlockSize
+}
+
+func (c *compressedPostings) decodeBlock(b int, indexType int, block *decodedBlock) {
+	n := c.blockLength(b)
+	block.index = b
+	block.docIds = make([]uint64, n)
+	block.frequencies = nil
+	block.locations = nil
+
+	data := c.data[c.offsets[b]:]
+	uvarint := func() uint64 {
+		value, size := binary.Uvarint(data)
+		data = data[size:]
+		return value
+	}
+	varint := func() int64 {
+		value, size := binary.Varint(data)
+		data = data[size:]
+		return value
+	}
+
+	block.docIds[0] = c.firstDocIds[b]
+	for i := 1; i < n; i++ {
+		block.docIds[i] = block.docIds[i-1] + uvarint()
+	}
+	switch indexType {
+	case types.FrequenciesIndex:
+		block.frequencies = make([]float32, n)
+		for i := range block.frequencies {
+			block.frequencies[i] = float32(uvarint()) / frequencyScale
+		}
+	case types.LocationsIndex:
+		block.locations = make([][]int, n)
+		for i := range block.locations {
+			locations := make([]int, uvarint())
+			previous := 0
+			for j := range locations {
+				locations[j] = previous + int(varint())
+				previous = locations[j]
+			}
+			block.locations[i] = locations
+		}
+	}
+}
+
+// 在[start, end]中找出第一个DocId不小于docId的位置，先用跳表找到所在的块
+func (c *compressedPostings) search(
+	ti *KeywordIndices, indexType int, start int, end int, docId uint64) (int, bool) {
+	if start > end {
+		return start, false
+	}
+	firstBlock, lastBlock := start/postingBlockSize, end/postingBlockSize
+	b := firstBlock + sort.Search(lastBlock-firstBlock+1, func(i int) bool {
+		return c.lastDocIds[firstBlock+i] >= docId
+	})
+	if b > lastBlock {
+		return end + 1, false
+	}
+
+	block := ti.getBlock(b, indexType)
+	low := b * postingBlockSize
+	if low < start {
+		low = start
+	}
+	high := b*postingBlockSize + len(block.docIds)
+	if high > end+1 {
+		high = end + 1
+	}
+	offset := b * postingBlockSize
+	position := low + sort.Search(high-low, func(i int) bool {
+		return block.docIds[low+i-offset] >= docId
+	})
+	return position, position < high && block.docIds[position-offset] == docId
+}
+
+// 得到第b块解码后的数据
+// 只有查询时的副本（见Indexer.reader）会缓存解码后的块，共享的KeywordIndices每次重新解码
+func (ti *KeywordIndices) getBlock(b int, indexType int) *decodedBlock {
+	if ti.block != nil {
+		if ti.block.index != b {
+			ti.compressed.decodeBlock(b, indexType, ti.block)
+		}
+		return ti.block
+	}
+	block := &decodedBlock{}
+	ti.compressed.decodeBlock(b, indexType, block)
+	return block
+}
+
+// 插入docId时需要修改的第一块，即第一个最后DocId不小于docId的块
+// docId大于全部文档时，最后一块未满则为最后一块，否则为新的一块
+func (c *compressedPostings) firstAffectedBlock(docId uint64) int {
+	n := c.numBlocks()
+	b := sort.Search(n, func(i int) bool { return c.lastDocIds[i] >= docId })
+	if b == n && c.blockLength(n-1) < postingBlockSize {
+		b = n - 1
+	}
+	return b
+}
+
+// 将压缩格式还原为切片，用于修改索引
+func (indexer *Indexer) decompress(ti *KeywordIndices) {
+	indexer.decompressFrom(ti, 0)
+}
+
+// 只将第b块及之后的块还原为切片，返回之前保持压缩的块
+// 之前的块都是满的，修改完切片后用compressAfter重新接在一起
+func (indexer *Indexer) decompressFrom(ti *KeywordIndices, b int) *compressedPostings {
+	c := ti.compressed
+	if c == nil {
+		return nil
+	}
+	indexType := indexer.initOptions.IndexType
+	ti.docIds = make([]uint64, 0, c.length-b*postingBlockSize)
+	var block decodedBlock
+	for i := b; i < c.numBlocks(); i++ {
+		c.decodeBlock(i, indexType, &block)
+		ti.docIds = append(ti.docIds, block.docIds...)
+		ti.frequencies = append(ti.frequencies, block.frequencies...)
+		ti.locations = append(ti.locations, block.locations...)
+	}
+	ti.compressed = nil
+
+	end := len(c.data)
+	if b < c.numBlocks() {
+		end = c.offsets[b]
+	}
+	return &compressedPostings{
+		length:      b * postingBlockSize,
+		firstDocIds: c.firstDocIds[:b],
+		lastDocIds:  c.lastDocIds[:b],
+		offsets:     c.offsets[:b],
+		data:        c.data[:end],
+	}
+}
+
+// 压缩索引表的一行，释放切片
+func (indexer *Indexer) compress(ti *KeywordIndices) {
+	if ti.compressed != nil || len(ti.docIds) == 0 {
+		return
+	}
+	ti.compressed = compressPostings(ti, indexer.initOptions.IndexType)
+	ti.docIds = nil
+	ti.frequencies = nil
+	ti.locations = nil
+}
+
+// 压缩切片并接在head的块之后，head为decompressFrom的返回值
+// 原来的压缩数据不再使用，因此直接在head的切片上追加，不需要复制之前的块
+func (indexer *Indexer) compressAfter(ti *KeywordIndices, head *compressedPostings) {
+	if head == nil || head.numBlocks() == 0 {
+		indexer.compress(ti)
+		return
+	}
+	if len(ti.docIds) > 0 {
+		tail := compressPostings(ti, indexer.initOptions.IndexType)
+		for _, offset := range tail.offsets {
+			head.offsets = append(head.offsets, len(head.data)+offset)
+		}
+		head.length += tail.length
+		head.firstDocIds = append(head.firstDocIds, tail.firstDocIds...)
+		head.lastDocIds = append(head.lastDocIds, tail.lastDocIds...)
+		head.data = append(head.data, tail.data...)
+	}
+	ti.compressed = head
+	ti.docIds = nil
+	ti.frequencies = nil
+	ti.locations = nil
+}
@@ -0,0 +1,71 @@
+package core
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/huichen/wukong/types"
+)
+
+// 统计docIds中带有各个标签的文档数
+//
+// 返回值的第一层键为分面名（见FacetRequest.GetName），第二层键为标签。按前缀统计时
+// 只返回文档数大于零的标签，TopN在合并各个分片的结果之后由调用者处理。
+func (indexer *Indexer) CountFacets(docIds []uint64, facets []types.FacetRequest) (
+	map[string]map[string]int, error) {
+	if !indexer.initialized {
+		return nil, types.ErrNotInitialized
+	}
+
+	sortedDocIds := make([]uint64, len(docIds))
+	copy(sortedDocIds, docIds)
+	sort.Sort(types.DocumentsId(sortedDocIds))
+
+	indexer.tableLock.RLock()
+	defer indexer.tableLock.RUnlock()
+
+	output := make(map[string]map[string]int)
+	for _, facet := range facets {
+		counts := make(map[string]int)
+		if len(facet.Labels) > 0 {
+			for _, label := range facet.Labels {
+				counts[label] = indexer.countDocsWithKeyword(label, sortedDocIds)
+			}
+		} else if facet.Prefix != "" {
+			for keyword := range indexer.tableLock.table {
+				if !strings.HasPrefix(keyword, facet.Prefix) {
+					continue
+				}
+				if count := indexer.countDocsWithKeyword(keyword, sortedDocIds); count > 0 {
+					counts[keyword] = count
+				}
+			}
+		}
+		output[facet.GetName()] = counts
+	}
+	return output, nil
+}
+
+// 统计升序的docIds中有多少文档含有该搜索键，调用时必须持有tableLock的读锁
+func (indexer *Indexer) countDocsWithKeyword(keyword string, docIds []uint64) int {
+	indices, found := indexer.tableLock.table[keyword]
+	if !found {
+		return 0
+	}
+	indices = indexer.reader(indices)
+	count := 0
+	start, end := 0, indexer.getIndexLength(indices)-1
+	for _, docId := range docIds {
+		if start > end {
+			break
+		}
+		position, found := indexer.searchIndex(indices, start, end, docId)
+		if found {
+			count++
+			start = position + 1
+		} else {
+			start = position
+		}
+	}
+	return count
+}
@@ -0,0 +1,88 @@
+package core
+
+import (
+	"github.com/huichen/wukong/types"
+)
+
+// 类型转换之后的过滤条件
+type attributeFilter struct {
+	column                 map[uint64]types.AttributeValue
+	min, max               *types.AttributeValue
+	excludeMin, excludeMax bool
+}
+
+func (filter *attributeFilter) match(docId uint64) bool {
+	value, found := filter.column[docId]
+	if !found {
+		return false
+	}
+	if filter.min != nil {
+		compare := value.Compare(*filter.min)
+		if compare < 0 || compare == 0 && filter.excludeMin {
+			return false
+		}
+	}
+	if filter.max != nil {
+		compare := value.Compare(*filter.max)
+		if compare > 0 || compare == 0 && filter.excludeMax {
+			return false
+		}
+	}
+	return true
+}
+
+// 按数值属性过滤文档，返回满足全部过滤条件的文档，顺序不变
+func (ranker *Ranker) Filter(
+	docs []types.IndexedDocument, filters []types.AttributeFilter) ([]types.IndexedDocument, error) {
+	if !ranker.initialized {
+		return nil, types.ErrNotInitialized
+	}
+	if len(filters) == 0 {
+		return docs, nil
+	}
+
+	ranker.lock.RLock()
+	defer ranker.lock.RUnlock()
+
+	compiled := make([]attributeFilter, len(filters))
+	for i, filter := range filters {
+		compiled[i] = attributeFilter{
+			column:     ranker.lock.attributes[filter.Name],
+			excludeMin: filter.ExcludeMin,
+			excludeMax: filter.ExcludeMax,
+		}
+		if filter.Min != nil {
+			min, err := types.NewAttributeValue(filter.Min)
+			if err != nil {
+				return nil, err
+			}
+			compiled[i].min = &min
+		}
+		if filter.Max != nil {
+			max, err := types.NewAttributeValue(filter.Max)
+			if err != nil {
+				return nil, err
+			}
+			compiled[i].max = &max
+		}
+		if compiled[i].column == nil {
+			// 没有文档带有该属性
+			return nil, nil
+		}
+	}
+
+	var output []types.IndexedDocument
+	for _, doc := range docs {
+		matched := true
+		for i := range compiled {
+			if !compiled[i].match(doc.DocId) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			output = append(output, doc)
+		}
+	}
+	return output, nil
+}
@@ -0,0 +1,99 @@
+package core
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/huichen/wukong/types"
+)
+
+// 返回和term的编辑距离（Levenshtein距离）不超过maxDistance的搜索键及其编辑距离
+// maxDistance大于types.MaxFuzzyDistance时按types.MaxFuzzyDistance计算
+//
+// 按字典序遍历词典，相邻搜索键共享公共前缀的动态规划行；某个前缀的编辑距离下界
+// 超过maxDistance时跳过以它开头的全部搜索键，相当于在词典上运行Levenshtein自动机。
+func (indexer *Indexer) FuzzyKeywords(term string, maxDistance int) (map[string]int, error) {
+	if !indexer.initialized {
+		return nil, types.ErrNotInitialized
+	}
+
+	indexer.tableLock.RLock()
+	defer indexer.tableLock.RUnlock()
+	return indexer.fuzzyKeywords(term, maxDistance), nil
+}
+
+// 同FuzzyKeywords，调用时必须持有tableLock的读锁
+func (indexer *Indexer) fuzzyKeywords(term string, maxDistance int) map[string]int {
+	if maxDistance > types.MaxFuzzyDistance {
+		maxDistance = types.MaxFuzzyDistance
+	}
+	output := make(map[string]int)
+	target := []rune(term)
+	keywords := indexer.tableLock.keywords
+
+	// rows[j]为target和当前搜索键前j个字符的编辑距离行
+	firstRow := make([]int, len(target)+1)
+	for i := range firstRow {
+		firstRow[i] = i
+	}
+	rows := [][]int{firstRow}
+	var previous []rune
+
+	for i := 0; i < len(keywords); {
+		keyword := []rune(keywords[i])
+		common := 0
+		for common < len(previous) && common < len(keyword) && previous[common] == keyword[common] {
+			common++
+		}
+		rows = rows[:common+1]
+
+		pruned := false
+		for j := common; j < len(keyword); j++ {
+			row := nextLevenshteinRow(rows[j], keyword[j], target)
+			rows = append(rows, row)
+			if minInts(row) > maxDistance {
+				// 以keyword[:j+1]开头的搜索键都不满足，它们在词典中是连续的
+				prefix := string(keyword[:j+1])
+				i += sort.Search(len(keywords)-i, func(k int) bool {
+					return keywords[i+k] > prefix && !strings.HasPrefix(keywords[i+k], prefix)
+				})
+				previous = keyword[:j+1]
+				pruned = true
+				break
+			}
+		}
+		if pruned {
+			continue
+		}
+		if distance := rows[len(keyword)][len(target)]; distance <= maxDistance {
+			output[keywords[i]] = distance
+		}
+		previous = keyword
+		i++
+	}
+	return output
+}
+
+// 由编辑距离行row计算在搜索键后面增加字符r之后的行
+func nextLevenshteinRow(row []int, r rune, target []rune) []int {
+	next := make([]int, len(row))
+	next[0] = row[0] + 1
+	for i := 1; i < len(row); i++ {
+		cost := 1
+		if target[i-1] == r {
+			cost = 0
+		}
+		next[i] = minInts([]int{row[i] + 1, next[i-1] + 1, row[i-1] + cost})
+	}
+	return next
+}
+
+func minInts(values []int) int {
+	min := values[0]
+	for _, value := range values[1:] {
+		if value < min {
+			min = value
+		}
+	}
+	return min
+}
@@ -1,7 +1,7 @@
 package core
 
 import (
-	"log"
+	"context"
 	"math"
 	"sort"
 	"sync"
@@ -10,6 +10,9 @@ import (
 	"github.com/huichen/wukong/utils"
 )
 
+// 查找和排序时每处理这么多文档检查一次context是否结束
+const contextCheckInterval = 1024
+
 // 索引器
 type Indexer struct {
 	// 从搜索键到文档列表的反向索引
@@ -18,6 +21,9 @@ type Indexer struct {
 		sync.RWMutex
 		table     map[string]*KeywordIndices
 		docsState map[uint64]int // nil: 表示无状态记录，0: 存在于索引中，1: 等待删除，2: 等待加入
+
+		// table中的全部搜索键，按字典序排列，用于前缀查找
+		keywords []string
 	}
 	addCacheLock struct {
 		sync.RWMutex
@@ -49,12 +55,18 @@ type KeywordIndices struct {
 	docIds      []uint64  // 全部类型都有
 	frequencies []float32 // IndexType == FrequenciesIndex
 	locations   [][]int   // IndexType == LocationsIndex
+
+	// 当IndexerInitOptions.CompressPostings为true时使用压缩格式，上面的切片为空
+	compressed *compressedPostings
+
+	// 查询时缓存的解码后的块，见reader
+	block *decodedBlock
 }
 
 // 初始化索引器
-func (indexer *Indexer) Init(options types.IndexerInitOptions) {
+func (indexer *Indexer) Init(options types.IndexerInitOptions) error {
 	if indexer.initialized {
-		log.Fatal("索引器不能初始化两次")
+		return types.ErrAlreadyInitialized
 	}
 	options.Init()
 	indexer.initOptions = options
@@ -65,6 +77,7 @@ func (indexer *Indexer) Init(options types.IndexerInitOptions) {
 	indexer.addCacheLock.addCache = make([]*types.DocumentIndex, indexer.initOptions.DocCacheSize)
 	indexer.removeCacheLock.removeCache = make([]uint64, indexer.initOptions.DocCacheSize*2)
 	indexer.docTokenLengths = make(map[uint64]float32)
+	return nil
 }
 
 func (indexer *Indexer) Close() {
@@ -76,9 +89,11 @@ func (indexer *Indexer) Close() {
 		ki.docIds = nil
 		ki.frequencies = nil
 		ki.locations = nil
+		ki.compressed = nil
 	}
 	indexer.tableLock.table = nil
 	indexer.tableLock.docsState = nil
+	indexer.tableLock.keywords = nil
 
 	indexer.addCacheLock.addCache.Close()
 	indexer.addCacheLock.addCache = nil
@@ -89,18 +104,61 @@ func (indexer *Indexer) Close() {
 
 // 从KeywordIndices中得到第i个文档的DocId
 func (indexer *Indexer) getDocId(ti *KeywordIndices, i int) uint64 {
+	if ti.compressed != nil {
+		return ti.getBlock(i/postingBlockSize, indexer.initOptions.IndexType).docIds[i%postingBlockSize]
+	}
 	return ti.docIds[i]
 }
 
+// 从KeywordIndices中得到第i个文档的词频，仅当IndexType == FrequenciesIndex时有效
+func (indexer *Indexer) getFrequency(ti *KeywordIndices, i int) float32 {
+	if ti.compressed != nil {
+		return ti.getBlock(i/postingBlockSize, indexer.initOptions.IndexType).frequencies[i%postingBlockSize]
+	}
+	return ti.frequencies[i]
+}
+
+// 从KeywordIndices中得到第i个文档中关键词的位置，仅当IndexType == LocationsIndex时有效
+func (indexer *Indexer) getLocations(ti *KeywordIndices, i int) []int {
+	if ti.compressed != nil {
+		return ti.getBlock(i/postingBlockSize, indexer.initOptions.IndexType).locations[i%postingBlockSize]
+	}
+	return ti.locations[i]
+}
+
+// 得到KeywordIndices中全部文档的DocId，调用者不能修改返回的切片
+func (indexer *Indexer) getDocIds(ti *KeywordIndices) []uint64 {
+	if ti.compressed != nil {
+		docIds := make([]uint64, 0, ti.compressed.length)
+		for b := 0; b < ti.compressed.numBlocks(); b++ {
+			docIds = append(docIds, ti.getBlock(b, indexer.initOptions.IndexType).docIds...)
+		}
+		return docIds
+	}
+	return ti.docIds
+}
+
+// 得到查询时使用的KeywordIndices
+// 压缩格式时返回一个只属于本次查询的副本，用来缓存解码后的块，避免和其它查询冲突
+func (indexer *Indexer) reader(ti *KeywordIndices) *KeywordIndices {
+	if ti == nil || ti.compressed == nil {
+		return ti
+	}
+	return &KeywordIndices{compressed: ti.compressed, block: &decodedBlock{index: -1}}
+}
+
 // 得到KeywordIndices中文档总数
 func (indexer *Indexer) getIndexLength(ti *KeywordIndices) int {
+	if ti.compressed != nil {
+		return ti.compressed.length
+	}
 	return len(ti.docIds)
 }
 
 // 向 ADDCACHE 中加入一个文档
-func (indexer *Indexer) AddDocumentToCache(document *types.DocumentIndex, forceUpdate bool) {
+func (indexer *Indexer) AddDocumentToCache(document *types.DocumentIndex, forceUpdate bool) error {
 	if !indexer.initialized {
-		log.Fatal("索引器尚未初始化")
+		return types.ErrNotInitialized
 	}
 
 	indexer.addCacheLock.Lock()
@@ -136,7 +194,12 @@ func (indexer *Indexer) AddDocumentToCache(document *types.DocumentIndex, forceU
 		}
 
 		indexer.tableLock.Unlock()
-		if indexer.RemoveDocumentToCache(0, forceUpdate) {
+		removed, err := indexer.RemoveDocumentToCache(0, forceUpdate)
+		if err != nil {
+			indexer.addCacheLock.Unlock()
+			return err
+		}
+		if removed {
 			// 只有当存在于索引表中的文档已被删除，其才可以重新加入到索引表中
 			position = 0
 		}
@@ -145,22 +208,54 @@ func (indexer *Indexer) AddDocumentToCache(document *types.DocumentIndex, forceU
 		indexer.addCacheLock.addCachePointer = position
 		indexer.addCacheLock.Unlock()
 		sort.Sort(addCachedDocuments)
-		indexer.AddDocuments(&addCachedDocuments)
-	} else {
-		indexer.addCacheLock.Unlock()
+		return indexer.AddDocuments(&addCachedDocuments)
 	}
+	indexer.addCacheLock.Unlock()
+	return nil
 }
 
 // 向反向索引表中加入 ADDCACHE 中所有文档
-func (indexer *Indexer) AddDocuments(documents *types.DocumentsIndex) {
+func (indexer *Indexer) AddDocuments(documents *types.DocumentsIndex) error {
 	if !indexer.initialized {
-		log.Fatal("索引器尚未初始化")
+		return types.ErrNotInitialized
 	}
 
 	indexer.tableLock.Lock()
 	defer indexer.tableLock.Unlock()
 	indexPointers := make(map[string]int, len(indexer.tableLock.table))
 
+	// 压缩格式时只还原每行中从新文档所在的块开始的部分，全部文档加入后再重新压缩
+	// DocId递增加入时只需还原最后一块
+	if indexer.initOptions.CompressPostings {
+		minDocIds := make(map[string]uint64)
+		for _, document := range *documents {
+			for _, keyword := range document.Keywords {
+				if docId, found := minDocIds[keyword.Text]; !found || document.DocId < docId {
+					minDocIds[keyword.Text] = document.DocId
+				}
+			}
+		}
+		heads := make(map[string]*compressedPostings, len(minDocIds))
+		for keyword, docId := range minDocIds {
+			if indices, found := indexer.tableLock.table[keyword]; found && indices.compressed != nil {
+				heads[keyword] = indexer.decompressFrom(indices, indices.compressed.firstAffectedBlock(docId))
+			}
+		}
+		defer func() {
+			for keyword := range minDocIds {
+				if indices, found := indexer.tableLock.table[keyword]; found {
+					indexer.compressAfter(indices, heads[keyword])
+				}
+			}
+		}()
+	}
+
+	// 新加入的搜索键，最后一起合并到词典中
+	var newKeywords []string
+	defer func() {
+		indexer.addKeywords(newKeywords)
+	}()
+
 	// DocId 递增顺序遍历插入文档保证索引移动次数最少
 	for i, document := range *documents {
 		if i < len(*documents)-1 && (*documents)[i].DocId == (*documents)[i+1].DocId {
@@ -187,12 +282,13 @@ func (indexer *Indexer) AddDocuments(documents *types.DocumentsIndex) {
 				ti := KeywordIndices{}
 				switch indexer.initOptions.IndexType {
 				case types.LocationsIndex:
-					ti.locations = [][]int{keyword.Starts}
+					ti.locations = [][]int{sortedLocations(keyword.Starts)}
 				case types.FrequenciesIndex:
 					ti.frequencies = []float32{keyword.Frequency}
 				}
 				ti.docIds = []uint64{document.DocId}
 				indexer.tableLock.table[keyword.Text] = &ti
+				newKeywords = append(newKeywords, keyword.Text)
 				continue
 			}
 
@@ -204,7 +300,7 @@ func (indexer *Indexer) AddDocuments(documents *types.DocumentsIndex) {
 			case types.LocationsIndex:
 				indices.locations = append(indices.locations, []int{})
 				copy(indices.locations[position+1:], indices.locations[position:])
-				indices.locations[position] = keyword.Starts
+				indices.locations[position] = sortedLocations(keyword.Starts)
 			case types.FrequenciesIndex:
 				indices.frequencies = append(indices.frequencies, float32(0))
 				copy(indices.frequencies[position+1:], indices.frequencies[position:])
@@ -221,13 +317,25 @@ func (indexer *Indexer) AddDocuments(documents *types.DocumentsIndex) {
 			indexer.numDocuments++
 		}
 	}
+	return nil
+}
+
+// 索引中的位置按从小到大排序，短语查询用二分查找（见matchPhrase）
+// 用户提供的位置（DocumentIndexData.Tokens）不一定有序，此时排序一份副本
+func sortedLocations(locations []int) []int {
+	if sort.IntsAreSorted(locations) {
+		return locations
+	}
+	sorted := append([]int(nil), locations...)
+	sort.Ints(sorted)
+	return sorted
 }
 
 // 向 REMOVECACHE 中加入一个待删除文档
 // 返回值表示文档是否在索引表中被删除
-func (indexer *Indexer) RemoveDocumentToCache(docId uint64, forceUpdate bool) bool {
+func (indexer *Indexer) RemoveDocumentToCache(docId uint64, forceUpdate bool) (bool, error) {
 	if !indexer.initialized {
-		log.Fatal("索引器尚未初始化")
+		return false, types.ErrNotInitialized
 	}
 
 	indexer.removeCacheLock.Lock()
@@ -254,17 +362,16 @@ func (indexer *Indexer) RemoveDocumentToCache(docId uint64, forceUpdate bool) bo
 		indexer.removeCacheLock.removeCachePointer = 0
 		indexer.removeCacheLock.Unlock()
 		sort.Sort(removeCachedDocuments)
-		indexer.RemoveDocuments(&removeCachedDocuments)
-		return true
+		return true, indexer.RemoveDocuments(&removeCachedDocuments)
 	}
 	indexer.removeCacheLock.Unlock()
-	return false
+	return false, nil
 }
 
 // 向反向索引表中删除 REMOVECACHE 中所有文档
-func (indexer *Indexer) RemoveDocuments(documents *types.DocumentsId) {
+func (indexer *Indexer) RemoveDocuments(documents *types.DocumentsId) error {
 	if !indexer.initialized {
-		log.Fatal("索引器尚未初始化")
+		return types.ErrNotInitialized
 	}
 
 	indexer.tableLock.Lock()
@@ -277,7 +384,15 @@ func (indexer *Indexer) RemoveDocuments(documents *types.DocumentsId) {
 		delete(indexer.tableLock.docsState, docId)
 	}
 
+	var removedKeywords []string
 	for keyword, indices := range indexer.tableLock.table {
+		if indices.compressed != nil {
+			if !indexer.containsAny(indices, *documents) {
+				continue
+			}
+			indexer.decompress(indices)
+		}
+
 		indicesTop, indicesPointer := 0, 0
 		documentsPointer := sort.Search(
 			len(*documents), func(i int) bool { return (*documents)[i] >= indices.docIds[0] })
@@ -316,16 +431,48 @@ func (indexer *Indexer) RemoveDocuments(documents *types.DocumentsId) {
 		}
 		if len(indices.docIds) == 0 {
 			delete(indexer.tableLock.table, keyword)
+			removedKeywords = append(removedKeywords, keyword)
+		} else if indexer.initOptions.CompressPostings {
+			indexer.compress(indices)
 		}
 	}
+	indexer.removeKeywords(removedKeywords)
+	return nil
+}
+
+// 升序的docIds中是否有文档在这一行中
+func (indexer *Indexer) containsAny(indices *KeywordIndices, docIds []uint64) bool {
+	indices = indexer.reader(indices)
+	start, end := 0, indexer.getIndexLength(indices)-1
+	for _, docId := range docIds {
+		position, found := indexer.searchIndex(indices, start, end, docId)
+		if found {
+			return true
+		}
+		if position > end {
+			return false
+		}
+		start = position
+	}
+	return false
 }
 
 // 查找包含全部搜索键(AND操作)的文档
 // 当docIds不为nil时仅从docIds指定的文档中查找
 func (indexer *Indexer) Lookup(
-	tokens []string, labels []string, docIds map[uint64]bool, countDocsOnly bool) (docs []types.IndexedDocument, numDocs int) {
+	tokens []string, labels []string, docIds map[uint64]bool, countDocsOnly bool) (
+	docs []types.IndexedDocument, numDocs int, err error) {
+	return indexer.LookupContext(context.Background(), tokens, labels, docIds, countDocsOnly)
+}
+
+// 同Lookup，查找过程中会定期检查ctx，ctx结束时中止查找并返回ctx.Err()，
+// 此时docs和numDocs为已经找到的部分结果
+func (indexer *Indexer) LookupContext(
+	ctx context.Context, tokens []string, labels []string, docIds map[uint64]bool, countDocsOnly bool) (
+	docs []types.IndexedDocument, numDocs int, err error) {
 	if !indexer.initialized {
-		log.Fatal("索引器尚未初始化")
+		err = types.ErrNotInitialized
+		return
 	}
 
 	if indexer.numDocuments == 0 {
@@ -348,7 +495,7 @@ func (indexer *Indexer) Lookup(
 			return
 		} else {
 			// 否则加入反向表中
-			table[i] = indices
+			table[i] = indexer.reader(indices)
 		}
 	}
 
@@ -365,7 +512,14 @@ func (indexer *Indexer) Lookup(
 	}
 	// 平均文本关键词长度，用于计算BM25
 	avgDocLength := indexer.totalTokenLength / float32(indexer.numDocuments)
-	for ; indexPointers[0] >= 0; indexPointers[0]-- {
+	for iteration := 0; indexPointers[0] >= 0; indexPointers[0]-- {
+		if iteration%contextCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return
+			}
+		}
+		iteration++
+
 		// 以第一个搜索键出现的文档作为基准，并遍历其他搜索键搜索同一文档
 		baseDocId := indexer.getDocId(table[0], indexPointers[0])
 		if docIds != nil {
@@ -408,8 +562,10 @@ func (indexer *Indexer) Lookup(
 			if indexer.initOptions.IndexType == types.LocationsIndex {
 				// 计算有多少关键词是带有距离信息的
 				numTokensWithLocations := 0
+				tokenLocations := make([][]int, len(tokens))
 				for i, t := range table[:len(tokens)] {
-					if len(t.locations[indexPointers[i]]) > 0 {
+					tokenLocations[i] = indexer.getLocations(t, indexPointers[i])
+					if len(tokenLocations[i]) > 0 {
 						numTokensWithLocations++
 					}
 				}
@@ -425,15 +581,12 @@ func (indexer *Indexer) Lookup(
 				}
 
 				// 计算搜索键在文档中的紧邻距离
-				tokenProximity, tokenLocations := computeTokenProximity(table[:len(tokens)], indexPointers, tokens)
+				tokenProximity, snippetLocations := computeTokenProximity(tokenLocations, tokens)
 				indexedDoc.TokenProximity = int32(tokenProximity)
-				indexedDoc.TokenSnippetLocations = tokenLocations
+				indexedDoc.TokenSnippetLocations = snippetLocations
 
 				// 添加TokenLocations
-				indexedDoc.TokenLocations = make([][]int, len(tokens))
-				for i, t := range table[:len(tokens)] {
-					indexedDoc.TokenLocations[i] = t.locations[indexPointers[i]]
-				}
+				indexedDoc.TokenLocations = tokenLocations
 			}
 
 			// 当为LocationsIndex或者FrequenciesIndex时计算BM25
@@ -444,19 +597,13 @@ func (indexer *Indexer) Lookup(
 				for i, t := range table[:len(tokens)] {
 					var frequency float32
 					if indexer.initOptions.IndexType == types.LocationsIndex {
-						frequency = float32(len(t.locations[indexPointers[i]]))
+						frequency = float32(len(indexer.getLocations(t, indexPointers[i])))
 					} else {
-						frequency = t.frequencies[indexPointers[i]]
+						frequency = indexer.getFrequency(t, indexPointers[i])
 					}
 
 					// 计算BM25
-					if len(t.docIds) > 0 && frequency > 0 && indexer.initOptions.BM25Parameters != nil && avgDocLength != 0 {
-						// 带平滑的idf
-						idf := float32(math.Log2(float64(indexer.numDocuments)/float64(len(t.docIds)) + 1))
-						k1 := indexer.initOptions.BM25Parameters.K1
-						b := indexer.initOptions.BM25Parameters.B
-						bm25 += idf * frequency * (k1 + 1) / (frequency + k1*(1-b+b*d/avgDocLength))
-					}
+					bm25 += indexer.computeBM25(frequency, indexer.getIndexLength(t), d, avgDocLength)
 				}
 				indexedDoc.BM25 = float32(bm25)
 			}
@@ -471,11 +618,28 @@ func (indexer *Indexer) Lookup(
 	return
 }
 
+// 计算一个搜索键对文档BM25的贡献
+// frequency为词频，numDocsWithKeyword为包含该搜索键的文档数，d为文档关键词长度
+func (indexer *Indexer) computeBM25(frequency float32, numDocsWithKeyword int, d float32, avgDocLength float32) float32 {
+	if numDocsWithKeyword == 0 || frequency <= 0 || indexer.initOptions.BM25Parameters == nil || avgDocLength == 0 {
+		return 0
+	}
+	// 带平滑的idf
+	idf := float32(math.Log2(float64(indexer.numDocuments)/float64(numDocsWithKeyword) + 1))
+	k1 := indexer.initOptions.BM25Parameters.K1
+	b := indexer.initOptions.BM25Parameters.B
+	return idf * frequency * (k1 + 1) / (frequency + k1*(1-b+b*d/avgDocLength))
+}
+
 // 二分法查找indices中某文档的索引项
 // 第一个返回参数为找到的位置或需要插入的位置
 // 第二个返回参数标明是否找到
 func (indexer *Indexer) searchIndex(
 	indices *KeywordIndices, start int, end int, docId uint64) (int, bool) {
+	if indices.compressed != nil {
+		return indices.compressed.search(indices, indexer.initOptions.IndexType, start, end, docId)
+	}
+
 	// 特殊情况
 	if indexer.getIndexLength(indices) == start {
 		return start, false
@@ -515,7 +679,9 @@ func (indexer *Indexer) searchIndex(
 //
 // 具体由动态规划实现，依次计算前 i 个 token 在每个出现位置的最优值。
 // 选定的 P_i 通过 tokenLocations 参数传回。
-func computeTokenProximity(table []*KeywordIndices, indexPointers []int, tokens []string) (
+//
+// locations[i]为第i个搜索键在文本中出现的位置
+func computeTokenProximity(locations [][]int, tokens []string) (
 	minTokenProximity int, tokenLocations []int) {
 	minTokenProximity = -1
 	tokenLocations = make([]int, len(tokens))
@@ -529,14 +695,14 @@ func computeTokenProximity(table []*KeywordIndices, indexPointers []int, tokens
 	// 初始化路径数组
 	path = make([][]int, len(tokens))
 	for i := 1; i < len(path); i++ {
-		path[i] = make([]int, len(table[i].locations[indexPointers[i]]))
+		path[i] = make([]int, len(locations[i]))
 	}
 
 	// 动态规划
-	currentLocations = table[0].locations[indexPointers[0]]
+	currentLocations = locations[0]
 	currentMinValues = make([]int, len(currentLocations))
 	for i := 1; i < len(tokens); i++ {
-		nextLocations = table[i].locations[indexPointers[i]]
+		nextLocations = locations[i]
 		nextMinValues = make([]int, len(nextLocations))
 		for j, _ := range nextMinValues {
 			nextMinValues[j] = -1
@@ -588,7 +754,7 @@ func computeTokenProximity(table []*KeywordIndices, indexPointers []int, tokens
 		if i != len(tokens)-1 {
 			cursor = path[i+1][cursor]
 		}
-		tokenLocations[i] = table[i].locations[indexPointers[i]][cursor]
+		tokenLocations[i] = locations[i][cursor]
 	}
 	return
 }
@@ -1,6 +1,10 @@
 package core
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"testing"
 
 	"github.com/huichen/wukong/types"
@@ -385,12 +389,43 @@ func TestLookupWithBM25(t *testing.T) {
 		},
 	}, true)
 
-	outputs, _ := indexer.Lookup([]string{"token2", "token3", "token4"}, []string{}, nil, false)
+	outputs, _, _ := indexer.Lookup([]string{"token2", "token3", "token4"}, []string{}, nil, false)
 
 	// BM25 = log2(3) * (12/9 + 28/17 + 60/33) = 6.3433
 	utils.Expect(t, "76055", int(outputs[0].BM25*10000))
 }
 
+func TestLookupQueryWithWeights(t *testing.T) {
+	var indexer Indexer
+	indexer.Init(types.IndexerInitOptions{
+		IndexType: types.FrequenciesIndex,
+		BM25Parameters: &types.BM25Parameters{
+			K1: 1,
+			B:  1,
+		},
+	})
+	indexer.AddDocumentToCache(&types.DocumentIndex{
+		DocId:       1,
+		TokenLength: 2,
+		Keywords: []types.KeywordIndex{
+			{"token1", 1, []int{0}},
+			{"token2", 1, []int{7}},
+		},
+	}, true)
+
+	query := types.AndQuery{Queries: []types.Query{
+		types.TermQuery{Text: "token1"},
+		types.TermQuery{Text: "token2"},
+	}}
+	docs, _, _ := indexer.LookupQuery(query, nil, false)
+	bm25 := docs[0].BM25
+
+	// token2的权重为0.5时BM25变为原来的3/4
+	query.Queries[1] = types.TermQuery{Text: "token2", Weight: 0.5}
+	docs, _, _ = indexer.LookupQuery(query, nil, false)
+	utils.Expect(t, "7500", int(docs[0].BM25/bm25*10000+0.5))
+}
+
 func TestLookupWithinDocIds(t *testing.T) {
 	var indexer Indexer
 	indexer.Init(types.IndexerInitOptions{IndexType: types.LocationsIndex})
@@ -458,6 +493,447 @@ func TestLookupWithLocations(t *testing.T) {
 	}, true)
 
 	indexer.RemoveDocumentToCache(2, true)
-	docs, _ := indexer.Lookup([]string{"token2", "token3"}, []string{}, nil, false)
+	docs, _, _ := indexer.Lookup([]string{"token2", "token3"}, []string{}, nil, false)
 	utils.Expect(t, "[[0 21] [28]]", docs[0].TokenLocations)
 }
+
+func TestLookupContext(t *testing.T) {
+	var indexer Indexer
+	indexer.Init(types.IndexerInitOptions{IndexType: types.LocationsIndex})
+	indexer.AddDocumentToCache(&types.DocumentIndex{
+		DocId: 1,
+		Keywords: []types.KeywordIndex{
+			{"token2", 0, []int{0}},
+		},
+	}, true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	docs, numDocs, err := indexer.LookupContext(ctx, []string{"token2"}, []string{}, nil, false)
+	utils.Expect(t, "[1 0 [0]] ", indexedDocsToString(docs, numDocs, err))
+
+	cancel()
+	docs, numDocs, err = indexer.LookupContext(ctx, []string{"token2"}, []string{}, nil, false)
+	utils.Expect(t, "context canceled", indexedDocsToString(docs, numDocs, err))
+	docs, numDocs, err = indexer.LookupQueryContext(ctx, types.TermQuery{Text: "token2"}, nil, false)
+	utils.Expect(t, "context canceled", indexedDocsToString(docs, numDocs, err))
+}
+
+func TestCountFacets(t *testing.T) {
+	var indexer Indexer
+	indexer.Init(types.IndexerInitOptions{IndexType: types.DocIdsIndex})
+	indexer.AddDocumentToCache(&types.DocumentIndex{
+		DocId: 1,
+		Keywords: []types.KeywordIndex{
+			{"token1", 0, []int{}},
+			{"label:a", 0, []int{}},
+		},
+	}, false)
+	indexer.AddDocumentToCache(&types.DocumentIndex{
+		DocId: 2,
+		Keywords: []types.KeywordIndex{
+			{"label:a", 0, []int{}},
+			{"label:b", 0, []int{}},
+		},
+	}, false)
+	indexer.AddDocumentToCache(&types.DocumentIndex{
+		DocId: 3,
+		Keywords: []types.KeywordIndex{
+			{"label:b", 0, []int{}},
+		},
+	}, true)
+
+	facets, _ := indexer.CountFacets([]uint64{3, 1}, []types.FacetRequest{
+		{Prefix: "label:"},
+		{Name: "labels", Labels: []string{"label:a", "label:c"}},
+	})
+	utils.Expect(t, "map[label:a:1 label:b:1]", facets["label:"])
+	utils.Expect(t, "map[label:a:1 label:c:0]", facets["labels"])
+}
+
+func TestLookupQuery(t *testing.T) {
+	var indexer Indexer
+	indexer.Init(types.IndexerInitOptions{IndexType: types.LocationsIndex})
+	// doc1 = "token2 token3"
+	indexer.AddDocumentToCache(&types.DocumentIndex{
+		DocId: 1,
+		Keywords: []types.KeywordIndex{
+			{"token2", 0, []int{0}},
+			{"token3", 0, []int{7}},
+		},
+	}, false)
+	// doc2 = "token1 token2 token3"
+	indexer.AddDocumentToCache(&types.DocumentIndex{
+		DocId: 2,
+		Keywords: []types.KeywordIndex{
+			{"token1", 0, []int{0}},
+			{"token2", 0, []int{7}},
+			{"token3", 0, []int{14}},
+		},
+	}, false)
+	// doc3 = "token1 token2" + "label1"
+	indexer.AddDocumentToCache(&types.DocumentIndex{
+		DocId: 3,
+		Keywords: []types.KeywordIndex{
+			{"token1", 0, []int{0}},
+			{"token2", 0, []int{7}},
+			{"label1", 0, []int{}},
+		},
+	}, false)
+	// doc4 = "token4"
+	indexer.AddDocumentToCache(&types.DocumentIndex{
+		DocId: 4,
+		Keywords: []types.KeywordIndex{
+			{"token4", 0, []int{0}},
+		},
+	}, true)
+
+	// token1 OR token3
+	utils.Expect(t, "[3 0 [0 -1]] [2 8 [0 14]] [1 0 [-1 7]] ",
+		indexedDocsToString(indexer.LookupQuery(types.OrQuery{Queries: []types.Query{
+			types.TermQuery{Text: "token1"},
+			types.TermQuery{Text: "token3"},
+		}}, nil, false)))
+
+	// token2 -token1
+	utils.Expect(t, "[1 0 [0]] ",
+		indexedDocsToString(indexer.LookupQuery(types.AndQuery{Queries: []types.Query{
+			types.TermQuery{Text: "token2"},
+			types.NotQuery{Query: types.TermQuery{Text: "token1"}},
+		}}, nil, false)))
+
+	// NOT token2
+	utils.Expect(t, "[4 0 []] ",
+		indexedDocsToString(indexer.LookupQuery(
+			types.NotQuery{Query: types.TermQuery{Text: "token2"}}, nil, false)))
+
+	// (token1 OR token4) label:label1
+	utils.Expect(t, "[3 0 [0 -1]] ",
+		indexedDocsToString(indexer.LookupQuery(types.AndQuery{Queries: []types.Query{
+			types.OrQuery{Queries: []types.Query{
+				types.TermQuery{Text: "token1"},
+				types.TermQuery{Text: "token4"},
+			}},
+			types.LabelQuery{Label: "label1"},
+		}}, nil, false)))
+
+	// 不存在的搜索键
+	utils.Expect(t, "", indexedDocsToString(indexer.LookupQuery(types.AndQuery{Queries: []types.Query{
+		types.TermQuery{Text: "token1"},
+		types.TermQuery{Text: "token5"},
+	}}, nil, false)))
+
+	docIds := make(map[uint64]bool)
+	docIds[1] = true
+	docIds[3] = true
+	_, numDocs, _ := indexer.LookupQuery(types.TermQuery{Text: "token2"}, docIds, true)
+	utils.Expect(t, "2", numDocs)
+}
+
+func TestLookupPhraseQuery(t *testing.T) {
+	var indexer Indexer
+	indexer.Init(types.IndexerInitOptions{IndexType: types.LocationsIndex})
+	// doc1 = "token1 token2 token3"
+	indexer.AddDocumentToCache(&types.DocumentIndex{
+		DocId: 1,
+		Keywords: []types.KeywordIndex{
+			{"token1", 0, []int{0}},
+			{"token2", 0, []int{7}},
+			{"token3", 0, []int{14}},
+		},
+	}, false)
+	// doc2 = "token1token2 token3 token1"
+	indexer.AddDocumentToCache(&types.DocumentIndex{
+		DocId: 2,
+		Keywords: []types.KeywordIndex{
+			{"token1", 0, []int{0, 20}},
+			{"token2", 0, []int{6}},
+			{"token3", 0, []int{13}},
+		},
+	}, false)
+	// doc3 = "token2 token1"
+	indexer.AddDocumentToCache(&types.DocumentIndex{
+		DocId: 3,
+		Keywords: []types.KeywordIndex{
+			{"token1", 0, []int{7}},
+			{"token2", 0, []int{0}},
+		},
+	}, true)
+
+	phrase := types.PhraseQuery{Terms: []string{"token1", "token2"}}
+	utils.Expect(t, "[2 0 [0 6]] ", indexedDocsToString(indexer.LookupQuery(phrase, nil, false)))
+
+	phrase.Gaps = []int{1}
+	utils.Expect(t, "[1 1 [0 7]] ", indexedDocsToString(indexer.LookupQuery(phrase, nil, false)))
+
+	phrase.Slop = 1
+	utils.Expect(t, "[2 0 [0 6]] [1 1 [0 7]] ", indexedDocsToString(indexer.LookupQuery(phrase, nil, false)))
+
+	phrase = types.PhraseQuery{Terms: []string{"token1", "token2", "token3"}, Gaps: []int{1, 1}}
+	utils.Expect(t, "[1 2 [0 7 14]] ", indexedDocsToString(indexer.LookupQuery(phrase, nil, false)))
+	phrase.Slop = 1
+	utils.Expect(t, "[2 1 [0 6 13]] [1 2 [0 7 14]] ", indexedDocsToString(indexer.LookupQuery(phrase, nil, false)))
+
+	// 用户提供的位置可以是无序的，doc4 = "token2 token1token2 token1"
+	indexer.AddDocumentToCache(&types.DocumentIndex{
+		DocId: 4,
+		Keywords: []types.KeywordIndex{
+			{"token1", 0, []int{20, 7}},
+			{"token2", 0, []int{13, 0}},
+		},
+	}, true)
+	phrase = types.PhraseQuery{Terms: []string{"token1", "token2"}}
+	utils.Expect(t, "[4 0 [7 13]] [2 0 [0 6]] ", indexedDocsToString(indexer.LookupQuery(phrase, nil, false)))
+}
+
+func TestCompressPostings(t *testing.T) {
+	for _, indexType := range []int{types.DocIdsIndex, types.FrequenciesIndex, types.LocationsIndex} {
+		var indexer, compressed Indexer
+		indexer.Init(types.IndexerInitOptions{IndexType: indexType})
+		compressed.Init(types.IndexerInitOptions{IndexType: indexType, CompressPostings: true})
+
+		// 文档数超过一块，并分多次加入
+		for docId := uint64(1); docId <= 300; docId++ {
+			keywords := []types.KeywordIndex{{"token1", float32(docId % 3), []int{0}}}
+			if docId%2 == 0 {
+				keywords = append(keywords, types.KeywordIndex{"token2", 1, []int{7, 21}})
+			}
+			if docId%5 == 0 {
+				keywords = append(keywords, types.KeywordIndex{"token3", 2, []int{14}})
+			}
+			document := &types.DocumentIndex{DocId: docId, TokenLength: 4, Keywords: keywords}
+			indexer.AddDocumentToCache(document, docId%100 == 0)
+			compressed.AddDocumentToCache(document, docId%100 == 0)
+		}
+		utils.Expect(t, "true", compressed.tableLock.table["token1"].compressed != nil)
+		utils.Expect(t, indicesToString(&indexer, "token2"), indicesToString(&compressed, "token2"))
+
+		for _, docId := range []uint64{2, 130, 150, 299} {
+			indexer.RemoveDocumentToCache(docId, false)
+			compressed.RemoveDocumentToCache(docId, false)
+		}
+		indexer.RemoveDocumentToCache(0, true)
+		compressed.RemoveDocumentToCache(0, true)
+		utils.Expect(t, indicesToString(&indexer, "token1"), indicesToString(&compressed, "token1"))
+
+		docs, numDocs, _ := indexer.Lookup([]string{"token1", "token2"}, []string{}, nil, false)
+		compressedDocs, compressedNumDocs, _ := compressed.Lookup([]string{"token1", "token2"}, []string{}, nil, false)
+		utils.Expect(t, fmt.Sprint(numDocs), compressedNumDocs)
+		utils.Expect(t, fmt.Sprint(docs), compressedDocs)
+
+		query := types.OrQuery{Queries: []types.Query{
+			types.PhraseQuery{Terms: []string{"token1", "token2"}, Gaps: []int{1}},
+			types.TermQuery{Text: "token3"},
+		}}
+		docs, numDocs, _ = indexer.LookupQuery(query, nil, false)
+		compressedDocs, compressedNumDocs, _ = compressed.LookupQuery(query, nil, false)
+		utils.Expect(t, fmt.Sprint(numDocs), compressedNumDocs)
+		utils.Expect(t, fmt.Sprint(docs), compressedDocs)
+
+		// 与、非和短语查询在压缩格式上逐块查找
+		for _, query := range []types.Query{
+			types.AndQuery{Queries: []types.Query{types.TermQuery{Text: "token2"}, types.TermQuery{Text: "token3"}}},
+			types.AndQuery{Queries: []types.Query{types.TermQuery{Text: "token1"}, types.NotQuery{Query: types.TermQuery{Text: "token2"}}}},
+			types.AndQuery{Queries: []types.Query{
+				types.OrQuery{Queries: []types.Query{types.TermQuery{Text: "token2"}, types.TermQuery{Text: "token3"}}},
+				types.NotQuery{Query: types.TermQuery{Text: "token3"}},
+				types.TermQuery{Text: "token1"},
+			}},
+			types.NotQuery{Query: types.TermQuery{Text: "token2"}},
+			types.PhraseQuery{Terms: []string{"token3", "token2"}, Gaps: []int{7}},
+		} {
+			docs, numDocs, _ = indexer.LookupQuery(query, nil, false)
+			compressedDocs, compressedNumDocs, _ = compressed.LookupQuery(query, nil, false)
+			utils.Expect(t, fmt.Sprint(numDocs), compressedNumDocs)
+			utils.Expect(t, fmt.Sprint(docs), compressedDocs)
+		}
+		docs, numDocs, _ = compressed.LookupQuery(types.AndQuery{Queries: []types.Query{
+			types.TermQuery{Text: "token2"}, types.TermQuery{Text: "token3"}}}, nil, false)
+		utils.Expect(t, "28", numDocs)
+	}
+}
+
+func TestCompressPostingsIncremental(t *testing.T) {
+	for _, indexType := range []int{types.DocIdsIndex, types.FrequenciesIndex, types.LocationsIndex} {
+		var indexer, compressed Indexer
+		indexer.Init(types.IndexerInitOptions{IndexType: indexType})
+		compressed.Init(types.IndexerInitOptions{IndexType: indexType, CompressPostings: true})
+		addDocuments := func(docIds []uint64) {
+			for i, docId := range docIds {
+				document := &types.DocumentIndex{DocId: docId, TokenLength: 2, Keywords: []types.KeywordIndex{
+					{"token1", float32(docId % 3), []int{int(docId % 7)}},
+				}}
+				indexer.AddDocumentToCache(document, i == len(docIds)-1)
+				compressed.AddDocumentToCache(document, i == len(docIds)-1)
+			}
+		}
+
+		// DocId递增时分多次加入，每次只修改最后一块
+		for start := uint64(10); start < 400; start += 50 {
+			var docIds []uint64
+			for docId := start; docId < start+50; docId += 2 {
+				docIds = append(docIds, docId)
+			}
+			addDocuments(docIds)
+			utils.Expect(t, indicesToString(&indexer, "token1"), indicesToString(&compressed, "token1"))
+		}
+		// 正好填满最后一块后再加入
+		var docIds []uint64
+		for docId := uint64(1000); compressed.getIndexLength(compressed.tableLock.table["token1"])+len(docIds) < 2*postingBlockSize; docId++ {
+			docIds = append(docIds, docId)
+		}
+		addDocuments(docIds)
+		addDocuments([]uint64{2000, 2001})
+		utils.Expect(t, indicesToString(&indexer, "token1"), indicesToString(&compressed, "token1"))
+
+		// 插入到中间的块和最前面
+		addDocuments([]uint64{1, 3, 151, 153, 1500})
+		utils.Expect(t, indicesToString(&indexer, "token1"), indicesToString(&compressed, "token1"))
+
+		docs, numDocs, _ := indexer.LookupQuery(types.TermQuery{Text: "token1"}, nil, false)
+		compressedDocs, compressedNumDocs, _ := compressed.LookupQuery(types.TermQuery{Text: "token1"}, nil, false)
+		utils.Expect(t, fmt.Sprint(numDocs), compressedNumDocs)
+		utils.Expect(t, fmt.Sprint(docs), compressedDocs)
+	}
+}
+
+func TestPrefixKeywords(t *testing.T) {
+	var indexer Indexer
+	indexer.Init(types.IndexerInitOptions{IndexType: types.DocIdsIndex})
+	indexer.AddDocumentToCache(&types.DocumentIndex{
+		DocId: 1,
+		Keywords: []types.KeywordIndex{
+			{"apple", 0, []int{}},
+			{"apply", 0, []int{}},
+			{"banana", 0, []int{}},
+		},
+	}, true)
+	indexer.AddDocumentToCache(&types.DocumentIndex{
+		DocId: 2,
+		Keywords: []types.KeywordIndex{
+			{"app", 0, []int{}},
+			{"apple", 0, []int{}},
+		},
+	}, true)
+	utils.Expect(t, "[app apple apply banana]", indexer.tableLock.keywords)
+
+	keywords, _ := indexer.PrefixKeywords("appl")
+	utils.Expect(t, "map[apple:2 apply:1]", keywords)
+	frequencies, _ := indexer.DocumentFrequencies([]string{"apple", "cherry"})
+	utils.Expect(t, "map[apple:2 cherry:0]", frequencies)
+
+	docs, _, _ := indexer.LookupQuery(types.PrefixQuery{Prefix: "appl"}, nil, false)
+	utils.Expect(t, "[2 1]", docIdsOf(docs))
+	docs, _, _ = indexer.LookupQuery(types.PrefixQuery{Prefix: "cherry"}, nil, false)
+	utils.Expect(t, "0", len(docs))
+
+	indexer.RemoveDocumentToCache(1, true)
+	utils.Expect(t, "[app apple]", indexer.tableLock.keywords)
+	keywords, _ = indexer.PrefixKeywords("appl")
+	utils.Expect(t, "map[apple:1]", keywords)
+}
+
+func TestFuzzyKeywords(t *testing.T) {
+	var indexer Indexer
+	indexer.Init(types.IndexerInitOptions{
+		IndexType: types.FrequenciesIndex,
+		BM25Parameters: &types.BM25Parameters{
+			K1: 1,
+			B:  1,
+		},
+	})
+	indexer.AddDocumentToCache(&types.DocumentIndex{
+		DocId:       1,
+		TokenLength: 3,
+		Keywords: []types.KeywordIndex{
+			{"apple", 1, []int{}},
+			{"apply", 1, []int{}},
+			{"banana", 1, []int{}},
+		},
+	}, false)
+	indexer.AddDocumentToCache(&types.DocumentIndex{
+		DocId:       2,
+		TokenLength: 2,
+		Keywords: []types.KeywordIndex{
+			{"ample", 1, []int{}},
+			{"北京", 1, []int{}},
+		},
+	}, true)
+
+	keywords, _ := indexer.FuzzyKeywords("aple", 1)
+	utils.Expect(t, "map[ample:1 apple:1]", keywords)
+	keywords, _ = indexer.FuzzyKeywords("aple", 2)
+	utils.Expect(t, "map[ample:1 apple:1 apply:2]", keywords)
+	keywords, _ = indexer.FuzzyKeywords("banan", 5)
+	utils.Expect(t, "map[banana:1]", keywords)
+	keywords, _ = indexer.FuzzyKeywords("apple", 0)
+	utils.Expect(t, "map[apple:0]", keywords)
+	keywords, _ = indexer.FuzzyKeywords("北景", 1)
+	utils.Expect(t, "map[北京:1]", keywords)
+
+	docs, _, _ := indexer.LookupQuery(types.FuzzyQuery{Text: "apply", MaxDistance: 2}, nil, false)
+	utils.Expect(t, "[2 1]", docIdsOf(docs))
+
+	// 编辑距离为2的ample权重低于编辑距离为1的apple
+	docs, _, _ = indexer.LookupQuery(types.OrQuery{Queries: []types.Query{
+		types.TermQuery{Text: "apple", Weight: types.FuzzyWeight(1)},
+		types.TermQuery{Text: "ample", Weight: types.FuzzyWeight(2)},
+	}}, nil, false)
+	utils.Expect(t, "[2 1]", docIdsOf(docs))
+	utils.Expect(t, "true", docs[1].BM25 > docs[0].BM25)
+}
+
+func TestIndexerSnapshot(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		options := types.IndexerInitOptions{
+			IndexType:        types.LocationsIndex,
+			CompressPostings: compress,
+		}
+		var indexer Indexer
+		indexer.Init(options)
+		for docId := uint64(1); docId <= 300; docId++ {
+			keywords := []types.KeywordIndex{{"token1", 1, []int{int(docId)}}}
+			if docId%3 == 0 {
+				keywords = append(keywords, types.KeywordIndex{"token2", 2, []int{5, 1}})
+			}
+			indexer.AddDocumentToCache(&types.DocumentIndex{
+				DocId: docId, TokenLength: 2, Keywords: keywords}, false)
+		}
+		indexer.AddDocumentToCache(nil, true)
+		indexer.RemoveDocumentToCache(3, true)
+
+		var buffer bytes.Buffer
+		utils.Expect(t, "<nil>", indexer.Snapshot(&buffer))
+
+		var restored Indexer
+		restored.Init(options)
+		utils.Expect(t, "<nil>", restored.Restore(bytes.NewReader(buffer.Bytes())))
+		utils.Expect(t, indicesToString(&indexer, "token1"), indicesToString(&restored, "token1"))
+		utils.Expect(t, indicesToString(&indexer, "token2"), indicesToString(&restored, "token2"))
+		utils.Expect(t, "[token1 token2]", restored.tableLock.keywords)
+		utils.Expect(t, "299", restored.numDocuments)
+		utils.Expect(t, "598", restored.totalTokenLength)
+
+		docs, _, _ := restored.LookupQuery(types.PhraseQuery{Terms: []string{"token2"}}, nil, false)
+		utils.Expect(t, "99", len(docs))
+		// 无序的位置在索引时已经排序
+		utils.Expect(t, "[1 5]", restored.getLocations(restored.reader(restored.tableLock.table["token2"]), 0))
+
+		// 快照之后仍然可以修改索引
+		restored.AddDocumentToCache(&types.DocumentIndex{
+			DocId: 301, Keywords: []types.KeywordIndex{{"token2", 1, []int{0}}}}, true)
+		docs, _, _ = restored.LookupQuery(types.TermQuery{Text: "token2"}, nil, false)
+		utils.Expect(t, "100", len(docs))
+
+		// 截断的快照
+		var broken Indexer
+		broken.Init(options)
+		err := broken.Restore(bytes.NewReader(buffer.Bytes()[:buffer.Len()-3]))
+		utils.Expect(t, "true", errors.Is(err, types.ErrInvalidSnapshot))
+		utils.Expect(t, "0", len(broken.tableLock.keywords))
+
+		var mismatched Indexer
+		mismatched.Init(types.IndexerInitOptions{IndexType: types.DocIdsIndex})
+		err = mismatched.Restore(bytes.NewReader(buffer.Bytes()))
+		utils.Expect(t, "true", errors.Is(err, types.ErrInvalidSnapshot))
+	}
+}
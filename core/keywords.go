@@ -0,0 +1,137 @@
+package core
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/huichen/wukong/types"
+)
+
+// 返回以prefix开头的全部搜索键及其文档频率（含有该搜索键的文档数）
+// prefix为空时返回空表
+func (indexer *Indexer) PrefixKeywords(prefix string) (map[string]int, error) {
+	if !indexer.initialized {
+		return nil, types.ErrNotInitialized
+	}
+
+	indexer.tableLock.RLock()
+	defer indexer.tableLock.RUnlock()
+
+	output := make(map[string]int)
+	for _, keyword := range indexer.keywordsWithPrefix(prefix) {
+		output[keyword] = indexer.getIndexLength(indexer.tableLock.table[keyword])
+	}
+	return output, nil
+}
+
+// 返回各个搜索键的文档频率，索引中没有的搜索键为0
+func (indexer *Indexer) DocumentFrequencies(keywords []string) (map[string]int, error) {
+	if !indexer.initialized {
+		return nil, types.ErrNotInitialized
+	}
+
+	indexer.tableLock.RLock()
+	defer indexer.tableLock.RUnlock()
+
+	output := make(map[string]int)
+	for _, keyword := range keywords {
+		if ti, found := indexer.tableLock.table[keyword]; found {
+			output[keyword] = indexer.getIndexLength(ti)
+		} else {
+			output[keyword] = 0
+		}
+	}
+	return output, nil
+}
+
+// 将排好序的新搜索键合并到词典中，调用时必须持有tableLock的写锁
+func (indexer *Indexer) addKeywords(keywords []string) {
+	if len(keywords) == 0 {
+		return
+	}
+	sort.Strings(keywords)
+	old := indexer.tableLock.keywords
+	merged := make([]string, 0, len(old)+len(keywords))
+	i, j := 0, 0
+	for i < len(old) && j < len(keywords) {
+		if old[i] < keywords[j] {
+			merged = append(merged, old[i])
+			i++
+		} else {
+			merged = append(merged, keywords[j])
+			j++
+		}
+	}
+	merged = append(merged, old[i:]...)
+	merged = append(merged, keywords[j:]...)
+	indexer.tableLock.keywords = merged
+}
+
+// 从词典中删除搜索键，调用时必须持有tableLock的写锁
+func (indexer *Indexer) removeKeywords(keywords []string) {
+	if len(keywords) == 0 {
+		return
+	}
+	removed := make(map[string]bool, len(keywords))
+	for _, keyword := range keywords {
+		removed[keyword] = true
+	}
+	kept := indexer.tableLock.keywords[:0]
+	for _, keyword := range indexer.tableLock.keywords {
+		if !removed[keyword] {
+			kept = append(kept, keyword)
+		}
+	}
+	indexer.tableLock.keywords = kept
+}
+
+// 以prefix开头的搜索键（按字典序），调用时必须持有tableLock的读锁
+func (indexer *Indexer) keywordsWithPrefix(prefix string) []string {
+	if prefix == "" {
+		return nil
+	}
+	keywords := indexer.tableLock.keywords
+	start := sort.SearchStrings(keywords, prefix)
+	end := start
+	for end < len(keywords) && strings.HasPrefix(keywords[end], prefix) {
+		end++
+	}
+	return keywords[start:end]
+}
+
+// 将查询中的PrefixQuery展开为以前缀开头的搜索键的OrQuery（见types.ExpandPrefixKeywords），
+// FuzzyQuery展开为满足编辑距离的搜索键的OrQuery（见types.ExpandFuzzyKeywords），
+// 调用时必须持有tableLock的读锁
+//
+// 这里只用本索引器的词典。引擎在查找前已经用全部分片的词典展开，各个分片的关键词相同
+func (indexer *Indexer) expandPrefixQueries(query types.Query) types.Query {
+	switch q := query.(type) {
+	case types.PrefixQuery:
+		frequencies := make(map[string]int)
+		for _, keyword := range indexer.keywordsWithPrefix(q.Prefix) {
+			frequencies[keyword] = indexer.getIndexLength(indexer.tableLock.table[keyword])
+		}
+		return types.ExpandPrefixKeywords(frequencies)
+	case types.FuzzyQuery:
+		if q.MaxDistance <= 0 {
+			return types.TermQuery{Text: q.Text}
+		}
+		_, or := types.ExpandFuzzyKeywords(indexer.fuzzyKeywords(q.Text, q.MaxDistance))
+		return or
+	case types.AndQuery:
+		and := types.AndQuery{}
+		for _, sub := range q.Queries {
+			and.Queries = append(and.Queries, indexer.expandPrefixQueries(sub))
+		}
+		return and
+	case types.OrQuery:
+		or := types.OrQuery{}
+		for _, sub := range q.Queries {
+			or.Queries = append(or.Queries, indexer.expandPrefixQueries(sub))
+		}
+		return or
+	case types.NotQuery:
+		return types.NotQuery{Query: indexer.expandPrefixQueries(q.Query)}
+	}
+	return query
+}
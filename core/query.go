@@ -0,0 +1,445 @@
+package core
+
+import (
+	"context"
+	"sort"
+
+	"github.com/huichen/wukong/types"
+	"github.com/huichen/wukong/utils"
+)
+
+// 按查询语法树查找文档
+// query中TermQuery的Text和LabelQuery的Label必须已经是索引中的搜索键（即已经分词）
+// 当docIds不为nil时仅从docIds指定的文档中查找
+//
+// 返回文档的BM25和紧邻距离由types.CollectTerms(query)得到的关键词计算，
+// 文档中没有出现的关键词不参与计算，其TokenSnippetLocations为-1。
+func (indexer *Indexer) LookupQuery(
+	query types.Query, docIds map[uint64]bool, countDocsOnly bool) (
+	docs []types.IndexedDocument, numDocs int, err error) {
+	return indexer.LookupQueryContext(context.Background(), query, docIds, countDocsOnly)
+}
+
+// 同LookupQuery，ctx结束时中止查找并返回ctx.Err()，此时docs和numDocs为已经找到的部分结果
+func (indexer *Indexer) LookupQueryContext(
+	ctx context.Context, query types.Query, docIds map[uint64]bool, countDocsOnly bool) (
+	docs []types.IndexedDocument, numDocs int, err error) {
+	if !indexer.initialized {
+		err = types.ErrNotInitialized
+		return
+	}
+
+	if indexer.numDocuments == 0 || query == nil {
+		return
+	}
+
+	indexer.tableLock.RLock()
+	defer indexer.tableLock.RUnlock()
+
+	query = indexer.expandPrefixQueries(query)
+	evaluator := queryEvaluator{indexer: indexer}
+	matchedDocIds := evaluator.evaluate(query)
+	if err = ctx.Err(); err != nil || len(matchedDocIds) == 0 {
+		return
+	}
+
+	tokens := types.CollectTerms(query)
+	weights := types.CollectTermWeights(query)
+	table := make([]*KeywordIndices, len(tokens))
+	for i, token := range tokens {
+		table[i] = indexer.reader(indexer.tableLock.table[token])
+	}
+
+	// 平均文本关键词长度，用于计算BM25
+	avgDocLength := indexer.totalTokenLength / float32(indexer.numDocuments)
+
+	// 从后向前输出保证先输出DocId较大文档，和Lookup一致
+	for iDoc := len(matchedDocIds) - 1; iDoc >= 0; iDoc-- {
+		if (len(matchedDocIds)-1-iDoc)%contextCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return
+			}
+		}
+		docId := matchedDocIds[iDoc]
+		if docIds != nil {
+			if _, found := docIds[docId]; !found {
+				continue
+			}
+		}
+		if docState, ok := indexer.tableLock.docsState[docId]; !ok || docState != 0 {
+			continue
+		}
+		numDocs++
+		if countDocsOnly {
+			continue
+		}
+		docs = append(docs, indexer.scoreQueryDoc(docId, tokens, weights, table, avgDocLength))
+	}
+	return
+}
+
+// 计算查询命中文档的BM25和紧邻距离，weights为各个关键词在BM25中的权重
+func (indexer *Indexer) scoreQueryDoc(docId uint64, tokens []string, weights map[string]float32,
+	table []*KeywordIndices, avgDocLength float32) types.IndexedDocument {
+	indexedDoc := types.IndexedDocument{DocId: docId}
+	if indexer.initOptions.IndexType != types.LocationsIndex &&
+		indexer.initOptions.IndexType != types.FrequenciesIndex {
+		return indexedDoc
+	}
+
+	// 找出出现在该文档中的关键词
+	var (
+		presentTable     []*KeywordIndices
+		presentPointers  []int
+		presentTokens    []string
+		presentIndices   []int
+		presentLocations [][]int
+	)
+	for i, t := range table {
+		if t == nil {
+			continue
+		}
+		position, found := indexer.searchIndex(t, 0, indexer.getIndexLength(t)-1, docId)
+		if !found {
+			continue
+		}
+		presentTable = append(presentTable, t)
+		presentPointers = append(presentPointers, position)
+		presentTokens = append(presentTokens, tokens[i])
+		presentIndices = append(presentIndices, i)
+		if indexer.initOptions.IndexType == types.LocationsIndex {
+			presentLocations = append(presentLocations, indexer.getLocations(t, position))
+		}
+	}
+
+	// 计算BM25
+	d := indexer.docTokenLengths[docId]
+	for i, t := range presentTable {
+		var frequency float32
+		if indexer.initOptions.IndexType == types.LocationsIndex {
+			frequency = float32(len(presentLocations[i]))
+		} else {
+			frequency = indexer.getFrequency(t, presentPointers[i])
+		}
+		indexedDoc.BM25 += weights[presentTokens[i]] *
+			indexer.computeBM25(frequency, indexer.getIndexLength(t), d, avgDocLength)
+	}
+
+	// 当为LocationsIndex时计算关键词紧邻距离
+	if indexer.initOptions.IndexType == types.LocationsIndex && len(presentTable) > 0 {
+		for _, locations := range presentLocations {
+			if len(locations) == 0 {
+				// 有关键词不带位置信息时不计算紧邻距离
+				return indexedDoc
+			}
+		}
+		tokenProximity, tokenLocations := computeTokenProximity(presentLocations, presentTokens)
+		indexedDoc.TokenProximity = int32(tokenProximity)
+		indexedDoc.TokenSnippetLocations = make([]int, len(tokens))
+		indexedDoc.TokenLocations = make([][]int, len(tokens))
+		for i := range tokens {
+			indexedDoc.TokenSnippetLocations[i] = -1
+		}
+		for i, index := range presentIndices {
+			indexedDoc.TokenSnippetLocations[index] = tokenLocations[i]
+			indexedDoc.TokenLocations[index] = presentLocations[i]
+		}
+	}
+	return indexedDoc
+}
+
+// 对查询语法树求值，得到满足查询的文档DocId（升序）
+// 调用时必须持有tableLock的读锁
+type queryEvaluator struct {
+	indexer *Indexer
+
+	// 索引中全部文档的DocId，仅在需要时计算
+	allDocIds []uint64
+}
+
+func (evaluator *queryEvaluator) evaluate(query types.Query) []uint64 {
+	switch q := query.(type) {
+	case types.TermQuery:
+		return evaluator.keywordDocIds(q.Text)
+	case types.LabelQuery:
+		return evaluator.keywordDocIds(q.Label)
+	case types.PhraseQuery:
+		return evaluator.evaluatePhrase(q)
+	case types.AndQuery:
+		return evaluator.evaluateAnd(q)
+	case types.OrQuery:
+		var result []uint64
+		for _, sub := range q.Queries {
+			result = unionDocIds(result, evaluator.evaluate(sub))
+		}
+		return result
+	case types.NotQuery:
+		return differenceDocIds(evaluator.getAllDocIds(), evaluator.evaluate(q.Query))
+	}
+	return nil
+}
+
+// 求与查询的结果
+//
+// 搜索键和标签不展开为DocId列表，而是用filterDocIds在其它子查询的结果中查找（压缩格式时
+// 用跳表跳过不相关的块）；只有全部子查询都是搜索键时才展开最短的一行。与NotQuery求交集等价于
+// 求差集，不必展开为全集。
+func (evaluator *queryEvaluator) evaluateAnd(query types.AndQuery) []uint64 {
+	indexer := evaluator.indexer
+	var (
+		included      []*KeywordIndices
+		excluded      []*KeywordIndices
+		excludedLists [][]uint64
+		result        []uint64
+	)
+	first := true
+	for _, sub := range query.Queries {
+		if not, ok := sub.(types.NotQuery); ok {
+			if keyword, ok := queryKeyword(not.Query); ok {
+				if indices, found := indexer.tableLock.table[keyword]; found {
+					excluded = append(excluded, indices)
+				}
+			} else {
+				excludedLists = append(excludedLists, evaluator.evaluate(not.Query))
+			}
+			continue
+		}
+		if keyword, ok := queryKeyword(sub); ok {
+			indices, found := indexer.tableLock.table[keyword]
+			if !found {
+				return nil
+			}
+			included = append(included, indices)
+			continue
+		}
+		docIds := evaluator.evaluate(sub)
+		if first {
+			result = docIds
+			first = false
+		} else {
+			result = intersectDocIds(result, docIds)
+		}
+		if len(result) == 0 {
+			return nil
+		}
+	}
+
+	// 从短的行开始查找，结果尽快变少
+	sort.Slice(included, func(i, j int) bool {
+		return indexer.getIndexLength(included[i]) < indexer.getIndexLength(included[j])
+	})
+	if first && len(included) > 0 {
+		result = indexer.getDocIds(included[0])
+		included = included[1:]
+		first = false
+	}
+	if first {
+		result = evaluator.getAllDocIds()
+	}
+	for _, indices := range included {
+		if result = indexer.filterDocIds(indices, result, true); len(result) == 0 {
+			return nil
+		}
+	}
+	for _, indices := range excluded {
+		result = indexer.filterDocIds(indices, result, false)
+	}
+	for _, docIds := range excludedLists {
+		result = differenceDocIds(result, docIds)
+	}
+	return result
+}
+
+// TermQuery和LabelQuery直接对应索引中的一行
+func queryKeyword(query types.Query) (string, bool) {
+	switch q := query.(type) {
+	case types.TermQuery:
+		return q.Text, true
+	case types.LabelQuery:
+		return q.Label, true
+	}
+	return "", false
+}
+
+// 先求短语中全部关键词的交集，再用位置信息剔除关键词没有按短语出现的文档
+// 只展开最短的一行，其它行用filterDocIds查找
+func (evaluator *queryEvaluator) evaluatePhrase(query types.PhraseQuery) []uint64 {
+	indexer := evaluator.indexer
+	if len(query.Terms) == 0 {
+		return nil
+	}
+	table := make([]*KeywordIndices, len(query.Terms))
+	shortest := 0
+	for i, term := range query.Terms {
+		indices, found := indexer.tableLock.table[term]
+		if !found {
+			return nil
+		}
+		table[i] = indexer.reader(indices)
+		if indexer.getIndexLength(indices) < indexer.getIndexLength(table[shortest]) {
+			shortest = i
+		}
+	}
+	result := indexer.getDocIds(table[shortest])
+	for i, t := range table {
+		if i == shortest {
+			continue
+		}
+		if result = indexer.filterDocIds(t, result, true); len(result) == 0 {
+			return nil
+		}
+	}
+	if indexer.initOptions.IndexType != types.LocationsIndex || len(query.Terms) == 1 {
+		return result
+	}
+
+	var matched []uint64
+	indexPointers := make([]int, len(table))
+	locations := make([][]int, len(table))
+	for _, docId := range result {
+		for i, t := range table {
+			// result是升序的，因此每次只需从上次的位置向后查找
+			indexPointers[i], _ = indexer.searchIndex(
+				t, indexPointers[i], indexer.getIndexLength(t)-1, docId)
+			locations[i] = indexer.getLocations(t, indexPointers[i])
+		}
+		if matchPhrase(locations, query.Terms, query.Gaps, query.Slop) {
+			matched = append(matched, docId)
+		}
+	}
+	return matched
+}
+
+func (evaluator *queryEvaluator) keywordDocIds(keyword string) []uint64 {
+	if indices, found := evaluator.indexer.tableLock.table[keyword]; found {
+		return evaluator.indexer.getDocIds(indices)
+	}
+	return nil
+}
+
+// 从升序的docIds中留下（keep为true）或者剔除（keep为false）出现在这一行中的文档
+// 压缩格式时按块的最后DocId跳过不含docIds的块，只解码用到的块，不还原整行
+func (indexer *Indexer) filterDocIds(ti *KeywordIndices, docIds []uint64, keep bool) []uint64 {
+	ti = indexer.reader(ti)
+	end := indexer.getIndexLength(ti) - 1
+	var result []uint64
+	position := 0
+	for _, docId := range docIds {
+		var found bool
+		position, found = indexer.searchIndex(ti, position, end, docId)
+		if found == keep {
+			result = append(result, docId)
+		}
+	}
+	return result
+}
+
+func (evaluator *queryEvaluator) getAllDocIds() []uint64 {
+	if evaluator.allDocIds == nil {
+		evaluator.allDocIds = make([]uint64, 0, len(evaluator.indexer.tableLock.docsState))
+		for docId, docState := range evaluator.indexer.tableLock.docsState {
+			if docState == 0 {
+				evaluator.allDocIds = append(evaluator.allDocIds, docId)
+			}
+		}
+		sort.Sort(types.DocumentsId(evaluator.allDocIds))
+	}
+	return evaluator.allDocIds
+}
+
+// 下面三个函数归并两个升序的DocId列表，返回新的列表
+
+func intersectDocIds(a, b []uint64) []uint64 {
+	var result []uint64
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		if a[i] < b[j] {
+			i++
+		} else if a[i] > b[j] {
+			j++
+		} else {
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+func unionDocIds(a, b []uint64) []uint64 {
+	result := make([]uint64, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i] < b[j] {
+			result = append(result, a[i])
+			i++
+		} else if a[i] > b[j] {
+			result = append(result, b[j])
+			j++
+		} else {
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	result = append(result, a[i:]...)
+	return append(result, b[j:]...)
+}
+
+func differenceDocIds(a, b []uint64) []uint64 {
+	var result []uint64
+	j := 0
+	for _, docId := range a {
+		for j < len(b) && b[j] < docId {
+			j++
+		}
+		if j < len(b) && b[j] == docId {
+			continue
+		}
+		result = append(result, docId)
+	}
+	return result
+}
+
+// 判断关键词是否按短语出现在文档中，判断条件见types.PhraseQuery的注释
+//
+// 和computeTokenProximity类似用动态规划实现，依次计算前i个关键词在第i个关键词
+// 每个出现位置的最小误差。
+func matchPhrase(locations [][]int, terms []string, gaps []int, slop int) bool {
+	costs := make([]int, len(locations[0]))
+	for i := 1; i < len(terms); i++ {
+		gap := 0
+		if i-1 < len(gaps) {
+			gap = gaps[i-1]
+		}
+		length := len(terms[i-1])
+		minGap := gap - slop
+		if minGap < 0 {
+			minGap = 0
+		}
+
+		nextCosts := make([]int, len(locations[i]))
+		reachable := false
+		for iNext, next := range locations[i] {
+			nextCosts[iNext] = -1
+			// 只有间隔在[minGap, gap+slop]之内的前一位置才可能满足条件
+			lower := next - length - gap - slop
+			upper := next - length - minGap
+			for iCurrent := sort.SearchInts(locations[i-1], lower); iCurrent < len(locations[i-1]) &&
+				locations[i-1][iCurrent] <= upper; iCurrent++ {
+				if costs[iCurrent] == -1 {
+					continue
+				}
+				cost := costs[iCurrent] + utils.AbsInt(next-locations[i-1][iCurrent]-length-gap)
+				if cost <= slop && (nextCosts[iNext] == -1 || cost < nextCosts[iNext]) {
+					nextCosts[iNext] = cost
+					reachable = true
+				}
+			}
+		}
+		if !reachable {
+			return false
+		}
+		costs = nextCosts
+	}
+	return true
+}
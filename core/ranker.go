@@ -1,7 +1,7 @@
 package core
 
 import (
-	"log"
+	"context"
 	"sort"
 	"sync"
 
@@ -14,55 +14,120 @@ type Ranker struct {
 		sync.RWMutex
 		fields map[uint64]interface{}
 		docs   map[uint64]bool
+
+		// 文档的数值属性，按列存储：属性名 -> 文档 -> 属性值
+		attributes map[string]map[uint64]types.AttributeValue
 	}
 	initialized bool
 }
 
-func (ranker *Ranker) Init() {
+func (ranker *Ranker) Init() error {
 	if ranker.initialized {
-		log.Fatal("排序器不能初始化两次")
+		return types.ErrAlreadyInitialized
 	}
 	ranker.initialized = true
 
 	ranker.lock.fields = make(map[uint64]interface{})
 	ranker.lock.docs = make(map[uint64]bool)
+	ranker.lock.attributes = make(map[string]map[uint64]types.AttributeValue)
+	return nil
 }
 
 // 给某个文档添加评分字段
-func (ranker *Ranker) AddDoc(docId uint64, fields interface{}) {
+func (ranker *Ranker) AddDoc(docId uint64, fields interface{}) error {
+	return ranker.AddDocWithAttributes(docId, fields, nil)
+}
+
+// 给某个文档添加评分字段和数值属性，文档原有的属性会被替换
+func (ranker *Ranker) AddDocWithAttributes(
+	docId uint64, fields interface{}, attributes map[string]types.AttributeValue) error {
 	if !ranker.initialized {
-		log.Fatal("排序器尚未初始化")
+		return types.ErrNotInitialized
 	}
 
 	ranker.lock.Lock()
+	defer ranker.lock.Unlock()
 	ranker.lock.fields[docId] = fields
 	ranker.lock.docs[docId] = true
-	ranker.lock.Unlock()
+	ranker.removeAttributes(docId)
+	for name, value := range attributes {
+		column, found := ranker.lock.attributes[name]
+		if !found {
+			column = make(map[uint64]types.AttributeValue)
+			ranker.lock.attributes[name] = column
+		}
+		column[docId] = value
+	}
+	return nil
+}
+
+// 调用时必须持有写锁
+func (ranker *Ranker) removeAttributes(docId uint64) {
+	for name, column := range ranker.lock.attributes {
+		delete(column, docId)
+		if len(column) == 0 {
+			delete(ranker.lock.attributes, name)
+		}
+	}
+}
+
+// 只替换某个文档的评分字段，不改变数值属性，文档不存在时返回types.ErrDocumentNotFound
+// 和Rank互斥，正在进行的排序看到的是完整的旧值或者新值
+func (ranker *Ranker) UpdateFields(docId uint64, fields interface{}) error {
+	if !ranker.initialized {
+		return types.ErrNotInitialized
+	}
+
+	ranker.lock.Lock()
+	defer ranker.lock.Unlock()
+	if !ranker.lock.docs[docId] {
+		return types.ErrDocumentNotFound
+	}
+	ranker.lock.fields[docId] = fields
+	return nil
 }
 
 // 删除某个文档的评分字段
-func (ranker *Ranker) RemoveDoc(docId uint64) {
+func (ranker *Ranker) RemoveDoc(docId uint64) error {
 	if !ranker.initialized {
-		log.Fatal("排序器尚未初始化")
+		return types.ErrNotInitialized
 	}
 
 	ranker.lock.Lock()
 	delete(ranker.lock.fields, docId)
 	delete(ranker.lock.docs, docId)
+	ranker.removeAttributes(docId)
 	ranker.lock.Unlock()
+	return nil
 }
 
 // 给文档评分并排序
 func (ranker *Ranker) Rank(
-	docs []types.IndexedDocument, options types.RankOptions, countDocsOnly bool) (types.ScoredDocuments, int) {
+	docs []types.IndexedDocument, options types.RankOptions, countDocsOnly bool) (types.ScoredDocuments, int, error) {
+	return ranker.RankContext(context.Background(), docs, options, countDocsOnly)
+}
+
+// 同Rank，评分过程中会定期检查ctx，ctx结束时中止并返回ctx.Err()
+func (ranker *Ranker) RankContext(ctx context.Context,
+	docs []types.IndexedDocument, options types.RankOptions, countDocsOnly bool) (types.ScoredDocuments, int, error) {
 	if !ranker.initialized {
-		log.Fatal("排序器尚未初始化")
+		return nil, 0, types.ErrNotInitialized
 	}
 
 	// 对每个文档评分
+	// 当用户只要求返回部分结果时用堆保留排序靠前的文档，不必对全部文档排序
 	var outputDocs types.ScoredDocuments
+	var topK *topKHeap
+	if !countDocsOnly && options.MaxOutputs != 0 {
+		topK = &topKHeap{k: options.OutputOffset + options.MaxOutputs, reverse: options.ReverseOrder}
+	}
 	numDocs := 0
-	for _, d := range docs {
+	for i, d := range docs {
+		if i%contextCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, 0, err
+			}
+		}
 		ranker.lock.RLock()
 		// 判断doc是否存在
 		if _, ok := ranker.lock.docs[d.DocId]; ok {
@@ -72,11 +137,16 @@ func (ranker *Ranker) Rank(
 			scores := options.ScoringCriteria.Score(d, fs)
 			if len(scores) > 0 {
 				if !countDocsOnly {
-					outputDocs = append(outputDocs, types.ScoredDocument{
+					doc := types.ScoredDocument{
 						DocId:                 d.DocId,
 						Scores:                scores,
 						TokenSnippetLocations: d.TokenSnippetLocations,
-						TokenLocations:        d.TokenLocations})
+						TokenLocations:        d.TokenLocations}
+					if topK != nil {
+						topK.add(doc)
+					} else {
+						outputDocs = append(outputDocs, doc)
+					}
 				}
 				numDocs++
 			}
@@ -87,6 +157,9 @@ func (ranker *Ranker) Rank(
 
 	// 排序
 	if !countDocsOnly {
+		if topK != nil {
+			outputDocs = topK.docs
+		}
 		if options.ReverseOrder {
 			sort.Sort(sort.Reverse(outputDocs))
 		} else {
@@ -101,13 +174,14 @@ func (ranker *Ranker) Rank(
 			start = utils.MinInt(options.OutputOffset, len(outputDocs))
 			end = len(outputDocs)
 		}
-		return outputDocs[start:end], numDocs
+		return outputDocs[start:end], numDocs, nil
 	}
-	return outputDocs, numDocs
+	return outputDocs, numDocs, nil
 }
 
 func (ranker *Ranker) Close() {
 	ranker.initialized = false
 	ranker.lock.fields = nil
 	ranker.lock.docs = nil
+	ranker.lock.attributes = nil
 }
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"bytes"
 	"github.com/huichen/wukong/types"
 	"github.com/huichen/wukong/utils"
 	"reflect"
@@ -37,14 +38,14 @@ func TestRankDocument(t *testing.T) {
 	ranker.AddDoc(3, DummyScoringFields{})
 	ranker.AddDoc(4, DummyScoringFields{})
 
-	scoredDocs, _ := ranker.Rank([]types.IndexedDocument{
+	scoredDocs, _, _ := ranker.Rank([]types.IndexedDocument{
 		types.IndexedDocument{DocId: 1, BM25: 6},
 		types.IndexedDocument{DocId: 3, BM25: 24},
 		types.IndexedDocument{DocId: 4, BM25: 18},
 	}, types.RankOptions{ScoringCriteria: types.RankByBM25{}}, false)
 	utils.Expect(t, "[3 [24000 ]] [4 [18000 ]] [1 [6000 ]] ", scoredDocsToString(scoredDocs))
 
-	scoredDocs, _ = ranker.Rank([]types.IndexedDocument{
+	scoredDocs, _, _ = ranker.Rank([]types.IndexedDocument{
 		types.IndexedDocument{DocId: 1, BM25: 6},
 		types.IndexedDocument{DocId: 3, BM25: 24},
 		types.IndexedDocument{DocId: 2, BM25: 0},
@@ -79,7 +80,7 @@ func TestRankWithCriteria(t *testing.T) {
 	})
 
 	criteria := DummyScoringCriteria{}
-	scoredDocs, _ := ranker.Rank([]types.IndexedDocument{
+	scoredDocs, _, _ := ranker.Rank([]types.IndexedDocument{
 		types.IndexedDocument{DocId: 1, TokenProximity: 6},
 		types.IndexedDocument{DocId: 2, TokenProximity: -1},
 		types.IndexedDocument{DocId: 3, TokenProximity: 24},
@@ -88,7 +89,7 @@ func TestRankWithCriteria(t *testing.T) {
 	utils.Expect(t, "[1 [25300 ]] [3 [17300 ]] [2 [3000 ]] [4 [1300 ]] ", scoredDocsToString(scoredDocs))
 
 	criteria.Threshold = 4
-	scoredDocs, _ = ranker.Rank([]types.IndexedDocument{
+	scoredDocs, _, _ = ranker.Rank([]types.IndexedDocument{
 		types.IndexedDocument{DocId: 1, TokenProximity: 6},
 		types.IndexedDocument{DocId: 2, TokenProximity: -1},
 		types.IndexedDocument{DocId: 3, TokenProximity: 24},
@@ -118,7 +119,7 @@ func TestRemoveDoc(t *testing.T) {
 	ranker.RemoveDoc(3)
 
 	criteria := DummyScoringCriteria{}
-	scoredDocs, _ := ranker.Rank([]types.IndexedDocument{
+	scoredDocs, _, _ := ranker.Rank([]types.IndexedDocument{
 		types.IndexedDocument{DocId: 1, TokenProximity: 6},
 		types.IndexedDocument{DocId: 2, TokenProximity: -1},
 		types.IndexedDocument{DocId: 3, TokenProximity: 24},
@@ -126,3 +127,118 @@ func TestRemoveDoc(t *testing.T) {
 	}, types.RankOptions{ScoringCriteria: criteria}, false)
 	utils.Expect(t, "[1 [25300 ]] [2 [3000 ]] ", scoredDocsToString(scoredDocs))
 }
+
+func TestFilter(t *testing.T) {
+	var ranker Ranker
+	ranker.Init()
+	ranker.AddDocWithAttributes(1, nil, map[string]types.AttributeValue{
+		"price": {Int: 10}, "rating": {IsFloat: true, Float: 4.5}})
+	ranker.AddDocWithAttributes(2, nil, map[string]types.AttributeValue{
+		"price": {Int: 50}})
+	ranker.AddDocWithAttributes(3, nil, map[string]types.AttributeValue{
+		"price": {Int: 80}, "rating": {IsFloat: true, Float: 3}})
+	docs := []types.IndexedDocument{{DocId: 3}, {DocId: 2}, {DocId: 1}}
+
+	filtered, _ := ranker.Filter(docs, []types.AttributeFilter{{Name: "price", Min: 10, Max: 50}})
+	utils.Expect(t, "[2 1]", docIdsOf(filtered))
+
+	filtered, _ = ranker.Filter(docs, []types.AttributeFilter{{Name: "price", Min: 10, ExcludeMin: true}})
+	utils.Expect(t, "[3 2]", docIdsOf(filtered))
+
+	filtered, _ = ranker.Filter(docs, []types.AttributeFilter{{Name: "rating", Max: 4}})
+	utils.Expect(t, "[3]", docIdsOf(filtered))
+
+	filtered, _ = ranker.Filter(docs, []types.AttributeFilter{{Name: "price", Min: 49.5}, {Name: "rating", Min: 0}})
+	utils.Expect(t, "[3]", docIdsOf(filtered))
+
+	ranker.RemoveDoc(3)
+	filtered, _ = ranker.Filter(docs, []types.AttributeFilter{{Name: "rating", Min: 0}})
+	utils.Expect(t, "[1]", docIdsOf(filtered))
+
+	_, err := ranker.Filter(docs, []types.AttributeFilter{{Name: "price", Min: "10"}})
+	utils.Expect(t, "属性值必须是整数或者浮点数：string", err)
+}
+
+func TestRankTopK(t *testing.T) {
+	var ranker Ranker
+	ranker.Init()
+	docs := []types.IndexedDocument{}
+	for i := uint64(1); i <= 20; i++ {
+		ranker.AddDoc(i, DummyScoringFields{})
+		// BM25为1, 3, 5, ..., 19, 18, 16, ..., 0
+		bm25 := float32(2*i - 1)
+		if i > 10 {
+			bm25 = float32(40 - 2*i)
+		}
+		docs = append(docs, types.IndexedDocument{DocId: i, BM25: bm25})
+	}
+
+	scoredDocs, numDocs, _ := ranker.Rank(docs, types.RankOptions{
+		ScoringCriteria: types.RankByBM25{}, OutputOffset: 1, MaxOutputs: 3}, false)
+	utils.Expect(t, "20", numDocs)
+	utils.Expect(t, "[11 [18000 ]] [9 [17000 ]] [12 [16000 ]] ", scoredDocsToString(scoredDocs))
+
+	scoredDocs, _, _ = ranker.Rank(docs, types.RankOptions{
+		ScoringCriteria: types.RankByBM25{}, ReverseOrder: true, MaxOutputs: 3}, false)
+	utils.Expect(t, "[20 [0 ]] [1 [1000 ]] [19 [2000 ]] ", scoredDocsToString(scoredDocs))
+
+	scoredDocs, _, _ = ranker.Rank(docs, types.RankOptions{
+		ScoringCriteria: types.RankByBM25{}, OutputOffset: 18, MaxOutputs: 10}, false)
+	utils.Expect(t, "[1 [1000 ]] [20 [0 ]] ", scoredDocsToString(scoredDocs))
+}
+
+func benchmarkRank(b *testing.B, maxOutputs int) {
+	var ranker Ranker
+	ranker.Init()
+	docs := make([]types.IndexedDocument, 100000)
+	for i := range docs {
+		docId := uint64(i + 1)
+		ranker.AddDoc(docId, DummyScoringFields{})
+		docs[i] = types.IndexedDocument{DocId: docId, BM25: float32(docId * 7919 % 100003)}
+	}
+	options := types.RankOptions{ScoringCriteria: types.RankByBM25{}, MaxOutputs: maxOutputs}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ranker.Rank(docs, options, false)
+	}
+}
+
+func BenchmarkRankTop10(b *testing.B) { benchmarkRank(b, 10) }
+
+func BenchmarkRankAll(b *testing.B) { benchmarkRank(b, 0) }
+
+func TestRankerUpdateFields(t *testing.T) {
+	var ranker Ranker
+	ranker.Init()
+	ranker.AddDoc(1, DummyScoringFields{counter: 1})
+	ranker.AddDoc(2, DummyScoringFields{counter: 2})
+
+	utils.Expect(t, "<nil>", ranker.UpdateFields(1, DummyScoringFields{counter: 3}))
+	utils.Expect(t, "文档不存在", ranker.UpdateFields(3, DummyScoringFields{counter: 3}))
+
+	scoredDocs, _, _ := ranker.Rank([]types.IndexedDocument{
+		types.IndexedDocument{DocId: 1},
+		types.IndexedDocument{DocId: 2},
+		types.IndexedDocument{DocId: 3},
+	}, types.RankOptions{ScoringCriteria: DummyScoringCriteria{}}, false)
+	utils.Expect(t, "[1 [3000 ]] [2 [2000 ]] ", scoredDocsToString(scoredDocs))
+}
+
+func TestRankerSnapshot(t *testing.T) {
+	var ranker Ranker
+	ranker.Init()
+	ranker.AddDocWithAttributes(1, "fields1", map[string]types.AttributeValue{
+		"price": {IsFloat: true, Float: 1.5}, "stock": {Int: -3}})
+	ranker.AddDoc(2, nil)
+
+	var buffer bytes.Buffer
+	utils.Expect(t, "<nil>", ranker.Snapshot(&buffer))
+
+	var restored Ranker
+	restored.Init()
+	utils.Expect(t, "<nil>", restored.Restore(&buffer))
+	utils.Expect(t, "map[1:fields1 2:<nil>]", restored.lock.fields)
+	utils.Expect(t, "map[1:true 2:true]", restored.lock.docs)
+	utils.Expect(t, "map[price:map[1:{true 0 1.5}] stock:map[1:{false -3 0}]]", restored.lock.attributes)
+}
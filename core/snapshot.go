@@ -0,0 +1,379 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/huichen/wukong/types"
+)
+
+// 快照中的整数使用varint编码，浮点数为4或8字节小端序。读取快照时r实现了io.ByteReader
+// 则不会多读，因此可以在同一个流中依次读取多个快照。
+
+// 快照中搜索键和属性名的最大长度
+const maxSnapshotStringLength = 1 << 20
+
+type snapshotEncoder struct {
+	w      *bufio.Writer
+	buffer [binary.MaxVarintLen64]byte
+	err    error
+}
+
+func newSnapshotEncoder(w io.Writer) *snapshotEncoder {
+	bw, ok := w.(*bufio.Writer)
+	if !ok {
+		bw = bufio.NewWriter(w)
+	}
+	return &snapshotEncoder{w: bw}
+}
+
+func (e *snapshotEncoder) write(b []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(b)
+	}
+}
+
+func (e *snapshotEncoder) uvarint(value uint64) {
+	e.write(e.buffer[:binary.PutUvarint(e.buffer[:], value)])
+}
+
+func (e *snapshotEncoder) varint(value int64) {
+	e.write(e.buffer[:binary.PutVarint(e.buffer[:], value)])
+}
+
+func (e *snapshotEncoder) float32(value float32) {
+	binary.LittleEndian.PutUint32(e.buffer[:], math.Float32bits(value))
+	e.write(e.buffer[:4])
+}
+
+func (e *snapshotEncoder) float64(value float64) {
+	binary.LittleEndian.PutUint64(e.buffer[:], math.Float64bits(value))
+	e.write(e.buffer[:8])
+}
+
+func (e *snapshotEncoder) string(value string) {
+	e.uvarint(uint64(len(value)))
+	if e.err == nil {
+		_, e.err = e.w.WriteString(value)
+	}
+}
+
+func (e *snapshotEncoder) flush() error {
+	if e.err == nil {
+		e.err = e.w.Flush()
+	}
+	return e.err
+}
+
+type snapshotReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+type snapshotDecoder struct {
+	r      snapshotReader
+	buffer [8]byte
+	err    error
+}
+
+func newSnapshotDecoder(r io.Reader) *snapshotDecoder {
+	br, ok := r.(snapshotReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &snapshotDecoder{r: br}
+}
+
+func (d *snapshotDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	var value uint64
+	value, d.err = binary.ReadUvarint(d.r)
+	return value
+}
+
+func (d *snapshotDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	var value int64
+	value, d.err = binary.ReadVarint(d.r)
+	return value
+}
+
+func (d *snapshotDecoder) read(n int) []byte {
+	if d.err != nil {
+		return d.buffer[:n]
+	}
+	_, d.err = io.ReadFull(d.r, d.buffer[:n])
+	return d.buffer[:n]
+}
+
+func (d *snapshotDecoder) float32() float32 {
+	return math.Float32frombits(binary.LittleEndian.Uint32(d.read(4)))
+}
+
+func (d *snapshotDecoder) float64() float64 {
+	return math.Float64frombits(binary.LittleEndian.Uint64(d.read(8)))
+}
+
+func (d *snapshotDecoder) string() string {
+	length := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if length > maxSnapshotStringLength {
+		d.err = errors.New("字符串过长")
+		return ""
+	}
+	b := make([]byte, length)
+	_, d.err = io.ReadFull(d.r, b)
+	return string(b)
+}
+
+// 预分配的容量，避免损坏的快照导致分配过多内存
+func (d *snapshotDecoder) capacity(n uint64) int {
+	if n > 1<<16 {
+		return 1 << 16
+	}
+	return int(n)
+}
+
+// 返回的错误都包装了types.ErrInvalidSnapshot
+func (d *snapshotDecoder) error() error {
+	if d.err == nil {
+		return nil
+	}
+	if d.err == io.EOF {
+		d.err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("%w: %v", types.ErrInvalidSnapshot, d.err)
+}
+
+// 将反向索引表写入快照，缓存中尚未加入索引表的文档不包含在快照中
+func (indexer *Indexer) Snapshot(w io.Writer) error {
+	if !indexer.initialized {
+		return types.ErrNotInitialized
+	}
+
+	indexer.tableLock.RLock()
+	defer indexer.tableLock.RUnlock()
+	e := newSnapshotEncoder(w)
+	e.uvarint(uint64(indexer.initOptions.IndexType))
+	e.uvarint(indexer.numDocuments)
+	e.float32(indexer.totalTokenLength)
+
+	e.uvarint(uint64(len(indexer.docTokenLengths)))
+	for docId, length := range indexer.docTokenLengths {
+		e.uvarint(docId)
+		e.float32(length)
+	}
+	e.uvarint(uint64(len(indexer.tableLock.docsState)))
+	for docId, state := range indexer.tableLock.docsState {
+		e.uvarint(docId)
+		e.uvarint(uint64(state))
+	}
+
+	// 搜索键按字典序写入，恢复时直接作为词典
+	e.uvarint(uint64(len(indexer.tableLock.keywords)))
+	for _, keyword := range indexer.tableLock.keywords {
+		indices := indexer.reader(indexer.tableLock.table[keyword])
+		length := indexer.getIndexLength(indices)
+		e.string(keyword)
+		e.uvarint(uint64(length))
+		previous := uint64(0)
+		for i := 0; i < length; i++ {
+			docId := indexer.getDocId(indices, i)
+			e.uvarint(docId - previous)
+			previous = docId
+			switch indexer.initOptions.IndexType {
+			case types.FrequenciesIndex:
+				e.float32(indexer.getFrequency(indices, i))
+			case types.LocationsIndex:
+				locations := indexer.getLocations(indices, i)
+				e.uvarint(uint64(len(locations)))
+				for _, location := range locations {
+					e.varint(int64(location))
+				}
+			}
+		}
+		if e.err != nil {
+			break
+		}
+	}
+	return e.flush()
+}
+
+// 用Snapshot写入的快照替换反向索引表，IndexType必须和写入快照时相同
+// 快照读取完毕后才替换，因此返回错误时索引表保持不变
+func (indexer *Indexer) Restore(r io.Reader) error {
+	if !indexer.initialized {
+		return types.ErrNotInitialized
+	}
+
+	d := newSnapshotDecoder(r)
+	indexType := int(d.uvarint())
+	if d.err == nil && indexType != indexer.initOptions.IndexType {
+		return fmt.Errorf("%w: 索引类型不一致", types.ErrInvalidSnapshot)
+	}
+	numDocuments := d.uvarint()
+	totalTokenLength := d.float32()
+
+	n := d.uvarint()
+	docTokenLengths := make(map[uint64]float32, d.capacity(n))
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		docId := d.uvarint()
+		docTokenLengths[docId] = d.float32()
+	}
+	n = d.uvarint()
+	docsState := make(map[uint64]int, d.capacity(n))
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		docId := d.uvarint()
+		docsState[docId] = int(d.uvarint())
+	}
+
+	n = d.uvarint()
+	table := make(map[string]*KeywordIndices, d.capacity(n))
+	keywords := make([]string, 0, d.capacity(n))
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		keyword := d.string()
+		length := d.uvarint()
+		ti := &KeywordIndices{docIds: make([]uint64, 0, d.capacity(length))}
+		docId := uint64(0)
+		for j := uint64(0); j < length && d.err == nil; j++ {
+			docId += d.uvarint()
+			ti.docIds = append(ti.docIds, docId)
+			switch indexType {
+			case types.FrequenciesIndex:
+				ti.frequencies = append(ti.frequencies, d.float32())
+			case types.LocationsIndex:
+				numLocations := d.uvarint()
+				locations := make([]int, 0, d.capacity(numLocations))
+				for k := uint64(0); k < numLocations && d.err == nil; k++ {
+					locations = append(locations, int(d.varint()))
+				}
+				// 旧版本写入的快照中位置可能没有排序
+				ti.locations = append(ti.locations, sortedLocations(locations))
+			}
+		}
+		if indexer.initOptions.CompressPostings {
+			indexer.compress(ti)
+		}
+		table[keyword] = ti
+		keywords = append(keywords, keyword)
+	}
+	if err := d.error(); err != nil {
+		return err
+	}
+	if !sort.StringsAreSorted(keywords) {
+		return fmt.Errorf("%w: 搜索键没有排序", types.ErrInvalidSnapshot)
+	}
+
+	indexer.tableLock.Lock()
+	defer indexer.tableLock.Unlock()
+	indexer.tableLock.table = table
+	indexer.tableLock.docsState = docsState
+	indexer.tableLock.keywords = keywords
+	indexer.numDocuments = numDocuments
+	indexer.totalTokenLength = totalTokenLength
+	indexer.docTokenLengths = docTokenLengths
+	return nil
+}
+
+// 快照中一个文档的评分字段，评分字段的类型必须在gob中注册
+type rankerSnapshotFields struct {
+	Fields interface{}
+}
+
+// 将全部文档的评分字段和数值属性写入快照
+func (ranker *Ranker) Snapshot(w io.Writer) error {
+	if !ranker.initialized {
+		return types.ErrNotInitialized
+	}
+
+	ranker.lock.RLock()
+	defer ranker.lock.RUnlock()
+	e := newSnapshotEncoder(w)
+	fieldsEncoder := gob.NewEncoder(e.w)
+	e.uvarint(uint64(len(ranker.lock.docs)))
+	for docId := range ranker.lock.docs {
+		e.uvarint(docId)
+		if e.err == nil {
+			e.err = fieldsEncoder.Encode(rankerSnapshotFields{ranker.lock.fields[docId]})
+		}
+	}
+
+	e.uvarint(uint64(len(ranker.lock.attributes)))
+	for name, column := range ranker.lock.attributes {
+		e.string(name)
+		e.uvarint(uint64(len(column)))
+		for docId, value := range column {
+			e.uvarint(docId)
+			if value.IsFloat {
+				e.uvarint(1)
+				e.float64(value.Float)
+			} else {
+				e.uvarint(0)
+				e.varint(value.Int)
+			}
+		}
+	}
+	return e.flush()
+}
+
+// 用Snapshot写入的快照替换全部文档的评分字段和数值属性
+// 快照读取完毕后才替换，因此返回错误时排序器保持不变
+func (ranker *Ranker) Restore(r io.Reader) error {
+	if !ranker.initialized {
+		return types.ErrNotInitialized
+	}
+
+	d := newSnapshotDecoder(r)
+	fieldsDecoder := gob.NewDecoder(d.r)
+	n := d.uvarint()
+	fields := make(map[uint64]interface{}, d.capacity(n))
+	docs := make(map[uint64]bool, d.capacity(n))
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		docId := d.uvarint()
+		var value rankerSnapshotFields
+		if d.err == nil {
+			d.err = fieldsDecoder.Decode(&value)
+		}
+		fields[docId] = value.Fields
+		docs[docId] = true
+	}
+
+	n = d.uvarint()
+	attributes := make(map[string]map[uint64]types.AttributeValue, d.capacity(n))
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		name := d.string()
+		length := d.uvarint()
+		column := make(map[uint64]types.AttributeValue, d.capacity(length))
+		for j := uint64(0); j < length && d.err == nil; j++ {
+			docId := d.uvarint()
+			if d.uvarint() == 1 {
+				column[docId] = types.AttributeValue{IsFloat: true, Float: d.float64()}
+			} else {
+				column[docId] = types.AttributeValue{Int: d.varint()}
+			}
+		}
+		attributes[name] = column
+	}
+	if err := d.error(); err != nil {
+		return err
+	}
+
+	ranker.lock.Lock()
+	defer ranker.lock.Unlock()
+	ranker.lock.fields = fields
+	ranker.lock.docs = docs
+	ranker.lock.attributes = attributes
+	return nil
+}
@@ -15,7 +15,10 @@ func indicesToString(indexer *Indexer, token string) (output string) {
 	return
 }
 
-func indexedDocsToString(docs []types.IndexedDocument, numDocs int) (output string) {
+func indexedDocsToString(docs []types.IndexedDocument, numDocs int, err error) (output string) {
+	if err != nil {
+		return err.Error()
+	}
 	for _, doc := range docs {
 		output += fmt.Sprintf("[%d %d %v] ",
 			doc.DocId, doc.TokenProximity, doc.TokenSnippetLocations)
@@ -33,3 +36,10 @@ func scoredDocsToString(docs []types.ScoredDocument) (output string) {
 	}
 	return
 }
+
+func docIdsOf(docs []types.IndexedDocument) (docIds []uint64) {
+	for _, doc := range docs {
+		docIds = append(docIds, doc.DocId)
+	}
+	return
+}
@@ -0,0 +1,44 @@
+package core
+
+import (
+	"container/heap"
+
+	"github.com/huichen/wukong/types"
+)
+
+// 保留排序最靠前的k个文档的堆，堆顶为其中排在最后的文档
+type topKHeap struct {
+	docs    types.ScoredDocuments
+	k       int
+	reverse bool
+}
+
+// a是否排在b之前
+func (h *topKHeap) before(a, b *types.ScoredDocument) bool {
+	if h.reverse {
+		return types.ScoresMore(b.Scores, a.Scores)
+	}
+	return types.ScoresMore(a.Scores, b.Scores)
+}
+
+func (h *topKHeap) Len() int           { return len(h.docs) }
+func (h *topKHeap) Less(i, j int) bool { return h.before(&h.docs[j], &h.docs[i]) }
+func (h *topKHeap) Swap(i, j int)      { h.docs[i], h.docs[j] = h.docs[j], h.docs[i] }
+func (h *topKHeap) Push(x interface{}) { h.docs = append(h.docs, x.(types.ScoredDocument)) }
+func (h *topKHeap) Pop() interface{} {
+	doc := h.docs[len(h.docs)-1]
+	h.docs = h.docs[:len(h.docs)-1]
+	return doc
+}
+
+// 加入一个文档，堆满时替换掉排在最后的文档
+func (h *topKHeap) add(doc types.ScoredDocument) {
+	if len(h.docs) < h.k {
+		heap.Push(h, doc)
+		return
+	}
+	if h.before(&doc, &h.docs[0]) {
+		h.docs[0] = doc
+		heap.Fix(h, 0)
+	}
+}
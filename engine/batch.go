@@ -0,0 +1,160 @@
+package engine
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/huichen/wukong/types"
+)
+
+// 批量索引时一次交给分词器的文档数
+const indexBatchChunkSize = 128
+
+// 一次批量索引的进度
+//
+// 批次完成需要：每个文档加入排序器，每个索引器分片处理完批次最后的强制刷新请求，每个
+// 持久存储分片写完批次中的文档。numSteps为尚未完成的步骤数，降为0时关闭done。
+type indexBatch struct {
+	numChunks int64
+	numSteps  int64
+	done      chan struct{}
+
+	// 持久存储写入失败时的第一个错误，在done关闭后由BatchHandle.Wait返回
+	errLock sync.Mutex
+	err     error
+}
+
+// 记录批次中的错误，必须在finishStep之前调用
+func (batch *indexBatch) fail(err error) {
+	batch.errLock.Lock()
+	defer batch.errLock.Unlock()
+	if batch.err == nil {
+		batch.err = err
+	}
+}
+
+func (batch *indexBatch) finishStep() {
+	if atomic.AddInt64(&batch.numSteps, -1) == 0 {
+		close(batch.done)
+	}
+}
+
+// 分词器处理完批次的一块文档后调用，最后一块处理完时在每个索引器分片的队列末尾放入强制
+// 刷新请求。每个分片只有一个索引协程按顺序处理请求，因此刷新请求处理完时批次的文档都已加入索引
+func (engine *Engine) finishBatchChunk(batch *indexBatch) {
+	if atomic.AddInt64(&batch.numChunks, -1) != 0 {
+		return
+	}
+	for shard := 0; shard < engine.initOptions.NumShards; shard++ {
+		engine.indexerAddDocChannels[shard] <- indexerAddDocumentRequest{forceUpdate: true, batch: batch}
+	}
+}
+
+// Engine.IndexDocuments返回的句柄，用于等待一批文档可以被搜索到
+type BatchHandle struct {
+	batch      *indexBatch
+	engineDone chan struct{}
+}
+
+// 阻塞等待直到这批文档都已加入索引和排序器（使用持久存储时也已写入存储）
+// 只等待这一批文档，和其他并发写入的文档无关。引擎先被关闭时返回types.ErrClosed；
+// 文档已经加入索引但写入持久存储失败时返回包装了types.ErrStorageWrite的错误
+func (handle *BatchHandle) Wait() error {
+	return handle.WaitContext(context.Background())
+}
+
+// 同Wait，ctx结束时不再等待并返回ctx.Err()
+func (handle *BatchHandle) WaitContext(ctx context.Context) error {
+	select {
+	case <-handle.batch.done:
+		return handle.err()
+	default:
+	}
+	select {
+	case <-handle.batch.done:
+		return handle.err()
+	case <-handle.engineDone:
+		return types.ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (handle *BatchHandle) err() error {
+	handle.batch.errLock.Lock()
+	defer handle.batch.errLock.Unlock()
+	return handle.batch.err
+}
+
+// 批量将文档加入索引
+//
+// 文档按块交给分词器，并且立即刷新索引器的缓存；使用持久存储时每个存储分片在一个事务中
+// 写入该分片的全部文档。任何一个文档的DocId为0、属性不合法或者无法编码（见EngineInitOptions.Codec）
+// 时返回错误，整批都不会被索引。
+//
+// 和IndexDocument一样，函数返回时文档可能尚未加入索引，调用返回句柄的Wait等待这一批文档
+// 可以被搜索到，不需要调用FlushIndex。
+func (engine *Engine) IndexDocuments(items []types.IndexItem) (*BatchHandle, error) {
+	if err := engine.enter(); err != nil {
+		return nil, err
+	}
+	defer engine.requests.Done()
+
+	for _, item := range items {
+		if item.DocId == 0 {
+			return nil, types.ErrInvalidDocId
+		}
+		if _, err := types.NewAttributeValues(item.Data.Attributes); err != nil {
+			return nil, err
+		}
+	}
+	// 复制一份，调用者返回后可以修改items
+	items = append([]types.IndexItem(nil), items...)
+
+	batch := &indexBatch{done: make(chan struct{})}
+	handle := &BatchHandle{batch: batch, engineDone: engine.done}
+	if len(items) == 0 {
+		close(batch.done)
+		return handle, nil
+	}
+
+	// 先编码全部文档，任何一个编码失败时整批都不索引
+	var encoded []encodedDocument
+	storageGroups := make(map[int][]encodedDocument)
+	if engine.initOptions.UsePersistentStorage {
+		encoded = make([]encodedDocument, len(items))
+		for i := range items {
+			value, err := engine.encodeDocument(&items[i].Data)
+			if err != nil {
+				return nil, err
+			}
+			encoded[i] = encodedDocument{DocId: items[i].DocId, Value: value}
+			shard := engine.storageShard(items[i].DocId)
+			storageGroups[shard] = append(storageGroups[shard], encoded[i])
+		}
+	}
+	batch.numChunks = int64((len(items) + indexBatchChunkSize - 1) / indexBatchChunkSize)
+	batch.numSteps = int64(len(items) + engine.initOptions.NumShards + len(storageGroups))
+
+	// 整批作为一条日志记录，崩溃时要么全部恢复，要么全部丢弃
+	err := engine.writeAhead(walIndexDocuments, encoded, func() {
+		atomic.AddUint64(&engine.numIndexingRequests, uint64(len(items)))
+		atomic.AddUint64(&engine.numForceUpdatingRequests, 1)
+		for start := 0; start < len(items); start += indexBatchChunkSize {
+			end := start + indexBatchChunkSize
+			if end > len(items) {
+				end = len(items)
+			}
+			engine.segmenterChannel <- segmenterRequest{batch: batch, documents: items[start:end]}
+		}
+		for shard, documents := range storageGroups {
+			engine.persistentStorageIndexDocumentChannels[shard] <- persistentStorageIndexDocumentRequest{
+				batch: batch, documents: documents}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return handle, nil
+}
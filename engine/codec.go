@@ -0,0 +1,76 @@
+package engine
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/huichen/wukong/types"
+)
+
+// 持久存储中每个值的格式头：documentFormatMarker、格式版本和编码方式的编号（各一个字节），
+// 后面是EngineInitOptions.Codec编码的文档。没有格式头的旧数据为gob编码，gob编码的数据
+// 不会以0开头，因此可以区分
+const (
+	documentFormatMarker  = 0
+	documentFormatVersion = 1
+)
+
+// 解码时按编号选择的内置编码方式
+var builtinCodecs = map[byte]types.Codec{
+	types.GobCodecID:    types.GobCodec{},
+	types.JSONCodecID:   types.JSONCodec{},
+	types.BinaryCodecID: types.BinaryCodec{},
+}
+
+// 编码后的文档，写入持久存储和预写日志
+type encodedDocument struct {
+	DocId uint64
+	Value []byte
+}
+
+// 用EngineInitOptions.Codec编码文档并加上格式头，失败时返回的错误包装了types.ErrDocumentCodec
+func (engine *Engine) encodeDocument(data *types.DocumentIndexData) ([]byte, error) {
+	codec := engine.initOptions.Codec
+	encoded, err := codec.Encode(data)
+	if err != nil {
+		atomic.AddUint64(&engine.numEncodeErrors, 1)
+		return nil, fmt.Errorf("%w: %v", types.ErrDocumentCodec, err)
+	}
+	value := make([]byte, 3, 3+len(encoded))
+	value[0], value[1], value[2] = documentFormatMarker, documentFormatVersion, codec.ID()
+	return append(value, encoded...), nil
+}
+
+// 解码持久存储中的值，失败时返回的错误包装了types.ErrDocumentCodec
+func (engine *Engine) decodeDocument(value []byte) (types.DocumentIndexData, error) {
+	data, err := decodeDocument(engine.initOptions.Codec, value)
+	if err != nil {
+		atomic.AddUint64(&engine.numDecodeErrors, 1)
+	}
+	return data, err
+}
+
+// 解码持久存储中的值，格式头中的编号和codec相同时用codec解码，否则用内置的编码方式
+func decodeDocument(codec types.Codec, value []byte) (data types.DocumentIndexData, err error) {
+	if len(value) == 0 || value[0] != documentFormatMarker {
+		err = types.GobCodec{}.Decode(value, &data)
+	} else if len(value) < 3 || value[1] != documentFormatVersion {
+		err = fmt.Errorf("不支持的格式版本")
+	} else if codec := codecByID(codec, value[2]); codec == nil {
+		err = fmt.Errorf("未知的编码方式%d", value[2])
+	} else {
+		err = codec.Decode(value[3:], &data)
+	}
+	if err != nil {
+		err = fmt.Errorf("%w: %v", types.ErrDocumentCodec, err)
+	}
+	return
+}
+
+// 编号为id的编码方式，优先使用codec
+func codecByID(codec types.Codec, id byte) types.Codec {
+	if codec.ID() == id {
+		return codec
+	}
+	return builtinCodecs[id]
+}
@@ -1,13 +1,32 @@
 package engine
 
+import (
+	"sync/atomic"
+)
+
 func (engine *Engine) NumTokenIndexAdded() uint64 {
-	return engine.numTokenIndexAdded
+	return atomic.LoadUint64(&engine.numTokenIndexAdded)
 }
 
 func (engine *Engine) NumDocumentsIndexed() uint64 {
-	return engine.numDocumentsIndexed
+	return atomic.LoadUint64(&engine.numDocumentsIndexed)
 }
 
 func (engine *Engine) NumDocumentsRemoved() uint64 {
-	return engine.numDocumentsRemoved
+	return atomic.LoadUint64(&engine.numDocumentsRemoved)
+}
+
+// 持久存储中文档编码失败的次数，见EngineInitOptions.Codec
+func (engine *Engine) NumEncodeErrors() uint64 {
+	return atomic.LoadUint64(&engine.numEncodeErrors)
+}
+
+// 持久存储中文档解码失败的次数，包括启动时无法载入的文档
+func (engine *Engine) NumDecodeErrors() uint64 {
+	return atomic.LoadUint64(&engine.numDecodeErrors)
+}
+
+// 持久存储写入失败的次数，包括UpdateFields时无法读出存储中的文档。每次失败都会记录日志
+func (engine *Engine) NumStorageErrors() uint64 {
+	return atomic.LoadUint64(&engine.numStorageErrors)
 }
@@ -1,17 +1,17 @@
 package engine
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"runtime"
-	"sort"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/huichen/murmur"
-	"github.com/huichen/sego"
 	"github.com/huichen/wukong/core"
 	"github.com/huichen/wukong/storage"
 	"github.com/huichen/wukong/types"
@@ -33,18 +33,47 @@ type Engine struct {
 	numForceUpdatingRequests uint64
 	numTokenIndexAdded       uint64
 	numDocumentsStored       uint64
+	numDocumentsUnstored     uint64
+	numFieldUpdatingRequests uint64
+	numFieldUpdatesStored    uint64
+	numEncodeErrors          uint64
+	numDecodeErrors          uint64
+	numStorageErrors         uint64
+	numDocumentsRanked       uint64
 
 	// 记录初始化参数
 	initOptions types.EngineInitOptions
 	initialized bool
+	closed      bool
+
+	// 保护initialized和closed
+	stateLock sync.RWMutex
+
+	// 关闭引擎时close，通知工作协程退出
+	done chan struct{}
+
+	// 全部工作协程
+	workers sync.WaitGroup
+
+	// 计数器更新时通知等待者
+	progress progressNotifier
+
+	// 正在处理的请求，关闭引擎时需要等待它们完成
+	requests sync.WaitGroup
+
+	// Restore替换indexers和rankers中的分片时加写锁，使用分片时加读锁
+	shardsLock sync.RWMutex
 
 	indexers                []*core.Indexer
 	rankers                 []*core.Ranker
-	segmenter               *sego.Segmenter
-	usingExternalSegmenter  bool
+	tokenizer               types.Tokenizer
+	segoTokenizer           *types.SegoTokenizer // 引擎从词典载入的分词器，关闭时释放
 	stopTokens              *types.StopTokens
 	usingExternalStopTokens bool
+	synonyms                *types.Synonyms
+	usingExternalSynonyms   bool
 	dbs                     []storage.Storage
+	wal                     *writeAheadLog // 预写日志，见EngineInitOptions.UseWAL
 
 	// 建立索引器使用的通信通道
 	segmenterChannel         chan segmenterRequest
@@ -62,27 +91,53 @@ type Engine struct {
 	persistentStorageInitChannel           chan bool
 }
 
-func (engine *Engine) Init(options types.EngineInitOptions) {
+// 新建并初始化引擎
+func NewEngine(options types.EngineInitOptions) (*Engine, error) {
+	engine := &Engine{}
+	if err := engine.init(options); err != nil {
+		return nil, err
+	}
+	return engine, nil
+}
+
+// 初始化引擎，出错时返回错误（比如types.ErrDictionaryNotFound），此时引擎不可用，
+// 调用引擎的其它函数会返回types.ErrNotInitialized
+func (engine *Engine) Init(options types.EngineInitOptions) error {
+	return engine.init(options)
+}
+
+func (engine *Engine) init(options types.EngineInitOptions) error {
 	// 将线程数设置为CPU数
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
 	// 初始化初始参数
 	if engine.initialized {
-		log.Fatal("请勿重复初始化引擎")
+		return types.ErrAlreadyInitialized
+	}
+	if err := options.Init(); err != nil {
+		return err
 	}
-	options.Init()
-	engine.initOptions = options
-	engine.initialized = true
 
 	if !options.NotUsingSegmenter {
-		// 载入分词器词典
-		if options.Segmenter != nil {
-			engine.segmenter = options.Segmenter
-			engine.usingExternalSegmenter = true
+		// 初始化分词器
+		if options.Tokenizer != nil {
+			engine.tokenizer = options.Tokenizer
+		} else if options.Segmenter != nil {
+			engine.tokenizer = types.NewSegoTokenizer(options.Segmenter)
 		} else {
-			engine.segmenter = &sego.Segmenter{}
-			engine.segmenter.LoadDictionary(options.SegmenterDictionaries)
-			engine.usingExternalSegmenter = false
+			tokenizer, err := types.LoadSegoTokenizer(options.SegmenterDictionaries)
+			if err != nil {
+				return err
+			}
+			engine.tokenizer = tokenizer
+			engine.segoTokenizer = tokenizer
+		}
+		if len(options.CharFilters) > 0 || len(options.TokenFilters) > 0 {
+			engine.tokenizer = &types.Analyzer{
+				CharFilters:  options.CharFilters,
+				Tokenizer:    engine.tokenizer,
+				TokenFilters: options.TokenFilters,
+			}
 		}
 
 		// 初始化停用词
@@ -91,18 +146,38 @@ func (engine *Engine) Init(options types.EngineInitOptions) {
 			engine.usingExternalStopTokens = true
 		} else {
 			engine.stopTokens = &types.StopTokens{}
-			engine.stopTokens.Init(options.StopTokenFile)
+			if err := engine.stopTokens.Init(options.StopTokenFile); err != nil {
+				return err
+			}
 			engine.usingExternalStopTokens = false
 		}
 	}
 
+	// 初始化同义词
+	if options.Synonyms != nil {
+		engine.synonyms = options.Synonyms
+		engine.usingExternalSynonyms = true
+	} else {
+		engine.synonyms = &types.Synonyms{}
+		if err := engine.synonyms.Init(options.SynonymFile); err != nil {
+			return err
+		}
+		engine.usingExternalSynonyms = false
+	}
+	engine.initOptions = options
+	engine.done = make(chan struct{})
+
 	// 初始化索引器和排序器
 	for shard := 0; shard < options.NumShards; shard++ {
 		engine.indexers = append(engine.indexers, &core.Indexer{})
-		engine.indexers[shard].Init(*options.IndexerInitOptions)
+		if err := engine.indexers[shard].Init(*options.IndexerInitOptions); err != nil {
+			return err
+		}
 
 		engine.rankers = append(engine.rankers, &core.Ranker{})
-		engine.rankers[shard].Init()
+		if err := engine.rankers[shard].Init(); err != nil {
+			return err
+		}
 	}
 
 	// 初始化分词器通道
@@ -147,6 +222,37 @@ func (engine *Engine) Init(options types.EngineInitOptions) {
 			options.RankerBufferLength)
 	}
 
+	// 打开或者创建数据库
+	if engine.initOptions.UsePersistentStorage {
+		err := os.MkdirAll(engine.initOptions.PersistentStorageFolder, 0700)
+		if err != nil {
+			return fmt.Errorf("无法创建目录%s: %w", engine.initOptions.PersistentStorageFolder, err)
+		}
+
+		engine.dbs = make([]storage.Storage, engine.initOptions.PersistentStorageShards)
+		for shard := 0; shard < engine.initOptions.PersistentStorageShards; shard++ {
+			dbPath := storagePath(engine.initOptions.PersistentStorageFolder, shard)
+			db, err := storage.OpenStorage(dbPath)
+			if db == nil || err != nil {
+				engine.closeStorage()
+				return fmt.Errorf("无法打开数据库%s: %w", dbPath, err)
+			}
+			engine.dbs[shard] = db
+		}
+
+		if engine.initOptions.UseWAL {
+			numRecords, err := engine.recoverFromWAL()
+			if err != nil {
+				engine.closeStorage()
+				return fmt.Errorf("无法恢复预写日志: %w", err)
+			}
+			if numRecords > 0 && engine.initOptions.SnapshotFile != "" {
+				// 持久存储中有快照之后的写操作，快照已经过时
+				os.Remove(engine.initOptions.SnapshotFile)
+			}
+		}
+	}
+
 	// 初始化持久化存储通道
 	if engine.initOptions.UsePersistentStorage {
 		engine.persistentStorageIndexDocumentChannels =
@@ -162,75 +268,127 @@ func (engine *Engine) Init(options types.EngineInitOptions) {
 
 	// 启动分词器
 	for iThread := 0; iThread < options.NumSegmenterThreads; iThread++ {
-		go engine.segmenterWorker()
+		engine.startWorker(engine.segmenterWorker)
 	}
 
 	// 启动索引器和排序器
 	for shard := 0; shard < options.NumShards; shard++ {
-		go engine.indexerAddDocumentWorker(shard)
-		go engine.indexerRemoveDocWorker(shard)
-		go engine.rankerAddDocWorker(shard)
-		go engine.rankerRemoveDocWorker(shard)
+		shard := shard
+		engine.startWorker(func() { engine.indexerAddDocumentWorker(shard) })
+		engine.startWorker(func() { engine.indexerRemoveDocWorker(shard) })
+		engine.startWorker(func() { engine.rankerAddDocWorker(shard) })
+		engine.startWorker(func() { engine.rankerRemoveDocWorker(shard) })
 
 		for i := 0; i < options.NumIndexerThreadsPerShard; i++ {
-			go engine.indexerLookupWorker(shard)
+			engine.startWorker(func() { engine.indexerLookupWorker(shard) })
 		}
 		for i := 0; i < options.NumRankerThreadsPerShard; i++ {
-			go engine.rankerRankWorker(shard)
+			engine.startWorker(func() { engine.rankerRankWorker(shard) })
 		}
 	}
 
 	// 启动持久化存储工作协程
 	if engine.initOptions.UsePersistentStorage {
-		err := os.MkdirAll(engine.initOptions.PersistentStorageFolder, 0700)
-		if err != nil {
-			log.Fatal("无法创建目录", engine.initOptions.PersistentStorageFolder)
-		}
-
-		// 打开或者创建数据库
-		engine.dbs = make([]storage.Storage, engine.initOptions.PersistentStorageShards)
-		for shard := 0; shard < engine.initOptions.PersistentStorageShards; shard++ {
-			dbPath := engine.initOptions.PersistentStorageFolder + "/" + PersistentStorageFilePrefix + "." + strconv.Itoa(shard)
-			db, err := storage.OpenStorage(dbPath)
-			if db == nil || err != nil {
-				log.Fatal("无法打开数据库", dbPath, ": ", err)
+		// 有快照时直接载入，否则从数据库中恢复
+		if engine.initOptions.SnapshotFile == "" || !engine.restoreSnapshotFile() {
+			for shard := 0; shard < engine.initOptions.PersistentStorageShards; shard++ {
+				shard := shard
+				engine.startWorker(func() { engine.persistentStorageInitWorker(shard) })
 			}
-			engine.dbs[shard] = db
-		}
 
-		// 从数据库中恢复
-		for shard := 0; shard < engine.initOptions.PersistentStorageShards; shard++ {
-			go engine.persistentStorageInitWorker(shard)
-		}
-
-		// 等待恢复完成
-		for shard := 0; shard < engine.initOptions.PersistentStorageShards; shard++ {
-			<-engine.persistentStorageInitChannel
-		}
-		for {
-			runtime.Gosched()
-			if engine.numIndexingRequests == engine.numDocumentsIndexed {
-				break
+			// 等待恢复完成
+			for shard := 0; shard < engine.initOptions.PersistentStorageShards; shard++ {
+				<-engine.persistentStorageInitChannel
 			}
+			engine.progress.waitUntil(context.Background(), func() bool {
+				return atomic.LoadUint64(&engine.numIndexingRequests) ==
+					atomic.LoadUint64(&engine.numDocumentsIndexed)
+			})
 		}
 
 		// 关闭并重新打开数据库
 		for shard := 0; shard < engine.initOptions.PersistentStorageShards; shard++ {
 			engine.dbs[shard].Close()
-			dbPath := engine.initOptions.PersistentStorageFolder + "/" + PersistentStorageFilePrefix + "." + strconv.Itoa(shard)
+			dbPath := storagePath(engine.initOptions.PersistentStorageFolder, shard)
 			db, err := storage.OpenStorage(dbPath)
 			if db == nil || err != nil {
-				log.Fatal("无法打开数据库", dbPath, ": ", err)
+				engine.dbs[shard] = nil
+				engine.stopWorkers()
+				engine.closeStorage()
+				return fmt.Errorf("无法打开数据库%s: %w", dbPath, err)
 			}
 			engine.dbs[shard] = db
 		}
 
 		for shard := 0; shard < engine.initOptions.PersistentStorageShards; shard++ {
-			go engine.persistentStorageIndexDocumentWorker(shard)
+			shard := shard
+			engine.startWorker(func() { engine.persistentStorageIndexDocumentWorker(shard) })
 		}
 	}
 
-	atomic.AddUint64(&engine.numDocumentsStored, engine.numIndexingRequests)
+	// 从持久存储或者快照恢复的文档都已经在存储中
+	atomic.StoreUint64(&engine.numDocumentsStored, atomic.LoadUint64(&engine.numIndexingRequests))
+
+	// 全部初始化完成后才能接受请求
+	engine.stateLock.Lock()
+	engine.initialized = true
+	engine.stateLock.Unlock()
+	return nil
+}
+
+// 在读锁下依次对每个分片的索引器调用f，f返回错误时停止
+func (engine *Engine) forEachIndexer(f func(indexer *core.Indexer) error) error {
+	engine.shardsLock.RLock()
+	defer engine.shardsLock.RUnlock()
+	for _, indexer := range engine.indexers {
+		if err := f(indexer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 启动一个工作协程，工作协程应在engine.done关闭时退出
+func (engine *Engine) startWorker(worker func()) {
+	engine.workers.Add(1)
+	go func() {
+		defer engine.workers.Done()
+		worker()
+	}()
+}
+
+// 通知全部工作协程退出并等待
+func (engine *Engine) stopWorkers() {
+	close(engine.done)
+	engine.workers.Wait()
+}
+
+func (engine *Engine) closeStorage() {
+	for _, db := range engine.dbs {
+		if db != nil {
+			db.Close()
+		}
+	}
+	engine.dbs = nil
+	if engine.wal != nil {
+		engine.wal.close()
+		engine.wal = nil
+	}
+}
+
+// 检查引擎是否可用，可用时登记一个正在处理的请求
+// 返回nil时调用者必须在处理完毕后调用engine.requests.Done()
+func (engine *Engine) enter() error {
+	engine.stateLock.RLock()
+	defer engine.stateLock.RUnlock()
+	if engine.closed {
+		return types.ErrClosed
+	}
+	if !engine.initialized {
+		return types.ErrNotInitialized
+	}
+	engine.requests.Add(1)
+	return nil
 }
 
 // 将文档加入索引
@@ -244,20 +402,40 @@ func (engine *Engine) Init(options types.EngineInitOptions) {
 //      1. 这个函数是线程安全的，请尽可能并发调用以提高索引速度
 //      2. 这个函数调用是非同步的，也就是说在函数返回时有可能文档还没有加入索引中，因此
 //         如果立刻调用Search可能无法查询到这个文档。强制刷新索引请调用FlushIndex函数。
-func (engine *Engine) IndexDocument(docId uint64, data types.DocumentIndexData, forceUpdate bool) {
-	engine.internalIndexDocument(docId, data, forceUpdate)
+//      3. 返回错误：引擎尚未初始化或者已经关闭、属性值无效（types.ErrInvalidAttribute）、
+//         文档无法编码（types.ErrDocumentCodec）或者预写日志写入失败
+func (engine *Engine) IndexDocument(docId uint64, data types.DocumentIndexData, forceUpdate bool) error {
+	if err := engine.enter(); err != nil {
+		return err
+	}
+	defer engine.requests.Done()
+	if _, err := types.NewAttributeValues(data.Attributes); err != nil {
+		return err
+	}
+	return engine.indexDocument(docId, data, forceUpdate)
+}
 
-	hash := murmur.Murmur3([]byte(fmt.Sprintf("%d", docId))) % uint32(engine.initOptions.PersistentStorageShards)
-	if engine.initOptions.UsePersistentStorage && docId != 0 {
-		engine.persistentStorageIndexDocumentChannels[hash] <- persistentStorageIndexDocumentRequest{docId: docId, data: data}
+func (engine *Engine) indexDocument(docId uint64, data types.DocumentIndexData, forceUpdate bool) error {
+	if !engine.initOptions.UsePersistentStorage || docId == 0 {
+		engine.internalIndexDocument(docId, data, forceUpdate)
+		return nil
+	}
+
+	// 先编码，编码失败时不索引文档
+	value, err := engine.encodeDocument(&data)
+	if err != nil {
+		return err
 	}
+	documents := []encodedDocument{{DocId: docId, Value: value}}
+	return engine.writeAhead(walIndexDocuments, documents, func() {
+		engine.internalIndexDocument(docId, data, forceUpdate)
+		hash := engine.storageShard(docId)
+		engine.persistentStorageIndexDocumentChannels[hash] <- persistentStorageIndexDocumentRequest{docId: docId, value: value}
+	})
 }
 
 func (engine *Engine) internalIndexDocument(
 	docId uint64, data types.DocumentIndexData, forceUpdate bool) {
-	if !engine.initialized {
-		log.Fatal("必须先初始化引擎")
-	}
 
 	if docId != 0 {
 		atomic.AddUint64(&engine.numIndexingRequests, 1)
@@ -265,7 +443,7 @@ func (engine *Engine) internalIndexDocument(
 	if forceUpdate {
 		atomic.AddUint64(&engine.numForceUpdatingRequests, 1)
 	}
-	hash := murmur.Murmur3([]byte(fmt.Sprintf("%d%s", docId, data.Content)))
+	hash := documentHash(docId, data.Content)
 	engine.segmenterChannel <- segmenterRequest{
 		docId: docId, hash: hash, data: data, forceUpdate: forceUpdate}
 }
@@ -280,37 +458,133 @@ func (engine *Engine) internalIndexDocument(
 //      1. 这个函数是线程安全的，请尽可能并发调用以提高索引速度
 //      2. 这个函数调用是非同步的，也就是说在函数返回时有可能文档还没有加入索引中，因此
 //         如果立刻调用Search可能无法查询到这个文档。强制刷新索引请调用FlushIndex函数。
-func (engine *Engine) RemoveDocument(docId uint64, forceUpdate bool) {
-	if !engine.initialized {
-		log.Fatal("必须先初始化引擎")
+//      3. 返回错误：引擎尚未初始化或者已经关闭，或者预写日志写入失败
+func (engine *Engine) RemoveDocument(docId uint64, forceUpdate bool) error {
+	if err := engine.enter(); err != nil {
+		return err
 	}
+	defer engine.requests.Done()
 
-	if docId != 0 {
-		atomic.AddUint64(&engine.numRemovingRequests, 1)
+	var documents []encodedDocument
+	if engine.initOptions.UsePersistentStorage && docId != 0 {
+		documents = []encodedDocument{{DocId: docId}}
 	}
-	if forceUpdate {
-		atomic.AddUint64(&engine.numForceUpdatingRequests, 1)
+	return engine.writeAhead(walRemoveDocument, documents, func() {
+		if docId != 0 {
+			atomic.AddUint64(&engine.numRemovingRequests, 1)
+		}
+		if forceUpdate {
+			atomic.AddUint64(&engine.numForceUpdatingRequests, 1)
+		}
+		for shard := 0; shard < engine.initOptions.NumShards; shard++ {
+			engine.indexerRemoveDocChannels[shard] <- indexerRemoveDocRequest{docId: docId, forceUpdate: forceUpdate}
+			if docId == 0 {
+				continue
+			}
+			engine.rankerRemoveDocChannels[shard] <- rankerRemoveDocRequest{docId: docId}
+		}
+
+		if engine.initOptions.UsePersistentStorage && docId != 0 {
+			// 从数据库中删除，和同一文档的写入在同一个协程中按顺序进行
+			hash := engine.storageShard(docId)
+			engine.persistentStorageIndexDocumentChannels[hash] <- persistentStorageIndexDocumentRequest{
+				docId: docId, remove: true}
+		}
+	})
+}
+
+// 只更新文档的评分字段（DocumentIndexData.Fields），不重新分词和索引
+//
+// 新的评分字段立即对之后的搜索生效，正在进行的搜索看到的是完整的旧值或者新值。文档必须已经
+// 加入排序器（IndexDocument之后调用FlushIndex），否则返回types.ErrDocumentNotFound。
+// 使用持久存储时存储中的评分字段也会被异步更新，FlushIndex会等待更新完成。
+func (engine *Engine) UpdateFields(docId uint64, fields interface{}) error {
+	if err := engine.enter(); err != nil {
+		return err
 	}
-	for shard := 0; shard < engine.initOptions.NumShards; shard++ {
-		engine.indexerRemoveDocChannels[shard] <- indexerRemoveDocRequest{docId: docId, forceUpdate: forceUpdate}
-		if docId == 0 {
-			continue
+	defer engine.requests.Done()
+
+	// 评分字段无法编码时不更新
+	var value []byte
+	if engine.initOptions.UsePersistentStorage {
+		var err error
+		value, err = engine.encodeDocument(&types.DocumentIndexData{Fields: fields})
+		if err != nil {
+			return err
 		}
-		engine.rankerRemoveDocChannels[shard] <- rankerRemoveDocRequest{docId: docId}
 	}
 
-	if engine.initOptions.UsePersistentStorage && docId != 0 {
-		// 从数据库中删除
-		hash := murmur.Murmur3([]byte(fmt.Sprintf("%d", docId))) % uint32(engine.initOptions.PersistentStorageShards)
-		go engine.persistentStorageRemoveDocumentWorker(docId, hash)
+	// 先更新排序器，文档存在时才记录日志
+	if engine.wal != nil {
+		engine.wal.lock.Lock()
+		defer engine.wal.lock.Unlock()
+	}
+
+	// 文档所在的分片由DocId和正文共同决定，因此依次尝试各个排序器
+	updated := false
+	engine.shardsLock.RLock()
+	for _, ranker := range engine.rankers {
+		err := ranker.UpdateFields(docId, fields)
+		if err == nil {
+			updated = true
+			break
+		}
+		if !errors.Is(err, types.ErrDocumentNotFound) {
+			engine.shardsLock.RUnlock()
+			return err
+		}
+	}
+	engine.shardsLock.RUnlock()
+	if !updated {
+		return types.ErrDocumentNotFound
 	}
+
+	if engine.initOptions.UsePersistentStorage {
+		if engine.wal != nil {
+			documents := []encodedDocument{{DocId: docId, Value: value}}
+			if err := engine.wal.append(walUpdateFields, documents); err != nil {
+				return err
+			}
+		}
+		atomic.AddUint64(&engine.numFieldUpdatingRequests, 1)
+		hash := engine.storageShard(docId)
+		engine.persistentStorageIndexDocumentChannels[hash] <- persistentStorageIndexDocumentRequest{
+			docId: docId, data: types.DocumentIndexData{Fields: fields}, fieldsOnly: true}
+		if engine.wal != nil {
+			engine.checkpointFullWAL()
+		}
+	}
+	return nil
+}
+
+// 从持久存储中读出文档的数据，即IndexDocument时传入的DocumentIndexData
+//
+// 需要打开EngineInitOptions.UsePersistentStorage，否则返回types.ErrPersistentStorageDisabled；
+// 文档不存在时返回types.ErrDocumentNotFound。文档是异步写入持久存储的，IndexDocument之后
+// 需要调用FlushIndex才能保证读到。无法解码时返回types.ErrDocumentCodec，见EngineInitOptions.Codec。
+func (engine *Engine) GetDocument(docId uint64) (types.DocumentIndexData, error) {
+	if err := engine.enter(); err != nil {
+		return types.DocumentIndexData{}, err
+	}
+	defer engine.requests.Done()
+	return engine.getStoredDocument(docId)
 }
 
 // 查找满足搜索条件的文档，此函数线程安全
-func (engine *Engine) Search(request types.SearchRequest) (output types.SearchResponse) {
-	if !engine.initialized {
-		log.Fatal("必须先初始化引擎")
+func (engine *Engine) Search(request types.SearchRequest) (output types.SearchResponse, err error) {
+	return engine.SearchContext(context.Background(), request)
+}
+
+// 同Search，ctx用于控制搜索的截止时间和取消
+//
+// ctx结束后索引器和排序器会尽快中止这次搜索。如果是到了截止时间（包括request.Timeout），
+// 返回已经完成的分片的结果，并将output.Timeout设为true；如果ctx被取消，返回ctx.Err()。
+func (engine *Engine) SearchContext(ctx context.Context, request types.SearchRequest) (
+	output types.SearchResponse, err error) {
+	if err = engine.enter(); err != nil {
+		return
 	}
+	defer engine.requests.Done()
 
 	var rankOptions types.RankOptions
 	if request.RankOptions == nil {
@@ -322,19 +596,101 @@ func (engine *Engine) Search(request types.SearchRequest) (output types.SearchRe
 		rankOptions.ScoringCriteria = engine.initOptions.DefaultRankOptions.ScoringCriteria
 	}
 
+	if request.LoadDocuments && !engine.initOptions.UsePersistentStorage {
+		err = types.ErrPersistentStorageDisabled
+		return
+	}
+
+	for _, filter := range request.Filters {
+		for _, bound := range []interface{}{filter.Min, filter.Max} {
+			if bound == nil {
+				continue
+			}
+			if _, err = types.NewAttributeValue(bound); err != nil {
+				return
+			}
+		}
+	}
+
 	// 收集关键词
 	tokens := []string{}
-	if request.Text != "" && engine.segmenter != nil {
-		querySegments := engine.segmenter.Segment([]byte(request.Text))
-		for _, s := range querySegments {
-			token := s.Token().Text()
-			if engine.stopTokens != nil && !engine.stopTokens.IsStopToken(token) {
-				tokens = append(tokens, s.Token().Text())
+	var query types.Query
+	if request.Query != nil {
+		query = engine.analyzeQuery(request.Query)
+		if query == nil {
+			// 查询中只有停用词
+			output.Tokens = tokens
+			return
+		}
+		query = engine.expandQuery(query)
+		tokens = types.CollectTerms(query)
+	} else if request.Pinyin {
+		tokens = types.PinyinKeywords(request.Text)
+	} else if request.Phrase {
+		phrase := types.PhraseQuery{Slop: request.Slop}
+		if request.Text != "" && engine.tokenizer != nil {
+			phrase.Terms, phrase.Gaps = engine.segmentPhrase(request.Text)
+		} else {
+			phrase.Terms = request.Tokens
+		}
+		query = phrase
+		if len(request.Labels) > 0 {
+			and := types.AndQuery{Queries: []types.Query{phrase}}
+			for _, label := range request.Labels {
+				and.Queries = append(and.Queries, types.LabelQuery{Label: label})
 			}
+			query = and
 		}
+		tokens = types.CollectTerms(query)
+	} else if request.Text != "" && engine.tokenizer != nil {
+		tokens = engine.segmentQueryText(request.Text)
 	} else {
 		tokens = append(tokens, request.Tokens...)
 	}
+	// 拼写建议只针对关键词的与查询
+	var suggestTokens []string
+	if query == nil {
+		suggestTokens = tokens
+	}
+	if query == nil && request.Fuzziness > 0 && !request.Phrase && len(tokens) > 0 {
+		// 模糊匹配时改为查询语法树，每个关键词为一个FuzzyQuery
+		and := types.AndQuery{}
+		for _, token := range tokens {
+			and.Queries = append(and.Queries, types.FuzzyQuery{Text: token, MaxDistance: request.Fuzziness})
+		}
+		for _, label := range request.Labels {
+			and.Queries = append(and.Queries, types.LabelQuery{Label: label})
+		}
+		query = and
+	} else if query == nil && engine.hasSynonyms(tokens) {
+		// 有同义词时改为查询语法树，每个关键词扩展为它和同义词的或查询
+		and := types.AndQuery{}
+		for _, token := range tokens {
+			and.Queries = append(and.Queries, engine.expandQuery(types.TermQuery{Text: token}))
+		}
+		for _, label := range request.Labels {
+			and.Queries = append(and.Queries, types.LabelQuery{Label: label})
+		}
+		query = and
+		tokens = types.CollectTerms(query)
+	}
+
+	if query != nil {
+		expansions := make(map[string][]string)
+		if query, err = engine.expandPrefixAndFuzzyQueries(query, expansions); err != nil {
+			return
+		}
+		if len(expansions) > 0 {
+			output.Expansions = expansions
+		}
+		tokens = types.CollectTerms(query)
+	}
+
+	if request.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Millisecond*time.Duration(request.Timeout))
+		defer cancel()
+	}
 
 	// 建立排序器返回的通信通道
 	rankerReturnChannel := make(
@@ -342,56 +698,69 @@ func (engine *Engine) Search(request types.SearchRequest) (output types.SearchRe
 
 	// 生成查找请求
 	lookupRequest := indexerLookupRequest{
+		ctx:                 ctx,
 		countDocsOnly:       request.CountDocsOnly,
 		tokens:              tokens,
 		labels:              request.Labels,
+		query:               query,
 		docIds:              request.DocIds,
 		options:             rankOptions,
 		rankerReturnChannel: rankerReturnChannel,
 		orderless:           request.Orderless,
+		facets:              request.Facets,
+		filters:             request.Filters,
 	}
 
 	// 向索引器发送查找请求
-	for shard := 0; shard < engine.initOptions.NumShards; shard++ {
-		engine.indexerLookupChannels[shard] <- lookupRequest
+	isTimeout := false
+	for shard := 0; shard < engine.initOptions.NumShards && !isTimeout; shard++ {
+		select {
+		case engine.indexerLookupChannels[shard] <- lookupRequest:
+		case <-ctx.Done():
+			isTimeout = true
+		}
 	}
 
 	// 从通信通道读取排序器的输出
 	numDocs := 0
-	rankOutput := types.ScoredDocuments{}
-	timeout := request.Timeout
-	isTimeout := false
-	if timeout <= 0 {
-		// 不设置超时
-		for shard := 0; shard < engine.initOptions.NumShards; shard++ {
-			rankerOutput := <-rankerReturnChannel
-			if !request.CountDocsOnly {
-				rankOutput = append(rankOutput, rankerOutput.docs...)
+	shardOutputs := []types.ScoredDocuments{}
+	facetCounts := make(map[string]map[string]int)
+	for shard := 0; shard < engine.initOptions.NumShards && !isTimeout; shard++ {
+		select {
+		case rankerOutput := <-rankerReturnChannel:
+			if rankerOutput.err != nil {
+				err = rankerOutput.err
 			}
-			numDocs += rankerOutput.numDocs
-		}
-	} else {
-		// 设置超时
-		deadline := time.Now().Add(time.Millisecond * time.Duration(request.Timeout))
-		for shard := 0; shard < engine.initOptions.NumShards && !isTimeout; shard++ {
-			select {
-			case rankerOutput := <-rankerReturnChannel:
-				if !request.CountDocsOnly {
-					rankOutput = append(rankOutput, rankerOutput.docs...)
-				}
-				numDocs += rankerOutput.numDocs
-			case <-time.After(time.Until(deadline)):
-				isTimeout = true
+			mergeFacetCounts(facetCounts, rankerOutput.facets)
+			if !request.CountDocsOnly && len(rankerOutput.docs) > 0 {
+				shardOutputs = append(shardOutputs, rankerOutput.docs)
 			}
+			numDocs += rankerOutput.numDocs
+		case <-ctx.Done():
+			isTimeout = true
 		}
 	}
 
-	// 再排序
-	if !request.CountDocsOnly && !request.Orderless {
-		if rankOptions.ReverseOrder {
-			sort.Sort(sort.Reverse(rankOutput))
+	if err != nil {
+		return types.SearchResponse{}, err
+	}
+	if isTimeout && !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return types.SearchResponse{}, ctx.Err()
+	}
+
+	// 归并各个分片已排序的输出，只需要取到分页的末尾
+	rankOutput := types.ScoredDocuments{}
+	if !request.CountDocsOnly {
+		if request.Orderless {
+			for _, docs := range shardOutputs {
+				rankOutput = append(rankOutput, docs...)
+			}
 		} else {
-			sort.Sort(rankOutput)
+			limit := 0
+			if rankOptions.MaxOutputs != 0 {
+				limit = rankOptions.OutputOffset + rankOptions.MaxOutputs
+			}
+			rankOutput = mergeScoredDocs(shardOutputs, limit, rankOptions.ReverseOrder)
 		}
 	}
 
@@ -414,45 +783,124 @@ func (engine *Engine) Search(request types.SearchRequest) (output types.SearchRe
 			output.Docs = rankOutput[start:end]
 		}
 	}
+	if request.LoadDocuments {
+		if err = engine.loadDocuments(output.Docs); err != nil {
+			return types.SearchResponse{}, err
+		}
+	}
 	output.NumDocs = numDocs
 	output.Timeout = isTimeout
+	if len(request.Facets) > 0 {
+		output.Facets = sortFacetCounts(facetCounts, request.Facets)
+	}
+	if request.Suggest && numDocs == 0 && !isTimeout && len(suggestTokens) > 0 {
+		if output.Suggestions, err = engine.spellingSuggestions(
+			suggestTokens, request.Labels, request.Pinyin); err != nil {
+			return types.SearchResponse{}, err
+		}
+	}
 	return
 }
 
 // 阻塞等待直到所有索引添加完毕
-func (engine *Engine) FlushIndex() {
-	for {
-		runtime.Gosched()
-		if engine.numIndexingRequests == engine.numDocumentsIndexed &&
-			engine.numRemovingRequests*uint64(engine.initOptions.NumShards) == engine.numDocumentsRemoved &&
-			(!engine.initOptions.UsePersistentStorage || engine.numIndexingRequests == engine.numDocumentsStored) {
-			// 保证 CHANNEL 中 REQUESTS 全部被执行完
-			break
-		}
+func (engine *Engine) FlushIndex() error {
+	return engine.FlushIndexContext(context.Background())
+}
+
+// 同FlushIndex，ctx结束时不再等待并返回ctx.Err()，此时索引可能尚未全部添加完毕
+func (engine *Engine) FlushIndexContext(ctx context.Context) error {
+	if err := engine.enter(); err != nil {
+		return err
 	}
-	// 强制更新，保证其为最后的请求
-	engine.IndexDocument(0, types.DocumentIndexData{}, true)
-	for {
-		runtime.Gosched()
-		if engine.numForceUpdatingRequests*uint64(engine.initOptions.NumShards) == engine.numDocumentsForceUpdated {
-			return
+	defer engine.requests.Done()
+	return engine.flushIndex(ctx)
+}
+
+// 持久存储是否已经执行完此前发出的全部写操作
+func (engine *Engine) storageCaughtUp() bool {
+	return atomic.LoadUint64(&engine.numIndexingRequests) == atomic.LoadUint64(&engine.numDocumentsStored) &&
+		atomic.LoadUint64(&engine.numRemovingRequests) == atomic.LoadUint64(&engine.numDocumentsUnstored) &&
+		atomic.LoadUint64(&engine.numFieldUpdatingRequests) == atomic.LoadUint64(&engine.numFieldUpdatesStored)
+}
+
+func (engine *Engine) flushIndex(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	numShards := uint64(engine.initOptions.NumShards)
+
+	// 此前记录在日志中的操作都已计入计数器
+	var walSeq uint64
+	if engine.wal != nil {
+		walSeq = engine.wal.lastSeq()
+	}
+
+	// 保证 CHANNEL 中 REQUESTS 全部被执行完
+	err := engine.progress.waitUntil(ctx, func() bool {
+		numIndexingRequests := atomic.LoadUint64(&engine.numIndexingRequests)
+		return numIndexingRequests == atomic.LoadUint64(&engine.numDocumentsIndexed) &&
+			numIndexingRequests == atomic.LoadUint64(&engine.numDocumentsRanked) &&
+			atomic.LoadUint64(&engine.numRemovingRequests)*numShards == atomic.LoadUint64(&engine.numDocumentsRemoved) &&
+			(!engine.initOptions.UsePersistentStorage || engine.storageCaughtUp())
+	})
+	if err != nil {
+		return err
+	}
+	if engine.wal != nil && atomic.LoadUint64(&engine.numStorageErrors) == 0 {
+		// 持久存储已经包含日志中的操作
+		if err := engine.wal.checkpoint(walSeq); err != nil {
+			return err
 		}
 	}
+
+	// 强制更新，保证其为最后的请求
+	engine.indexDocument(0, types.DocumentIndexData{}, true)
+	return engine.progress.waitUntil(ctx, func() bool {
+		return atomic.LoadUint64(&engine.numForceUpdatingRequests)*numShards ==
+			atomic.LoadUint64(&engine.numDocumentsForceUpdated)
+	})
 }
 
 // 关闭引擎并释放资源
-func (engine *Engine) Close() {
-	engine.FlushIndex()
-	engine.initialized = false
+//
+// 关闭时先等待正在处理的请求完成并刷新索引，然后停止全部工作协程，最后关闭索引器、
+// 排序器和持久存储。关闭后再调用引擎的函数会返回types.ErrClosed。
+// 设置了EngineInitOptions.SnapshotFile时在关闭索引器之前写入快照，写入失败时返回错误。
+func (engine *Engine) Close() error {
+	engine.stateLock.Lock()
+	if engine.closed {
+		engine.stateLock.Unlock()
+		return types.ErrClosed
+	}
+	if !engine.initialized {
+		engine.stateLock.Unlock()
+		return types.ErrNotInitialized
+	}
+	engine.closed = true
+	engine.stateLock.Unlock()
+
+	// 此后不会有新的请求进入
+	engine.requests.Wait()
+	engine.flushIndex(context.Background())
+	engine.stopWorkers()
 
-	if !engine.usingExternalSegmenter && engine.segmenter != nil {
-		engine.segmenter.Close()
+	var err error
+	if engine.initOptions.UsePersistentStorage && engine.initOptions.SnapshotFile != "" {
+		err = engine.writeSnapshotFile()
+	}
+
+	if engine.segoTokenizer != nil {
+		engine.segoTokenizer.Close()
 	}
 
 	if !engine.usingExternalStopTokens && engine.stopTokens != nil {
 		engine.stopTokens.Close()
 	}
 
+	if !engine.usingExternalSynonyms && engine.synonyms != nil {
+		engine.synonyms.Close()
+	}
+
 	for _, ranker := range engine.rankers {
 		ranker.Close()
 	}
@@ -463,12 +911,7 @@ func (engine *Engine) Close() {
 	}
 	engine.indexers = nil
 
-	if engine.initOptions.UsePersistentStorage {
-		for _, db := range engine.dbs {
-			db.Close()
-		}
-		engine.dbs = nil
-	}
+	engine.closeStorage()
 
 	engine.indexerAddDocChannels = nil
 	engine.indexerRemoveDocChannels = nil
@@ -477,9 +920,23 @@ func (engine *Engine) Close() {
 	engine.rankerRankChannels = nil
 	engine.rankerRemoveDocChannels = nil
 	engine.persistentStorageIndexDocumentChannels = nil
+	return err
 }
 
 // 从文本hash得到要分配到的shard
+// 文档的哈希值，决定文档所在的分片，和fmt.Sprintf("%d%s", docId, content)的哈希值相同
+func documentHash(docId uint64, content string) uint32 {
+	b := make([]byte, 0, 20+len(content))
+	b = strconv.AppendUint(b, docId, 10)
+	return murmur.Murmur3(append(b, content...))
+}
+
+// 文档所在的持久存储分片
+func (engine *Engine) storageShard(docId uint64) int {
+	hash := murmur.Murmur3(strconv.AppendUint(nil, docId, 10))
+	return int(hash % uint32(engine.initOptions.PersistentStorageShards))
+}
+
 func (engine *Engine) getShard(hash uint32) int {
 	return int(hash - hash/uint32(engine.initOptions.NumShards)*uint32(engine.initOptions.NumShards))
 }
@@ -1,11 +1,22 @@
 package engine
 
 import (
+	"bytes"
+	"context"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/rand"
 	"os"
 	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/huichen/wukong/storage"
 	"github.com/huichen/wukong/types"
 	"github.com/huichen/wukong/utils"
 )
@@ -100,7 +111,7 @@ func TestEngineIndexDocument(t *testing.T) {
 
 	AddDocs(&engine)
 
-	outputs := engine.Search(types.SearchRequest{Text: "中国人口"})
+	outputs, _ := engine.Search(types.SearchRequest{Text: "中国人口"})
 	utils.Expect(t, "2", len(outputs.Tokens))
 	utils.Expect(t, "中国", outputs.Tokens[0])
 	utils.Expect(t, "人口", outputs.Tokens[1])
@@ -137,7 +148,7 @@ func TestReverseOrder(t *testing.T) {
 
 	AddDocs(&engine)
 
-	outputs := engine.Search(types.SearchRequest{Text: "中国人口"})
+	outputs, _ := engine.Search(types.SearchRequest{Text: "中国人口"})
 	utils.Expect(t, "3", len(outputs.Docs))
 
 	utils.Expect(t, "1", outputs.Docs[0].DocId)
@@ -163,7 +174,7 @@ func TestOffsetAndMaxOutputs(t *testing.T) {
 
 	AddDocs(&engine)
 
-	outputs := engine.Search(types.SearchRequest{Text: "中国人口"})
+	outputs, _ := engine.Search(types.SearchRequest{Text: "中国人口"})
 	utils.Expect(t, "2", len(outputs.Docs))
 
 	utils.Expect(t, "5", outputs.Docs[0].DocId)
@@ -197,7 +208,7 @@ func TestSearchWithCriteria(t *testing.T) {
 
 	AddDocs(&engine)
 
-	outputs := engine.Search(types.SearchRequest{Text: "中国人口"})
+	outputs, _ := engine.Search(types.SearchRequest{Text: "中国人口"})
 	utils.Expect(t, "2", len(outputs.Docs))
 
 	utils.Expect(t, "1", outputs.Docs[0].DocId)
@@ -219,7 +230,7 @@ func TestCompactIndex(t *testing.T) {
 
 	AddDocs(&engine)
 
-	outputs := engine.Search(types.SearchRequest{Text: "中国人口"})
+	outputs, _ := engine.Search(types.SearchRequest{Text: "中国人口"})
 	utils.Expect(t, "2", len(outputs.Docs))
 
 	utils.Expect(t, "5", outputs.Docs[0].DocId)
@@ -255,7 +266,7 @@ func TestFrequenciesIndex(t *testing.T) {
 
 	AddDocs(&engine)
 
-	outputs := engine.Search(types.SearchRequest{Text: "中国人口"})
+	outputs, _ := engine.Search(types.SearchRequest{Text: "中国人口"})
 	utils.Expect(t, "2", len(outputs.Docs))
 
 	utils.Expect(t, "5", outputs.Docs[0].DocId)
@@ -285,7 +296,7 @@ func TestRemoveDocument(t *testing.T) {
 	}, false)
 	engine.FlushIndex()
 
-	outputs := engine.Search(types.SearchRequest{Text: "中国人口"})
+	outputs, _ := engine.Search(types.SearchRequest{Text: "中国人口"})
 	utils.Expect(t, "2", len(outputs.Docs))
 
 	utils.Expect(t, "6", outputs.Docs[0].DocId)
@@ -334,7 +345,7 @@ func TestEngineIndexDocumentWithTokens(t *testing.T) {
 	}, false)
 	engine.FlushIndex()
 
-	outputs := engine.Search(types.SearchRequest{Text: "中国人口"})
+	outputs, _ := engine.Search(types.SearchRequest{Text: "中国人口"})
 	utils.Expect(t, "2", len(outputs.Tokens))
 	utils.Expect(t, "中国", outputs.Tokens[0])
 	utils.Expect(t, "人口", outputs.Tokens[1])
@@ -373,8 +384,8 @@ func TestEngineIndexDocumentWithContentAndLabels(t *testing.T) {
 	addDocsWithLabels(&engine1)
 	addDocsWithLabels(&engine2)
 
-	outputs1 := engine1.Search(types.SearchRequest{Text: "百度"})
-	outputs2 := engine2.Search(types.SearchRequest{Text: "百度"})
+	outputs1, _ := engine1.Search(types.SearchRequest{Text: "百度"})
+	outputs2, _ := engine2.Search(types.SearchRequest{Text: "百度"})
 	utils.Expect(t, "1", len(outputs1.Tokens))
 	utils.Expect(t, "1", len(outputs2.Tokens))
 	utils.Expect(t, "百度", outputs1.Tokens[0])
@@ -385,6 +396,8 @@ func TestEngineIndexDocumentWithContentAndLabels(t *testing.T) {
 
 func TestEngineIndexDocumentWithPersistentStorage(t *testing.T) {
 	gob.Register(ScoringFields{})
+	// 测试中途失败时也删除数据库，不在目录中留下文件
+	defer os.RemoveAll("wukong.persistent")
 	var engine Engine
 	engine.Init(types.EngineInitOptions{
 		SegmenterDictionaries: "../testdata/test_dict.txt",
@@ -425,7 +438,7 @@ func TestEngineIndexDocumentWithPersistentStorage(t *testing.T) {
 
 	engine1.FlushIndex()
 
-	outputs := engine1.Search(types.SearchRequest{Text: "中国人口"})
+	outputs, _ := engine1.Search(types.SearchRequest{Text: "中国人口"})
 	utils.Expect(t, "2", len(outputs.Tokens))
 	utils.Expect(t, "中国", outputs.Tokens[0])
 	utils.Expect(t, "人口", outputs.Tokens[1])
@@ -440,7 +453,185 @@ func TestEngineIndexDocumentWithPersistentStorage(t *testing.T) {
 	utils.Expect(t, "[0 18]", outputs.Docs[1].TokenSnippetLocations)
 
 	engine1.Close()
-	os.RemoveAll("wukong.persistent")
+}
+
+func TestEngineErrors(t *testing.T) {
+	_, err := NewEngine(types.EngineInitOptions{
+		SegmenterDictionaries: "../testdata/not_exist.txt",
+	})
+	utils.Expect(t, "true", errors.Is(err, types.ErrDictionaryNotFound))
+
+	var uninitialized Engine
+	_, err = uninitialized.Search(types.SearchRequest{Text: "中国人口"})
+	utils.Expect(t, "true", errors.Is(err, types.ErrNotInitialized))
+
+	// Init失败时返回错误，引擎不可用
+	err = uninitialized.Init(types.EngineInitOptions{
+		Tokenizer:               types.WordTokenizer{},
+		UsePersistentStorage:    true,
+		PersistentStorageFolder: "engine_test.go",
+	})
+	utils.Expect(t, "false", err == nil)
+	utils.Expect(t, "true", errors.Is(uninitialized.IndexDocument(1, types.DocumentIndexData{}, false), types.ErrNotInitialized))
+	utils.Expect(t, "true", errors.Is(uninitialized.FlushIndex(), types.ErrNotInitialized))
+	utils.Expect(t, "true", errors.Is(uninitialized.Close(), types.ErrNotInitialized))
+
+	engine, err := NewEngine(types.EngineInitOptions{
+		SegmenterDictionaries: "../testdata/test_dict.txt",
+	})
+	utils.Expect(t, "<nil>", err)
+	AddDocs(engine)
+	utils.Expect(t, "<nil>", engine.Close())
+
+	utils.Expect(t, "true", errors.Is(engine.Close(), types.ErrClosed))
+	utils.Expect(t, "true", errors.Is(engine.RemoveDocument(1, false), types.ErrClosed))
+	_, err = engine.Search(types.SearchRequest{Text: "中国人口"})
+	utils.Expect(t, "true", errors.Is(err, types.ErrClosed))
+}
+
+func TestCloseStopsWorkers(t *testing.T) {
+	numGoroutines := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		engine, err := NewEngine(types.EngineInitOptions{
+			SegmenterDictionaries: "../testdata/test_dict.txt",
+		})
+		utils.Expect(t, "<nil>", err)
+		AddDocs(engine)
+		engine.Search(types.SearchRequest{Text: "中国人口", Timeout: 1})
+		utils.Expect(t, "<nil>", engine.Close())
+	}
+
+	// 退出的协程可能还没有被运行时回收
+	for i := 0; i < 100 && runtime.NumGoroutine() > numGoroutines; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	utils.Expect(t, "true", runtime.NumGoroutine() <= numGoroutines)
+}
+
+func TestSearchContext(t *testing.T) {
+	engine, _ := NewEngine(types.EngineInitOptions{
+		SegmenterDictionaries: "../testdata/test_dict.txt",
+	})
+	defer engine.Close()
+	AddDocs(engine)
+	engine.FlushIndex()
+
+	outputs, err := engine.SearchContext(context.Background(), types.SearchRequest{Text: "中国人口"})
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "false", outputs.Timeout)
+	utils.Expect(t, "3", len(outputs.Docs))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = engine.SearchContext(ctx, types.SearchRequest{Text: "中国人口"})
+	utils.Expect(t, "context canceled", err)
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+	outputs, err = engine.SearchContext(ctx, types.SearchRequest{Text: "中国人口"})
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "true", outputs.Timeout)
+}
+
+func TestFlushIndexContext(t *testing.T) {
+	engine, _ := NewEngine(types.EngineInitOptions{
+		SegmenterDictionaries: "../testdata/test_dict.txt",
+	})
+	defer engine.Close()
+	AddDocs(engine)
+	engine.RemoveDocument(5, false)
+
+	utils.Expect(t, "<nil>", engine.FlushIndexContext(context.Background()))
+	utils.Expect(t, "5", engine.NumDocumentsIndexed())
+	outputs, _ := engine.Search(types.SearchRequest{Text: "中国人口"})
+	utils.Expect(t, "2", len(outputs.Docs))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	utils.Expect(t, "context canceled", engine.FlushIndexContext(ctx))
+}
+
+func TestSearchWithFacets(t *testing.T) {
+	engine, _ := NewEngine(types.EngineInitOptions{
+		SegmenterDictionaries: "../testdata/test_dict.txt",
+		NumShards:             3,
+	})
+	defer engine.Close()
+
+	engine.IndexDocument(1, types.DocumentIndexData{
+		Content: "中国有十三亿人口", Labels: []string{"category:人口", "source:新闻"}}, false)
+	engine.IndexDocument(2, types.DocumentIndexData{
+		Content: "中国人口", Labels: []string{"category:人口"}}, false)
+	engine.IndexDocument(3, types.DocumentIndexData{
+		Content: "有人口", Labels: []string{"category:地理", "source:新闻"}}, false)
+	engine.IndexDocument(4, types.DocumentIndexData{
+		Content: "中国十三亿", Labels: []string{"category:地理"}}, false)
+	engine.FlushIndex()
+
+	request := types.SearchRequest{
+		Text: "人口",
+		Facets: []types.FacetRequest{
+			{Prefix: "category:"},
+			{Name: "source", Labels: []string{"source:新闻", "source:微博"}},
+			{Name: "top", Prefix: "category:", TopN: 1},
+		},
+		RankOptions: &types.RankOptions{MaxOutputs: 1},
+	}
+	outputs, _ := engine.Search(request)
+	utils.Expect(t, "1", len(outputs.Docs))
+	utils.Expect(t, "[{category:人口 2} {category:地理 1}]", outputs.Facets["category:"])
+	utils.Expect(t, "[{source:新闻 2} {source:微博 0}]", outputs.Facets["source"])
+	utils.Expect(t, "[{category:人口 2}]", outputs.Facets["top"])
+
+	request.CountDocsOnly = true
+	outputs, _ = engine.Search(request)
+	utils.Expect(t, "3", outputs.NumDocs)
+	utils.Expect(t, "[{category:人口 2} {category:地理 1}]", outputs.Facets["category:"])
+}
+
+func TestSearchWithFilters(t *testing.T) {
+	engine, _ := NewEngine(types.EngineInitOptions{
+		SegmenterDictionaries: "../testdata/test_dict.txt",
+	})
+	defer engine.Close()
+
+	prices := []interface{}{15, int64(30), 45.5, float32(60)}
+	for i, price := range prices {
+		engine.IndexDocument(uint64(i+1), types.DocumentIndexData{
+			Content:    "中国人口",
+			Attributes: map[string]interface{}{"price": price},
+		}, false)
+	}
+	err := engine.IndexDocument(5, types.DocumentIndexData{
+		Content:    "中国人口",
+		Attributes: map[string]interface{}{"price": "100"},
+	}, false)
+	utils.Expect(t, "true", errors.Is(err, types.ErrInvalidAttribute))
+	engine.FlushIndex()
+
+	outputs, _ := engine.Search(types.SearchRequest{
+		Text:    "中国人口",
+		Filters: []types.AttributeFilter{{Name: "price", Min: 20, Max: 50}},
+	})
+	utils.Expect(t, "2", outputs.NumDocs)
+	docIds := make(map[uint64]bool)
+	for _, doc := range outputs.Docs {
+		docIds[doc.DocId] = true
+	}
+	utils.Expect(t, "map[2:true 3:true]", docIds)
+
+	outputs, _ = engine.Search(types.SearchRequest{
+		Text:          "中国人口",
+		CountDocsOnly: true,
+		Filters:       []types.AttributeFilter{{Name: "price", Min: 45.5}},
+	})
+	utils.Expect(t, "2", outputs.NumDocs)
+
+	_, err = engine.Search(types.SearchRequest{
+		Text:    "中国人口",
+		Filters: []types.AttributeFilter{{Name: "price", Max: "50"}},
+	})
+	utils.Expect(t, "true", errors.Is(err, types.ErrInvalidAttribute))
 }
 
 func TestCountDocsOnly(t *testing.T) {
@@ -463,7 +654,7 @@ func TestCountDocsOnly(t *testing.T) {
 	engine.RemoveDocument(5, false)
 	engine.FlushIndex()
 
-	outputs := engine.Search(types.SearchRequest{Text: "中国人口", CountDocsOnly: true})
+	outputs, _ := engine.Search(types.SearchRequest{Text: "中国人口", CountDocsOnly: true})
 	utils.Expect(t, "0", len(outputs.Docs))
 	utils.Expect(t, "2", len(outputs.Tokens))
 	utils.Expect(t, "2", outputs.NumDocs)
@@ -490,7 +681,7 @@ func TestSearchWithin(t *testing.T) {
 	docIds := make(map[uint64]bool)
 	docIds[5] = true
 	docIds[1] = true
-	outputs := engine.Search(types.SearchRequest{
+	outputs, _ := engine.Search(types.SearchRequest{
 		Text:   "中国人口",
 		DocIds: docIds,
 	})
@@ -507,3 +698,1172 @@ func TestSearchWithin(t *testing.T) {
 	utils.Expect(t, "100", int(outputs.Docs[1].Scores[0]*1000))
 	utils.Expect(t, "[0 15]", outputs.Docs[1].TokenSnippetLocations)
 }
+
+func TestSearchWithQuery(t *testing.T) {
+	var engine Engine
+	engine.Init(types.EngineInitOptions{
+		SegmenterDictionaries: "../testdata/test_dict.txt",
+		DefaultRankOptions: &types.RankOptions{
+			ReverseOrder:    true,
+			OutputOffset:    0,
+			MaxOutputs:      10,
+			ScoringCriteria: &RankByTokenProximity{},
+		},
+		IndexerInitOptions: &types.IndexerInitOptions{
+			IndexType: types.LocationsIndex,
+		},
+	})
+	defer engine.Close()
+
+	AddDocs(&engine)
+
+	query, err := types.ParseQuery("中国 OR 有 -十三亿")
+	utils.Expect(t, "<nil>", err)
+	outputs, _ := engine.Search(types.SearchRequest{Query: query})
+	utils.Expect(t, "[中国 有]", outputs.Tokens)
+	utils.Expect(t, "2", len(outputs.Docs))
+	locations := make(map[uint64][]int)
+	for _, doc := range outputs.Docs {
+		locations[doc.DocId] = doc.TokenSnippetLocations
+	}
+	utils.Expect(t, "map[2:[0 -1] 3:[-1 0]]", locations)
+
+	// "中国人口"被分词为"中国"和"人口"的与查询
+	query, err = types.ParseQuery("中国人口 NOT 有")
+	utils.Expect(t, "<nil>", err)
+	outputs, _ = engine.Search(types.SearchRequest{Query: query})
+	utils.Expect(t, "[中国 人口]", outputs.Tokens)
+	utils.Expect(t, "2", len(outputs.Docs))
+	utils.Expect(t, "5", outputs.Docs[0].DocId)
+	utils.Expect(t, "2", outputs.Docs[1].DocId)
+
+	// 引号内为短语
+	query, err = types.ParseQuery("\"中国人口\" NOT 有")
+	utils.Expect(t, "<nil>", err)
+	outputs, _ = engine.Search(types.SearchRequest{Query: query})
+	utils.Expect(t, "[中国 人口]", outputs.Tokens)
+	utils.Expect(t, "1", len(outputs.Docs))
+	utils.Expect(t, "2", outputs.Docs[0].DocId)
+
+	_, err = types.ParseQuery("(中国 OR")
+	utils.Expect(t, "查询语法错误：OR后缺少查询", err)
+}
+
+func TestSearchPhrase(t *testing.T) {
+	var engine Engine
+	engine.Init(types.EngineInitOptions{
+		SegmenterDictionaries: "../testdata/test_dict.txt",
+		DefaultRankOptions: &types.RankOptions{
+			OutputOffset:    0,
+			MaxOutputs:      10,
+			ScoringCriteria: &RankByTokenProximity{},
+		},
+		IndexerInitOptions: &types.IndexerInitOptions{
+			IndexType: types.LocationsIndex,
+		},
+	})
+	defer engine.Close()
+
+	AddDocs(&engine)
+
+	outputs, _ := engine.Search(types.SearchRequest{Text: "中国人口", Phrase: true})
+	utils.Expect(t, "[中国 人口]", outputs.Tokens)
+	utils.Expect(t, "1", len(outputs.Docs))
+	utils.Expect(t, "2", outputs.Docs[0].DocId)
+
+	// "十三亿"占9个字节
+	outputs, _ = engine.Search(types.SearchRequest{Text: "中国人口", Phrase: true, Slop: 9})
+	utils.Expect(t, "2", len(outputs.Docs))
+	utils.Expect(t, "2", outputs.Docs[0].DocId)
+	utils.Expect(t, "5", outputs.Docs[1].DocId)
+
+	query, err := types.ParseQuery("\"中国人口\"~12")
+	utils.Expect(t, "<nil>", err)
+	outputs, _ = engine.Search(types.SearchRequest{Query: query})
+	utils.Expect(t, "3", len(outputs.Docs))
+
+	// 顺序颠倒的关键词不满足短语查询
+	outputs, _ = engine.Search(types.SearchRequest{Tokens: []string{"人口", "中国"}, Phrase: true, Slop: 100})
+	utils.Expect(t, "0", len(outputs.Docs))
+}
+
+func TestCustomTokenizer(t *testing.T) {
+	var engine Engine
+	engine.Init(types.EngineInitOptions{
+		Tokenizer: types.WordTokenizer{},
+		IndexerInitOptions: &types.IndexerInitOptions{
+			IndexType: types.LocationsIndex,
+		},
+	})
+	defer engine.Close()
+
+	engine.IndexDocument(1, types.DocumentIndexData{Content: "hello, world"}, false)
+	engine.IndexDocument(2, types.DocumentIndexData{Content: "world hello"}, false)
+	engine.IndexDocument(3, types.DocumentIndexData{Content: "hello_world()"}, false)
+	engine.FlushIndex()
+
+	outputs, _ := engine.Search(types.SearchRequest{Text: "Hello world!", Phrase: true})
+	utils.Expect(t, "[Hello world]", outputs.Tokens)
+	utils.Expect(t, "0", len(outputs.Docs))
+
+	outputs, _ = engine.Search(types.SearchRequest{Text: "hello world", Phrase: true, Slop: 1})
+	utils.Expect(t, "[hello world]", outputs.Tokens)
+	utils.Expect(t, "1", len(outputs.Docs))
+	utils.Expect(t, "1", outputs.Docs[0].DocId)
+
+	outputs, _ = engine.Search(types.SearchRequest{Text: "hello_world"})
+	utils.Expect(t, "1", len(outputs.Docs))
+	utils.Expect(t, "3", outputs.Docs[0].DocId)
+}
+
+func TestNotUsingSegmenter(t *testing.T) {
+	var engine Engine
+	engine.Init(types.EngineInitOptions{NotUsingSegmenter: true})
+	defer engine.Close()
+
+	engine.IndexDocument(1, types.DocumentIndexData{
+		Content: "中国人口",
+		Tokens:  []types.TokenData{{Text: "中国", Locations: []int{0}}},
+	}, true)
+	engine.FlushIndex()
+
+	outputs, _ := engine.Search(types.SearchRequest{Tokens: []string{"中国"}})
+	utils.Expect(t, "1", len(outputs.Docs))
+
+	// 不使用分词器时忽略Content
+	outputs, _ = engine.Search(types.SearchRequest{Tokens: []string{"人口"}})
+	utils.Expect(t, "0", len(outputs.Docs))
+}
+
+func TestAnalyzer(t *testing.T) {
+	traditionalToSimplified, err := types.LoadCharMappingFilter("../data/traditional_to_simplified.txt")
+	utils.Expect(t, "<nil>", err)
+
+	var engine Engine
+	engine.Init(types.EngineInitOptions{
+		Tokenizer:    types.WordTokenizer{},
+		CharFilters:  []types.CharFilter{types.FullWidthFilter{}, traditionalToSimplified},
+		TokenFilters: []types.TokenFilter{types.LowercaseFilter{}, types.PorterStemFilter{}},
+		IndexerInitOptions: &types.IndexerInitOptions{
+			IndexType: types.LocationsIndex,
+		},
+	})
+	defer engine.Close()
+
+	engine.IndexDocument(1, types.DocumentIndexData{Content: "Apple pie"}, false)
+	engine.IndexDocument(2, types.DocumentIndexData{Content: "國家 ａｐｐｌｅ"}, false)
+	engine.IndexDocument(3, types.DocumentIndexData{Content: "green apples"}, false)
+	engine.FlushIndex()
+
+	outputs, _ := engine.Search(types.SearchRequest{Text: "APPLES"})
+	utils.Expect(t, "[appl]", outputs.Tokens)
+	utils.Expect(t, "3", len(outputs.Docs))
+	for _, doc := range outputs.Docs {
+		if doc.DocId == 2 {
+			// 位置对应原文本，"國家 "占7个字节
+			utils.Expect(t, "[7]", doc.TokenSnippetLocations)
+		}
+	}
+
+	outputs, _ = engine.Search(types.SearchRequest{Text: "国家"})
+	utils.Expect(t, "1", len(outputs.Docs))
+	utils.Expect(t, "2", outputs.Docs[0].DocId)
+}
+
+func TestNFKCFilter(t *testing.T) {
+	var engine Engine
+	engine.Init(types.EngineInitOptions{
+		Tokenizer:    types.WordTokenizer{},
+		CharFilters:  []types.CharFilter{types.NFKCFilter{}},
+		TokenFilters: []types.TokenFilter{types.LowercaseFilter{}},
+		IndexerInitOptions: &types.IndexerInitOptions{
+			IndexType: types.LocationsIndex,
+		},
+	})
+	defer engine.Close()
+
+	// 连字、带圈数字和半角片假名
+	engine.IndexDocument(1, types.DocumentIndexData{Content: "a ﬁne day"}, false)
+	engine.IndexDocument(2, types.DocumentIndexData{Content: "room ⑫"}, false)
+	engine.IndexDocument(3, types.DocumentIndexData{Content: "ｶﾞｲﾄﾞ book"}, false)
+	engine.FlushIndex()
+
+	outputs, _ := engine.Search(types.SearchRequest{Text: "fine"})
+	utils.Expect(t, "1", len(outputs.Docs))
+	utils.Expect(t, "1", outputs.Docs[0].DocId)
+	utils.Expect(t, "[2]", outputs.Docs[0].TokenSnippetLocations)
+
+	outputs, _ = engine.Search(types.SearchRequest{Text: "12"})
+	utils.Expect(t, "1", len(outputs.Docs))
+	utils.Expect(t, "2", outputs.Docs[0].DocId)
+	utils.Expect(t, "[5]", outputs.Docs[0].TokenSnippetLocations)
+
+	// 搜索文本同样规范化
+	outputs, _ = engine.Search(types.SearchRequest{Text: "ガイド"})
+	utils.Expect(t, "[ガイド]", outputs.Tokens)
+	utils.Expect(t, "1", len(outputs.Docs))
+	utils.Expect(t, "3", outputs.Docs[0].DocId)
+	outputs, _ = engine.Search(types.SearchRequest{Text: "ｶﾞｲﾄﾞ"})
+	utils.Expect(t, "[ガイド]", outputs.Tokens)
+	utils.Expect(t, "1", len(outputs.Docs))
+
+	// "ｶﾞｲﾄﾞ"占15个字节，"book"的位置对应原文本
+	outputs, _ = engine.Search(types.SearchRequest{Text: "BOOK"})
+	utils.Expect(t, "1", len(outputs.Docs))
+	utils.Expect(t, "[16]", outputs.Docs[0].TokenSnippetLocations)
+}
+
+func TestSynonyms(t *testing.T) {
+	// BM25中的IDF按分片计算，用一个分片保证得分可比
+	engine, err := NewEngine(types.EngineInitOptions{
+		Tokenizer:   types.WordTokenizer{},
+		SynonymFile: "../testdata/test_synonyms.txt",
+		NumShards:   1,
+	})
+	utils.Expect(t, "<nil>", err)
+	defer engine.Close()
+
+	engine.IndexDocument(1, types.DocumentIndexData{Content: "mobile for sale"}, false)
+	engine.IndexDocument(2, types.DocumentIndexData{Content: "cellphone for sale"}, false)
+	engine.IndexDocument(3, types.DocumentIndexData{Content: "laptop for sale"}, false)
+	engine.FlushIndex()
+
+	// 同义词匹配的得分略低于原词匹配
+	outputs, _ := engine.Search(types.SearchRequest{Text: "cellphone sale"})
+	utils.Expect(t, "[cellphone mobile sale]", outputs.Tokens)
+	utils.Expect(t, "2", len(outputs.Docs))
+	utils.Expect(t, "2", outputs.Docs[0].DocId)
+	utils.Expect(t, "1", outputs.Docs[1].DocId)
+	utils.Expect(t, "true", outputs.Docs[0].Scores[0] > outputs.Docs[1].Scores[0])
+
+	query, _ := types.ParseQuery("mobile -laptop")
+	outputs, _ = engine.Search(types.SearchRequest{Query: query})
+	utils.Expect(t, "2", len(outputs.Docs))
+	utils.Expect(t, "1", outputs.Docs[0].DocId)
+
+	_, err = NewEngine(types.EngineInitOptions{
+		Tokenizer:   types.WordTokenizer{},
+		SynonymFile: "../testdata/not_exist.txt",
+	})
+	utils.Expect(t, "true", errors.Is(err, types.ErrSynonymFileNotFound))
+}
+
+func TestPinyinSearch(t *testing.T) {
+	var engine Engine
+	engine.Init(types.EngineInitOptions{
+		Tokenizer:         types.WordTokenizer{},
+		IndexTokenFilters: []types.TokenFilter{types.PinyinFilter{}},
+	})
+	defer engine.Close()
+
+	engine.IndexDocument(1, types.DocumentIndexData{Content: "北京 欢迎你"}, false)
+	engine.IndexDocument(2, types.DocumentIndexData{Content: "背景 音乐"}, false)
+	engine.IndexDocument(3, types.DocumentIndexData{Content: "南京 欢迎你"}, false)
+	engine.FlushIndex()
+
+	outputs, _ := engine.Search(types.SearchRequest{Text: "BeiJing", Pinyin: true})
+	utils.Expect(t, "[pinyin:beijing]", outputs.Tokens)
+	utils.Expect(t, "2", len(outputs.Docs))
+
+	outputs, _ = engine.Search(types.SearchRequest{Text: "nj hyn", Pinyin: true})
+	utils.Expect(t, "1", len(outputs.Docs))
+	utils.Expect(t, "3", outputs.Docs[0].DocId)
+
+	// 拼音关键词不影响原关键词的搜索
+	outputs, _ = engine.Search(types.SearchRequest{Text: "北京"})
+	utils.Expect(t, "[北京]", outputs.Tokens)
+	utils.Expect(t, "1", len(outputs.Docs))
+
+	// 整个关键词中的一部分音节也能搜到
+	engine.IndexDocument(4, types.DocumentIndexData{Content: "北京大学 iPhone手机"}, false)
+	engine.FlushIndex()
+	for _, text := range []string{"beijing", "bj", "daxue", "jingda", "bjdx", "beijingdaxue", "xue", "iphone sj"} {
+		outputs, _ = engine.Search(types.SearchRequest{Text: text, Pinyin: true})
+		found := false
+		for _, doc := range outputs.Docs {
+			found = found || doc.DocId == 4
+		}
+		utils.Expect(t, text+" true", text+" "+strconv.FormatBool(found))
+	}
+	outputs, _ = engine.Search(types.SearchRequest{Text: "bj", Pinyin: true})
+	utils.Expect(t, "3", len(outputs.Docs))
+	outputs, _ = engine.Search(types.SearchRequest{Text: "bjdxs", Pinyin: true})
+	utils.Expect(t, "0", len(outputs.Docs))
+
+	// 高亮拼音关键词对应的汉字
+	fragments, _ := engine.Highlight("北京大学 iPhone手机", []string{"pinyin:daxue"}, nil)
+	utils.Expect(t, "[北京<em>大学</em> iPhone手机]", fragments)
+}
+
+func TestSuggest(t *testing.T) {
+	var engine Engine
+	engine.Init(types.EngineInitOptions{Tokenizer: types.WordTokenizer{}})
+	defer engine.Close()
+
+	engine.IndexDocument(1, types.DocumentIndexData{Content: "search engine"}, false)
+	engine.IndexDocument(2, types.DocumentIndexData{Content: "searching the web"}, false)
+	engine.IndexDocument(3, types.DocumentIndexData{Content: "search the seashore"}, false)
+	engine.FlushIndex()
+
+	suggestions, _ := engine.Suggest("sea", 2)
+	utils.Expect(t, "[{search 2} {searching 1}]", suggestions)
+	suggestions, _ = engine.Suggest("sea", 0)
+	utils.Expect(t, "3", len(suggestions))
+
+	query, err := types.ParseQuery("sea* -web")
+	utils.Expect(t, "<nil>", err)
+	outputs, _ := engine.Search(types.SearchRequest{Query: query})
+	utils.Expect(t, "2", len(outputs.Docs))
+
+	query, _ = types.ParseQuery(`sea\*`)
+	utils.Expect(t, "{sea* 0}", query)
+}
+
+func TestFuzzySearch(t *testing.T) {
+	var engine Engine
+	engine.Init(types.EngineInitOptions{
+		NumShards:         1,
+		Tokenizer:         types.WordTokenizer{},
+		IndexTokenFilters: []types.TokenFilter{types.PinyinFilter{}},
+	})
+	defer engine.Close()
+
+	engine.IndexDocument(1, types.DocumentIndexData{Content: "iphone case"}, false)
+	engine.IndexDocument(2, types.DocumentIndexData{Content: "android phone"}, false)
+	engine.IndexDocument(3, types.DocumentIndexData{Content: "phone charger"}, false)
+	engine.IndexDocument(4, types.DocumentIndexData{Content: "北京 大学"}, false)
+	engine.FlushIndex()
+
+	outputs, _ := engine.Search(types.SearchRequest{Text: "iphnoe"})
+	utils.Expect(t, "0", len(outputs.Docs))
+
+	outputs, _ = engine.Search(types.SearchRequest{Text: "iphnoe", Fuzziness: 2})
+	utils.Expect(t, "map[iphnoe:[iphone]]", outputs.Expansions)
+	utils.Expect(t, "[iphone]", outputs.Tokens)
+	utils.Expect(t, "1", len(outputs.Docs))
+	utils.Expect(t, "1", outputs.Docs[0].DocId)
+
+	// 精确匹配的文档排在模糊匹配的前面
+	outputs, _ = engine.Search(types.SearchRequest{Text: "phone", Fuzziness: 1})
+	utils.Expect(t, "map[phone:[phone iphone]]", outputs.Expansions)
+	utils.Expect(t, "3", len(outputs.Docs))
+	utils.Expect(t, "1", outputs.Docs[2].DocId)
+
+	query, err := types.ParseQuery("phnoe~2 -androd~1")
+	utils.Expect(t, "<nil>", err)
+	outputs, _ = engine.Search(types.SearchRequest{Query: query})
+	utils.Expect(t, "1", len(outputs.Docs))
+	utils.Expect(t, "3", outputs.Docs[0].DocId)
+	utils.Expect(t, "map[androd:[android] phnoe:[phone]]", outputs.Expansions)
+
+	// 拼音输错
+	outputs, _ = engine.Search(types.SearchRequest{Text: "beijnig", Pinyin: true, Fuzziness: 2})
+	utils.Expect(t, "1", len(outputs.Docs))
+	utils.Expect(t, "4", outputs.Docs[0].DocId)
+
+	_, err = types.ParseQuery("iphone~")
+	utils.Expect(t, "查询语法错误：~后缺少数字", err)
+	query, _ = types.ParseQuery(`i\~phone`)
+	utils.Expect(t, "{i~phone 0}", query)
+}
+
+func TestPrefixSearchShards(t *testing.T) {
+	var engine Engine
+	engine.Init(types.EngineInitOptions{
+		NumShards: 4,
+		Tokenizer: types.WordTokenizer{},
+		IndexerInitOptions: &types.IndexerInitOptions{
+			IndexType: types.LocationsIndex,
+		},
+	})
+	defer engine.Close()
+
+	// 不同的文档分布在不同的分片中，各个分片的词典不同
+	contents := map[uint64]string{
+		1: "apple pie",
+		2: "red application",
+		3: "green apply now",
+		4: "big apple tree",
+		5: "the app store",
+		6: "banana",
+		7: "my apple app",
+		8: "applet",
+	}
+	for docId, content := range contents {
+		engine.IndexDocument(docId, types.DocumentIndexData{Content: content}, false)
+	}
+	engine.FlushIndex()
+
+	query, _ := types.ParseQuery("app*")
+	outputs, _ := engine.Search(types.SearchRequest{Query: query})
+	utils.Expect(t, "[app apple applet application apply]", outputs.Tokens)
+	utils.Expect(t, "7", len(outputs.Docs))
+	for _, doc := range outputs.Docs {
+		// 每个分片返回的关键词位置都和Tokens对应
+		utils.Expect(t, strconv.Itoa(len(outputs.Tokens)), len(doc.TokenLocations))
+		for i, locations := range doc.TokenLocations {
+			for _, location := range locations {
+				content := contents[doc.DocId]
+				end := location + len(outputs.Tokens[i])
+				utils.Expect(t, outputs.Tokens[i], content[location:end])
+				utils.Expect(t, "true", end == len(content) || content[end] == ' ')
+			}
+		}
+	}
+}
+
+func TestSpellingSuggestions(t *testing.T) {
+	var engine Engine
+	engine.Init(types.EngineInitOptions{
+		Tokenizer:         types.WordTokenizer{},
+		IndexTokenFilters: []types.TokenFilter{types.PinyinFilter{}},
+	})
+	defer engine.Close()
+
+	engine.IndexDocument(1, types.DocumentIndexData{Content: "iphone case"}, false)
+	engine.IndexDocument(2, types.DocumentIndexData{Content: "iphone charger"}, false)
+	engine.IndexDocument(3, types.DocumentIndexData{Content: "android phone"}, false)
+	engine.IndexDocument(4, types.DocumentIndexData{Content: "北京 大学"}, false)
+	engine.IndexDocument(5, types.DocumentIndexData{Content: "北京 天气"}, false)
+	engine.IndexDocument(6, types.DocumentIndexData{Content: "背景 图片"}, false)
+	engine.FlushIndex()
+
+	outputs, _ := engine.Search(types.SearchRequest{Text: "iphnoe case"})
+	utils.Expect(t, "0", outputs.NumDocs)
+	utils.Expect(t, "0", len(outputs.Suggestions))
+
+	outputs, _ = engine.Search(types.SearchRequest{Text: "iphnoe case", Suggest: true})
+	utils.Expect(t, "[iphone case]", outputs.Suggestions)
+
+	// 同音的"北京"优先于"背景"，"背景 大学"搜索不到文档
+	outputs, _ = engine.Search(types.SearchRequest{Text: "北经 大学", Suggest: true})
+	utils.Expect(t, "[北京大学]", outputs.Suggestions)
+
+	// 关键词都存在但没有文档同时含有它们时，尝试替换其中一个
+	outputs, _ = engine.Search(types.SearchRequest{Text: "iphone android", Suggest: true})
+	utils.Expect(t, "[phone android]", outputs.Suggestions)
+
+	outputs, _ = engine.Search(types.SearchRequest{Text: "beijnig", Pinyin: true, Suggest: true})
+	utils.Expect(t, "[beijing]", outputs.Suggestions)
+
+	// 搜索到文档时不给出建议
+	outputs, _ = engine.Search(types.SearchRequest{Text: "iphone", Suggest: true})
+	utils.Expect(t, "0", len(outputs.Suggestions))
+}
+
+func TestHighlight(t *testing.T) {
+	var engine Engine
+	engine.Init(types.EngineInitOptions{Tokenizer: types.WordTokenizer{}})
+	defer engine.Close()
+
+	content := "The quick brown fox jumps over the lazy dog. " +
+		"Nothing to see here, nothing at all. A quick <red> fox again."
+	fragments, _ := engine.Highlight(content, []string{"quick", "fox"},
+		&types.HighlightOptions{FragmentSize: 30, NumFragments: 2, EscapeHTML: true})
+	utils.Expect(t, "2", len(fragments))
+	utils.Expect(t, "The <em>quick</em> brown <em>fox</em> jumps over", fragments[0])
+	utils.Expect(t, "all. A <em>quick</em> &lt;red&gt; <em>fox</em> again.", fragments[1])
+
+	fragments, _ = engine.Highlight(content, []string{"lazy"},
+		&types.HighlightOptions{PreTag: "[", PostTag: "]", FragmentSize: 16})
+	utils.Expect(t, "[the [lazy] dog.]", fragments)
+
+	// 没有关键词时返回开头
+	fragments, _ = engine.Highlight(content, []string{"cat"}, &types.HighlightOptions{FragmentSize: 9})
+	utils.Expect(t, "[The quick]", fragments)
+
+	// 不分词时直接查找关键词，片段长度按字符计算
+	var engine1 Engine
+	engine1.Init(types.EngineInitOptions{
+		NotUsingSegmenter:       true,
+		UsePersistentStorage:    true,
+		PersistentStorageFolder: "wukong.highlight",
+		PersistentStorageShards: 2,
+	})
+	defer os.RemoveAll("wukong.highlight")
+	defer engine1.Close()
+
+	engine1.IndexDocument(1, types.DocumentIndexData{
+		Content: "今天北京的天气很好，适合出门散步",
+		Tokens:  []types.TokenData{{Text: "北京"}, {Text: "天气"}},
+	}, false)
+	engine1.FlushIndex()
+	fragments, err := engine1.HighlightDocument(1, []string{"北京", "天气"}, &types.HighlightOptions{FragmentSize: 8})
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "[天<em>北京</em>的<em>天气</em>很好]", fragments)
+	_, err = engine1.HighlightDocument(2, []string{"北京"}, nil)
+	utils.Expect(t, "true", errors.Is(err, types.ErrDocumentNotFound))
+	_, err = engine.HighlightDocument(1, []string{"北京"}, nil)
+	utils.Expect(t, "true", errors.Is(err, types.ErrPersistentStorageDisabled))
+}
+
+func TestGetDocument(t *testing.T) {
+	gob.Register(ScoringFields{})
+	var engine Engine
+	engine.Init(types.EngineInitOptions{
+		Tokenizer:               types.WordTokenizer{},
+		UsePersistentStorage:    true,
+		PersistentStorageFolder: "wukong.get_document",
+		PersistentStorageShards: 3,
+	})
+	defer os.RemoveAll("wukong.get_document")
+	defer engine.Close()
+
+	for docId := uint64(1); docId <= 5; docId++ {
+		engine.IndexDocument(docId, types.DocumentIndexData{
+			Content: fmt.Sprintf("document %d", docId),
+			Labels:  []string{"label"},
+			Fields:  ScoringFields{A: float32(docId)},
+		}, false)
+	}
+	engine.FlushIndex()
+
+	data, err := engine.GetDocument(3)
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "document 3", data.Content)
+	utils.Expect(t, "[label]", data.Labels)
+	utils.Expect(t, "{3 0 0}", data.Fields)
+
+	_, err = engine.GetDocument(6)
+	utils.Expect(t, "true", errors.Is(err, types.ErrDocumentNotFound))
+
+	engine.RemoveDocument(3, true)
+	engine.FlushIndex()
+	_, err = engine.GetDocument(3)
+	utils.Expect(t, "true", errors.Is(err, types.ErrDocumentNotFound))
+
+	outputs, err := engine.Search(types.SearchRequest{Text: "document", LoadDocuments: true})
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "4", len(outputs.Docs))
+	for _, doc := range outputs.Docs {
+		utils.Expect(t, fmt.Sprintf("document %d", doc.DocId), doc.Document.Content)
+	}
+	outputs, _ = engine.Search(types.SearchRequest{Text: "document"})
+	utils.Expect(t, "<nil>", outputs.Docs[0].Document)
+
+	var engine1 Engine
+	engine1.Init(types.EngineInitOptions{Tokenizer: types.WordTokenizer{}})
+	defer engine1.Close()
+	_, err = engine1.GetDocument(1)
+	utils.Expect(t, "true", errors.Is(err, types.ErrPersistentStorageDisabled))
+	_, err = engine1.Search(types.SearchRequest{Text: "document", LoadDocuments: true})
+	utils.Expect(t, "true", errors.Is(err, types.ErrPersistentStorageDisabled))
+}
+
+func TestUpdateFields(t *testing.T) {
+	gob.Register(ScoringFields{})
+	options := types.EngineInitOptions{
+		Tokenizer: types.WordTokenizer{},
+		DefaultRankOptions: &types.RankOptions{
+			ScoringCriteria: TestScoringCriteria{},
+		},
+		UsePersistentStorage:    true,
+		PersistentStorageFolder: "wukong.update_fields",
+		PersistentStorageShards: 2,
+	}
+	defer os.RemoveAll("wukong.update_fields")
+
+	var engine Engine
+	engine.Init(options)
+	for docId := uint64(1); docId <= 3; docId++ {
+		engine.IndexDocument(docId, types.DocumentIndexData{
+			Content: fmt.Sprintf("product %d", docId),
+			Fields:  ScoringFields{B: float32(docId), C: 1},
+		}, false)
+	}
+	engine.FlushIndex()
+
+	outputs, _ := engine.Search(types.SearchRequest{Text: "product"})
+	utils.Expect(t, "3", outputs.Docs[0].DocId)
+
+	utils.Expect(t, "<nil>", engine.UpdateFields(1, ScoringFields{B: 10, C: 1}))
+	outputs, _ = engine.Search(types.SearchRequest{Text: "product"})
+	utils.Expect(t, "1", outputs.Docs[0].DocId)
+	utils.Expect(t, "[10]", outputs.Docs[0].Scores)
+
+	err := engine.UpdateFields(4, ScoringFields{})
+	utils.Expect(t, "true", errors.Is(err, types.ErrDocumentNotFound))
+
+	// 持久存储中只有评分字段被更新
+	engine.FlushIndex()
+	data, _ := engine.GetDocument(1)
+	utils.Expect(t, "product 1", data.Content)
+	utils.Expect(t, "{0 10 1}", data.Fields)
+	engine.Close()
+
+	var engine1 Engine
+	engine1.Init(options)
+	defer engine1.Close()
+	engine1.FlushIndex()
+	outputs, _ = engine1.Search(types.SearchRequest{Text: "product"})
+	utils.Expect(t, "3", len(outputs.Docs))
+	utils.Expect(t, "1", outputs.Docs[0].DocId)
+}
+
+func TestIndexDocuments(t *testing.T) {
+	var engine Engine
+	engine.Init(types.EngineInitOptions{
+		Tokenizer:               types.WordTokenizer{},
+		NumShards:               2,
+		UsePersistentStorage:    true,
+		PersistentStorageFolder: "wukong.index_documents",
+		PersistentStorageShards: 3,
+	})
+	defer os.RemoveAll("wukong.index_documents")
+	defer engine.Close()
+
+	// 并发写入的文档不刷新，不影响批次的完成
+	engine.IndexDocument(1000, types.DocumentIndexData{Content: "other"}, false)
+
+	var items []types.IndexItem
+	for docId := uint64(1); docId <= 300; docId++ {
+		items = append(items, types.IndexItem{
+			DocId: docId,
+			Data:  types.DocumentIndexData{Content: fmt.Sprintf("batch %d", docId)},
+		})
+	}
+	handle, err := engine.IndexDocuments(items)
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "<nil>", handle.Wait())
+
+	// 不需要FlushIndex
+	outputs, _ := engine.Search(types.SearchRequest{Text: "batch", CountDocsOnly: true})
+	utils.Expect(t, "300", outputs.NumDocs)
+	outputs, _ = engine.Search(types.SearchRequest{Text: "batch 123"})
+	utils.Expect(t, "1", len(outputs.Docs))
+	utils.Expect(t, "123", outputs.Docs[0].DocId)
+	data, err := engine.GetDocument(200)
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "batch 200", data.Content)
+
+	handle, err = engine.IndexDocuments(nil)
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "<nil>", handle.Wait())
+
+	_, err = engine.IndexDocuments([]types.IndexItem{{DocId: 0}})
+	utils.Expect(t, "true", errors.Is(err, types.ErrInvalidDocId))
+}
+
+func TestWriteAheadLog(t *testing.T) {
+	gob.Register(ScoringFields{})
+	options := types.EngineInitOptions{
+		Tokenizer:               types.WordTokenizer{},
+		UsePersistentStorage:    true,
+		PersistentStorageFolder: "wukong.wal",
+		PersistentStorageShards: 3,
+		UseWAL:                  true,
+	}
+	defer os.RemoveAll("wukong.wal")
+	walPath := "wukong.wal/" + walFileName
+
+	var engine Engine
+	engine.Init(options)
+	for docId := uint64(1); docId <= 3; docId++ {
+		engine.IndexDocument(docId, types.DocumentIndexData{
+			Content: fmt.Sprintf("document %d", docId),
+			Fields:  ScoringFields{A: float32(docId)},
+		}, false)
+	}
+	info, _ := os.Stat(walPath)
+	utils.Expect(t, "true", info.Size() > 0)
+
+	// 持久存储追上日志后清空日志
+	engine.FlushIndex()
+	info, _ = os.Stat(walPath)
+	utils.Expect(t, "0", info.Size())
+	engine.Close()
+
+	// 模拟崩溃：日志中有尚未写入持久存储的操作，最后一条记录只写了一半
+	wal, records, err := openWriteAheadLog(walPath, false)
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "0", len(records))
+	encode := func(docId uint64, data types.DocumentIndexData) encodedDocument {
+		value, _ := engine.encodeDocument(&data)
+		return encodedDocument{DocId: docId, Value: value}
+	}
+	wal.append(walIndexDocuments, []encodedDocument{
+		encode(4, types.DocumentIndexData{Content: "document 4"}),
+		encode(5, types.DocumentIndexData{Content: "document 5"})})
+	wal.append(walRemoveDocument, []encodedDocument{{DocId: 1}})
+	wal.append(walRemoveDocument, []encodedDocument{{DocId: 5}})
+	wal.append(walUpdateFields, []encodedDocument{
+		encode(2, types.DocumentIndexData{Fields: ScoringFields{A: 20}})})
+	wal.append(walIndexDocuments, []encodedDocument{
+		encode(6, types.DocumentIndexData{Content: "document 6"})})
+	size := wal.size
+	wal.close()
+	os.Truncate(walPath, size-3)
+
+	var engine1 Engine
+	engine1.Init(options)
+	info, _ = os.Stat(walPath)
+	utils.Expect(t, "0", info.Size())
+	engine1.FlushIndex()
+
+	outputs, _ := engine1.Search(types.SearchRequest{Text: "document"})
+	var docIds []uint64
+	for _, doc := range outputs.Docs {
+		docIds = append(docIds, doc.DocId)
+	}
+	sort.Slice(docIds, func(i, j int) bool { return docIds[i] < docIds[j] })
+	utils.Expect(t, "[2 3 4]", docIds)
+	data, _ := engine1.GetDocument(2)
+	utils.Expect(t, "document 2", data.Content)
+	utils.Expect(t, "{20 0 0}", data.Fields)
+
+	// 恢复之后继续写入
+	engine1.RemoveDocument(3, false)
+	engine1.Close()
+	var engine2 Engine
+	engine2.Init(options)
+	defer engine2.Close()
+	engine2.FlushIndex()
+	_, err = engine2.GetDocument(3)
+	utils.Expect(t, "true", errors.Is(err, types.ErrDocumentNotFound))
+	outputs, _ = engine2.Search(types.SearchRequest{Text: "document", CountDocsOnly: true})
+	utils.Expect(t, "2", outputs.NumDocs)
+}
+
+func TestWriteAheadLogCheckpoint(t *testing.T) {
+	options := types.EngineInitOptions{
+		Tokenizer:               types.WordTokenizer{},
+		UsePersistentStorage:    true,
+		PersistentStorageFolder: "wukong.wal_checkpoint",
+		PersistentStorageShards: 2,
+		UseWAL:                  true,
+		WALCheckpointSize:       2000,
+	}
+	defer os.RemoveAll("wukong.wal_checkpoint")
+	walPath := "wukong.wal_checkpoint/" + walFileName
+
+	// 日志超过WALCheckpointSize时等持久存储追上后清空，不需要调用FlushIndex
+	engine, err := NewEngine(options)
+	utils.Expect(t, "<nil>", err)
+	for docId := uint64(1); docId <= 100; docId++ {
+		engine.IndexDocument(docId, types.DocumentIndexData{Content: fmt.Sprintf("document %d", docId)}, false)
+		info, _ := os.Stat(walPath)
+		utils.Expect(t, "true", info.Size() < options.WALCheckpointSize)
+	}
+	utils.Expect(t, "<nil>", engine.Close())
+
+	// 重放失败时Init返回错误，并且保留日志
+	wal, _, err := openWriteAheadLog(walPath, false)
+	utils.Expect(t, "<nil>", err)
+	wal.append(walUpdateFields, []encodedDocument{{DocId: 1, Value: []byte("bad")}})
+	size := wal.size
+	wal.close()
+
+	_, err = NewEngine(options)
+	utils.Expect(t, "true", errors.Is(err, types.ErrDocumentCodec))
+	info, _ := os.Stat(walPath)
+	utils.Expect(t, strconv.FormatInt(size, 10), info.Size())
+}
+
+// 写入总是失败的持久存储
+type failingStorage struct {
+	storage.Storage
+}
+
+func (failingStorage) Set(k, v []byte) error {
+	return errors.New("磁盘已满")
+}
+
+func TestStorageWriteErrors(t *testing.T) {
+	gob.Register(ScoringFields{})
+	options := types.EngineInitOptions{
+		Tokenizer:               types.WordTokenizer{},
+		UsePersistentStorage:    true,
+		PersistentStorageFolder: "wukong.storage_errors",
+		PersistentStorageShards: 2,
+		UseWAL:                  true,
+	}
+	defer os.RemoveAll("wukong.storage_errors")
+	walPath := "wukong.storage_errors/" + walFileName
+
+	engine, err := NewEngine(options)
+	utils.Expect(t, "<nil>", err)
+	dbs := engine.dbs
+	engine.dbs = []storage.Storage{failingStorage{dbs[0]}, failingStorage{dbs[1]}}
+
+	engine.IndexDocument(1, types.DocumentIndexData{Content: "document 1", Fields: ScoringFields{A: 1}}, false)
+	engine.FlushIndex()
+	utils.Expect(t, "1", engine.NumStorageErrors())
+	_, err = engine.GetDocument(1)
+	utils.Expect(t, "true", errors.Is(err, types.ErrDocumentNotFound))
+
+	// 批量索引的写入错误由BatchHandle.Wait返回
+	handle, err := engine.IndexDocuments([]types.IndexItem{
+		{DocId: 2, Data: types.DocumentIndexData{Content: "document 2"}}})
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "true", errors.Is(handle.Wait(), types.ErrStorageWrite))
+	utils.Expect(t, "2", engine.NumStorageErrors())
+
+	// 存储中没有文档1，无法更新评分字段
+	utils.Expect(t, "<nil>", engine.UpdateFields(1, ScoringFields{A: 10}))
+	engine.FlushIndex()
+	utils.Expect(t, "3", engine.NumStorageErrors())
+
+	// 写入失败后不清空日志，重启时重放日志补上失败的写入
+	info, _ := os.Stat(walPath)
+	utils.Expect(t, "true", info.Size() > 0)
+	engine.dbs = dbs
+	utils.Expect(t, "<nil>", engine.Close())
+
+	engine, err = NewEngine(options)
+	utils.Expect(t, "<nil>", err)
+	defer engine.Close()
+	engine.FlushIndex()
+	data, err := engine.GetDocument(1)
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "{10 0 0}", data.Fields)
+	_, err = engine.GetDocument(2)
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "0", engine.NumStorageErrors())
+}
+
+func TestSnapshot(t *testing.T) {
+	gob.Register(ScoringFields{})
+	options := types.EngineInitOptions{
+		Tokenizer: types.WordTokenizer{},
+		NumShards: 2,
+		DefaultRankOptions: &types.RankOptions{
+			ScoringCriteria: TestScoringCriteria{},
+		},
+		IndexerInitOptions: &types.IndexerInitOptions{
+			IndexType: types.LocationsIndex,
+		},
+	}
+	var engine Engine
+	engine.Init(options)
+	defer engine.Close()
+	for docId := uint64(1); docId <= 20; docId++ {
+		engine.IndexDocument(docId, types.DocumentIndexData{
+			Content:    fmt.Sprintf("product number %d", docId),
+			Fields:     ScoringFields{A: 1, B: float32(docId), C: 1},
+			Attributes: map[string]interface{}{"price": int(docId) * 10},
+		}, false)
+	}
+	engine.FlushIndex()
+	engine.RemoveDocument(20, false)
+	var buffer bytes.Buffer
+	utils.Expect(t, "<nil>", engine.Snapshot(&buffer))
+
+	var engine1 Engine
+	engine1.Init(options)
+	defer engine1.Close()
+	utils.Expect(t, "<nil>", engine1.Restore(bytes.NewReader(buffer.Bytes())))
+	// 计数器和分片一起恢复
+	utils.Expect(t, "20", engine1.NumDocumentsIndexed())
+	utils.Expect(t, "2", engine1.NumDocumentsRemoved())
+	utils.Expect(t, strconv.FormatUint(engine.NumTokenIndexAdded(), 10), engine1.NumTokenIndexAdded())
+	request := types.SearchRequest{
+		Text:    "product number",
+		Filters: []types.AttributeFilter{{Name: "price", Max: 150}},
+	}
+	outputs, _ := engine.Search(request)
+	outputs1, _ := engine1.Search(request)
+	utils.Expect(t, "15", len(outputs1.Docs))
+	utils.Expect(t, fmt.Sprint(outputs.Docs), fmt.Sprint(outputs1.Docs))
+
+	// 载入快照之后仍然可以修改索引
+	engine1.IndexDocument(21, types.DocumentIndexData{Content: "product number 21"}, true)
+	engine1.FlushIndex()
+	outputs1, _ = engine1.Search(types.SearchRequest{Text: "product", CountDocsOnly: true})
+	utils.Expect(t, "20", outputs1.NumDocs)
+	utils.Expect(t, "21", engine1.NumDocumentsIndexed())
+
+	var engine2 Engine
+	options.NumShards = 3
+	engine2.Init(options)
+	defer engine2.Close()
+	err := engine2.Restore(bytes.NewReader(buffer.Bytes()))
+	utils.Expect(t, "true", errors.Is(err, types.ErrInvalidSnapshot))
+	err = engine2.Restore(bytes.NewReader([]byte("wukong")))
+	utils.Expect(t, "true", errors.Is(err, types.ErrInvalidSnapshot))
+}
+
+func TestRestoreConcurrently(t *testing.T) {
+	options := types.EngineInitOptions{
+		Tokenizer: types.WordTokenizer{},
+		NumShards: 2,
+		IndexerInitOptions: &types.IndexerInitOptions{
+			IndexType: types.LocationsIndex,
+		},
+	}
+	var engine Engine
+	engine.Init(options)
+	defer engine.Close()
+	for docId := uint64(1); docId <= 10; docId++ {
+		engine.IndexDocument(docId, types.DocumentIndexData{Content: "restored document"}, false)
+	}
+	var buffer bytes.Buffer
+	utils.Expect(t, "<nil>", engine.Snapshot(&buffer))
+
+	var engine1 Engine
+	engine1.Init(options)
+	defer engine1.Close()
+	done := make(chan bool)
+	go func() {
+		for docId := uint64(100); docId < 200; docId++ {
+			engine1.IndexDocument(docId, types.DocumentIndexData{Content: "concurrent document"}, false)
+			engine1.Search(types.SearchRequest{Text: "document"})
+			engine1.Suggest("doc", 1)
+		}
+		done <- true
+	}()
+	for i := 0; i < 5; i++ {
+		utils.Expect(t, "<nil>", engine1.Restore(bytes.NewReader(buffer.Bytes())))
+	}
+	<-done
+
+	// 恢复期间发出的请求全部完成，计数器仍然一致
+	utils.Expect(t, "<nil>", engine1.FlushIndex())
+	outputs, _ := engine1.Search(types.SearchRequest{Text: "restored", CountDocsOnly: true})
+	utils.Expect(t, "10", outputs.NumDocs)
+}
+
+// 统计分词次数的分词器
+type countingTokenizer struct {
+	types.WordTokenizer
+	count *uint64
+}
+
+func (tokenizer countingTokenizer) Tokenize(text string) []types.Token {
+	atomic.AddUint64(tokenizer.count, 1)
+	return tokenizer.WordTokenizer.Tokenize(text)
+}
+
+func TestSnapshotFile(t *testing.T) {
+	gob.Register(ScoringFields{})
+	options := types.EngineInitOptions{
+		Tokenizer:               types.WordTokenizer{},
+		UsePersistentStorage:    true,
+		PersistentStorageFolder: "wukong.snapshot",
+		PersistentStorageShards: 2,
+		SnapshotFile:            "wukong.snapshot/index.snapshot",
+	}
+	defer os.RemoveAll("wukong.snapshot")
+
+	var engine Engine
+	engine.Init(options)
+	for docId := uint64(1); docId <= 5; docId++ {
+		engine.IndexDocument(docId, types.DocumentIndexData{
+			Content: fmt.Sprintf("document %d", docId),
+		}, false)
+	}
+	utils.Expect(t, "<nil>", engine.Close())
+	_, err := os.Stat(options.SnapshotFile)
+	utils.Expect(t, "<nil>", err)
+
+	// 直接载入快照，不再从持久存储重建索引
+	var engine1 Engine
+	var numTokenized uint64
+	options.Tokenizer = countingTokenizer{count: &numTokenized}
+	engine1.Init(options)
+	utils.Expect(t, "0", atomic.LoadUint64(&numTokenized))
+	utils.Expect(t, "5", engine1.NumDocumentsIndexed())
+	utils.Expect(t, "<nil>", engine1.FlushIndex())
+	_, err = os.Stat(options.SnapshotFile)
+	utils.Expect(t, "true", errors.Is(err, os.ErrNotExist))
+	outputs, _ := engine1.Search(types.SearchRequest{Text: "document", CountDocsOnly: true})
+	utils.Expect(t, "5", outputs.NumDocs)
+	data, _ := engine1.GetDocument(3)
+	utils.Expect(t, "document 3", data.Content)
+	engine1.RemoveDocument(3, true)
+	engine1.Close()
+
+	// 损坏的快照被忽略，从持久存储恢复
+	os.WriteFile(options.SnapshotFile, []byte("broken"), 0600)
+	var engine2 Engine
+	engine2.Init(options)
+	defer engine2.Close()
+	engine2.FlushIndex()
+	utils.Expect(t, "4", engine2.numIndexingRequests)
+	outputs, _ = engine2.Search(types.SearchRequest{Text: "document", CountDocsOnly: true})
+	utils.Expect(t, "4", outputs.NumDocs)
+}
+
+type BinaryScoringFields struct {
+	A float32
+}
+
+func (fields BinaryScoringFields) MarshalBinary() ([]byte, error) {
+	return []byte(fmt.Sprint(fields.A)), nil
+}
+
+func (fields *BinaryScoringFields) UnmarshalBinary(data []byte) error {
+	_, err := fmt.Sscan(string(data), &fields.A)
+	return err
+}
+
+type UnregisteredScoringFields struct {
+	A float32
+}
+
+func TestDocumentCodec(t *testing.T) {
+	gob.Register(ScoringFields{})
+	defer os.RemoveAll("wukong.codec")
+	codecs := []struct {
+		codec  types.Codec
+		fields interface{}
+	}{
+		{types.GobCodec{}, ScoringFields{A: 1.5}},
+		{types.JSONCodec{NewFields: func() interface{} { return &ScoringFields{} }}, ScoringFields{A: 1.5}},
+		{types.BinaryCodec{NewFields: func() interface{} { return &BinaryScoringFields{} }}, BinaryScoringFields{A: 1.5}},
+	}
+	for i, c := range codecs {
+		options := types.EngineInitOptions{
+			Tokenizer:               types.WordTokenizer{},
+			UsePersistentStorage:    true,
+			PersistentStorageFolder: "wukong.codec",
+			PersistentStorageShards: 2,
+			Codec:                   c.codec,
+		}
+		var engine Engine
+		engine.Init(options)
+		docId := uint64(i + 1)
+		err := engine.IndexDocument(docId, types.DocumentIndexData{
+			Content:    fmt.Sprintf("codec %d", c.codec.ID()),
+			Labels:     []string{"label"},
+			Fields:     c.fields,
+			Attributes: map[string]interface{}{"price": 10, "rating": 4.5},
+		}, false)
+		utils.Expect(t, "<nil>", err)
+		engine.FlushIndex()
+
+		data, err := engine.GetDocument(docId)
+		utils.Expect(t, "<nil>", err)
+		utils.Expect(t, fmt.Sprintf("codec %d", c.codec.ID()), data.Content)
+		utils.Expect(t, "[label]", data.Labels)
+		utils.Expect(t, fmt.Sprint(c.fields), fmt.Sprint(data.Fields))
+		utils.Expect(t, "map[price:10 rating:4.5]", data.Attributes)
+		engine.Close()
+	}
+
+	// 用不同的编码方式写入的文档都可以读出，没有格式头的旧数据按gob解码
+	var engine Engine
+	engine.Init(types.EngineInitOptions{
+		Tokenizer:               types.WordTokenizer{},
+		UsePersistentStorage:    true,
+		PersistentStorageFolder: "wukong.codec",
+		PersistentStorageShards: 2,
+		Codec:                   codecs[2].codec,
+	})
+	legacy, _ := types.GobCodec{}.Encode(&types.DocumentIndexData{Content: "codec legacy"})
+	engine.dbs[engine.storageShard(4)].Set(storageKey(4), legacy)
+	engine.dbs[engine.storageShard(5)].Set(storageKey(5), []byte{documentFormatMarker, documentFormatVersion, 200})
+	engine.FlushIndex()
+	outputs, _ := engine.Search(types.SearchRequest{
+		Text:    "codec",
+		Filters: []types.AttributeFilter{{Name: "price", Min: 10}},
+	})
+	utils.Expect(t, "3", len(outputs.Docs))
+	data, err := engine.GetDocument(4)
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "codec legacy", data.Content)
+	_, err = engine.GetDocument(5)
+	utils.Expect(t, "true", errors.Is(err, types.ErrDocumentCodec))
+	utils.Expect(t, "1", engine.NumDecodeErrors())
+
+	// 无法编码的文档返回错误，不会被索引
+	err = engine.IndexDocument(6, types.DocumentIndexData{
+		Content: "codec unregistered", Fields: UnregisteredScoringFields{}}, false)
+	utils.Expect(t, "true", errors.Is(err, types.ErrDocumentCodec))
+	_, err = engine.IndexDocuments([]types.IndexItem{
+		{DocId: 7, Data: types.DocumentIndexData{Content: "codec batch"}},
+		{DocId: 8, Data: types.DocumentIndexData{Fields: UnregisteredScoringFields{}}}})
+	utils.Expect(t, "true", errors.Is(err, types.ErrDocumentCodec))
+	err = engine.UpdateFields(1, UnregisteredScoringFields{})
+	utils.Expect(t, "true", errors.Is(err, types.ErrDocumentCodec))
+	utils.Expect(t, "3", engine.NumEncodeErrors())
+	engine.FlushIndex()
+	outputs, _ = engine.Search(types.SearchRequest{Text: "codec", CountDocsOnly: true})
+	utils.Expect(t, "3", outputs.NumDocs)
+	engine.Close()
+
+	// 启动时无法解码的文档被跳过并计数
+	var engine1 Engine
+	engine1.Init(types.EngineInitOptions{
+		Tokenizer:               types.WordTokenizer{},
+		UsePersistentStorage:    true,
+		PersistentStorageFolder: "wukong.codec",
+		PersistentStorageShards: 2,
+		Codec:                   codecs[2].codec,
+	})
+	defer engine1.Close()
+	engine1.FlushIndex()
+	utils.Expect(t, "1", engine1.NumDecodeErrors())
+	outputs, _ = engine1.Search(types.SearchRequest{Text: "codec", CountDocsOnly: true})
+	utils.Expect(t, "4", outputs.NumDocs)
+}
+
+func TestStorageAdmin(t *testing.T) {
+	options := types.EngineInitOptions{
+		Tokenizer:               types.WordTokenizer{},
+		UsePersistentStorage:    true,
+		PersistentStorageFolder: "wukong.storage_admin",
+		PersistentStorageShards: 2,
+	}
+	defer os.RemoveAll("wukong.storage_admin")
+
+	// 目录不存在时返回错误，不会新建数据库
+	_, err := StorageStats(options)
+	utils.Expect(t, "true", errors.Is(err, os.ErrNotExist))
+
+	var engine Engine
+	engine.Init(options)
+	// 随机内容不能被压缩，删除文档后才能看出压缩的效果
+	for docId := uint64(1); docId <= 100; docId++ {
+		content := "storage"
+		for i := 0; i < 100; i++ {
+			content += fmt.Sprintf(" %x", rand.Uint64())
+		}
+		engine.IndexDocument(docId, types.DocumentIndexData{Content: content}, false)
+	}
+	engine.FlushIndex()
+	// kv会回收文件末尾的空间，因此删除先写入的文档
+	for docId := uint64(1); docId <= 90; docId++ {
+		engine.RemoveDocument(docId, false)
+	}
+	engine.dbs[engine.storageShard(200)].Set(storageKey(200), []byte{documentFormatMarker, documentFormatVersion, 200})
+	engine.FlushIndex()
+	engine.Close()
+
+	stats, err := StorageStats(options)
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "2", len(stats))
+	numDocuments := 0
+	var sizeBefore int64
+	for shard, s := range stats {
+		utils.Expect(t, strconv.Itoa(shard), s.Shard)
+		utils.Expect(t, storagePath("wukong.storage_admin", shard), s.Path)
+		utils.Expect(t, "[]", s.InvalidDocIds)
+		numDocuments += s.NumDocuments
+		sizeBefore += s.Size
+	}
+	utils.Expect(t, "11", numDocuments)
+
+	stats, err = CheckStorage(options)
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "[200]", stats[engine.storageShard(200)].InvalidDocIds)
+	utils.Expect(t, "[]", stats[1-engine.storageShard(200)].InvalidDocIds)
+
+	stats, err = CompactStorage(options)
+	utils.Expect(t, "<nil>", err)
+	numDocuments = 0
+	var sizeAfter int64
+	for _, s := range stats {
+		numDocuments += s.NumDocuments
+		sizeAfter += s.Size
+	}
+	utils.Expect(t, "11", numDocuments)
+	utils.Expect(t, "true", sizeAfter < sizeBefore)
+
+	// 压缩后引擎可以正常载入
+	var engine1 Engine
+	engine1.Init(options)
+	defer engine1.Close()
+	engine1.FlushIndex()
+	outputs, _ := engine1.Search(types.SearchRequest{Text: "storage", CountDocsOnly: true})
+	utils.Expect(t, "10", outputs.NumDocs)
+}
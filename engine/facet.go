@@ -0,0 +1,49 @@
+package engine
+
+import (
+	"sort"
+
+	"github.com/huichen/wukong/types"
+)
+
+// 将一个分片的分面统计结果累加到counts
+func mergeFacetCounts(counts map[string]map[string]int, shardCounts map[string]map[string]int) {
+	for name, labels := range shardCounts {
+		if counts[name] == nil {
+			counts[name] = make(map[string]int)
+		}
+		for label, count := range labels {
+			counts[name][label] += count
+		}
+	}
+}
+
+// 将分面统计结果按文档数从大到小排序（文档数相同时按标签排序），并按TopN截断
+func sortFacetCounts(counts map[string]map[string]int, facets []types.FacetRequest) map[string][]types.FacetCount {
+	output := make(map[string][]types.FacetCount)
+	for _, facet := range facets {
+		name := facet.GetName()
+		facetCounts := []types.FacetCount{}
+		if len(facet.Labels) > 0 {
+			// 保证没有分片返回时也输出全部指定的标签
+			for _, label := range facet.Labels {
+				facetCounts = append(facetCounts, types.FacetCount{Label: label, Count: counts[name][label]})
+			}
+		} else {
+			for label, count := range counts[name] {
+				facetCounts = append(facetCounts, types.FacetCount{Label: label, Count: count})
+			}
+		}
+		sort.Slice(facetCounts, func(i, j int) bool {
+			if facetCounts[i].Count != facetCounts[j].Count {
+				return facetCounts[i].Count > facetCounts[j].Count
+			}
+			return facetCounts[i].Label < facetCounts[j].Label
+		})
+		if facet.TopN > 0 && len(facetCounts) > facet.TopN {
+			facetCounts = facetCounts[:facet.TopN]
+		}
+		output[name] = facetCounts
+	}
+	return output
+}
@@ -0,0 +1,275 @@
+package engine
+
+import (
+	"html"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/huichen/wukong/types"
+)
+
+const (
+	defaultHighlightPreTag       = "<em>"
+	defaultHighlightPostTag      = "</em>"
+	defaultHighlightFragmentSize = 100
+)
+
+// 关键词在文本中出现的一处，start和end为字符（而非字节）位置
+type highlightSpan struct {
+	start, end int
+	token      string
+}
+
+// 在content中高亮关键词，返回关键词最密集的几个片段，最好的在前
+//
+// tokens一般为SearchResponse.Tokens。content用引擎的分词器和EngineInitOptions.IndexTokenFilters
+// 重新分词，因此关键词的位置和索引时完全一致，拼音关键词会高亮对应的汉字；没有分词器时
+// 直接在content中查找关键词。片段的边界总是在字符之间，不会切断关键词。options为nil时
+// 使用默认选项。content中没有关键词时返回开头的一个片段。
+//
+// 片段以关键词为中心，两端不切断英文单词，因此可能比FragmentSize略短。
+func (engine *Engine) Highlight(content string, tokens []string, options *types.HighlightOptions) (
+	[]string, error) {
+	if err := engine.enter(); err != nil {
+		return nil, err
+	}
+	defer engine.requests.Done()
+	return engine.highlight(content, tokens, options), nil
+}
+
+// 同Highlight，从持久存储中读出文档的Content进行高亮
+// 需要打开EngineInitOptions.UsePersistentStorage，文档不存在时返回types.ErrDocumentNotFound
+func (engine *Engine) HighlightDocument(docId uint64, tokens []string, options *types.HighlightOptions) (
+	[]string, error) {
+	if err := engine.enter(); err != nil {
+		return nil, err
+	}
+	defer engine.requests.Done()
+
+	data, err := engine.getStoredDocument(docId)
+	if err != nil {
+		return nil, err
+	}
+	return engine.highlight(data.Content, tokens, options), nil
+}
+
+func (engine *Engine) highlight(content string, tokens []string, options *types.HighlightOptions) []string {
+	if content == "" {
+		return nil
+	}
+	var opts types.HighlightOptions
+	if options != nil {
+		opts = *options
+	}
+	if opts.PreTag == "" && opts.PostTag == "" {
+		opts.PreTag, opts.PostTag = defaultHighlightPreTag, defaultHighlightPostTag
+	}
+	if opts.FragmentSize <= 0 {
+		opts.FragmentSize = defaultHighlightFragmentSize
+	}
+	if opts.NumFragments <= 0 {
+		opts.NumFragments = 1
+	}
+
+	// offsets[i]为第i个字符的字节位置
+	offsets := make([]int, 0, len(content)+1)
+	for i := range content {
+		offsets = append(offsets, i)
+	}
+	offsets = append(offsets, len(content))
+	numRunes := len(offsets) - 1
+
+	spans := engine.highlightSpans(content, tokens, offsets)
+	if len(spans) == 0 {
+		end := opts.FragmentSize
+		if end > numRunes {
+			end = numRunes
+		}
+		return []string{renderFragment(content, offsets, 0, end, nil, &opts)}
+	}
+
+	var fragments []string
+	used := make([]bool, len(spans))
+	for len(fragments) < opts.NumFragments {
+		first, last, found := bestHighlightWindow(spans, used, opts.FragmentSize)
+		if !found {
+			break
+		}
+		for i := first; i <= last; i++ {
+			used[i] = true
+		}
+
+		// 片段以选中的关键词为中心，不超出文本
+		start := spans[first].start - (opts.FragmentSize-(spans[last].end-spans[first].start))/2
+		if start < 0 {
+			start = 0
+		}
+		end := start + opts.FragmentSize
+		if end > numRunes {
+			end = numRunes
+			start = end - opts.FragmentSize
+			if start < 0 {
+				start = 0
+			}
+		}
+		if start > spans[first].start {
+			start = spans[first].start
+		}
+		if end < spans[last].end {
+			end = spans[last].end
+		}
+
+		start, end = trimFragment(content, offsets, start, end, spans[first].start, spans[last].end)
+
+		// 不切断片段边界上的关键词
+		var inside []highlightSpan
+		for _, span := range spans {
+			if span.end <= start || span.start >= end {
+				continue
+			}
+			if span.start < start {
+				start = span.start
+			}
+			if span.end > end {
+				end = span.end
+			}
+			inside = append(inside, span)
+		}
+		fragments = append(fragments, renderFragment(content, offsets, start, end, inside, &opts))
+	}
+	return fragments
+}
+
+// 找出content中全部关键词的位置，按位置排序并合并重叠的部分
+func (engine *Engine) highlightSpans(content string, tokens []string, offsets []int) []highlightSpan {
+	wanted := make(map[string]bool)
+	for _, token := range tokens {
+		if token != "" {
+			wanted[token] = true
+		}
+	}
+	toRune := func(byteOffset int) int {
+		return sort.SearchInts(offsets, byteOffset)
+	}
+
+	var spans []highlightSpan
+	if engine.tokenizer != nil {
+		for _, token := range engine.filterIndexTokens(engine.tokenizer.Tokenize(content)) {
+			if wanted[token.Text] {
+				spans = append(spans, highlightSpan{toRune(token.Start), toRune(token.End), token.Text})
+			}
+		}
+	} else {
+		for token := range wanted {
+			for from := 0; from < len(content); {
+				index := strings.Index(content[from:], token)
+				if index < 0 {
+					break
+				}
+				start := from + index
+				spans = append(spans, highlightSpan{toRune(start), toRune(start + len(token)), token})
+				from = start + len(token)
+			}
+		}
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+
+	sort.Slice(spans, func(i, j int) bool {
+		if spans[i].start != spans[j].start {
+			return spans[i].start < spans[j].start
+		}
+		return spans[i].end > spans[j].end
+	})
+	merged := spans[:1]
+	for _, span := range spans[1:] {
+		last := &merged[len(merged)-1]
+		if span.start < last.end {
+			if span.end > last.end {
+				last.end = span.end
+			}
+			continue
+		}
+		merged = append(merged, span)
+	}
+	return merged
+}
+
+// 在没有用过的关键词中找出长度size以内包含不同关键词最多的一段，相同时包含关键词次数多的优先，
+// 再相同时靠前的优先。返回这一段第一个和最后一个关键词的下标
+func bestHighlightWindow(spans []highlightSpan, used []bool, size int) (first, last int, found bool) {
+	bestDistinct, bestHits := 0, 0
+	for i := range spans {
+		if used[i] {
+			continue
+		}
+		distinct := make(map[string]bool)
+		j := i
+		for j < len(spans) && !used[j] && (j == i || spans[j].end-spans[i].start <= size) {
+			distinct[spans[j].token] = true
+			j++
+		}
+		hits := j - i
+		if len(distinct) > bestDistinct || (len(distinct) == bestDistinct && hits > bestHits) {
+			first, last, found = i, j-1, true
+			bestDistinct, bestHits = len(distinct), hits
+		}
+	}
+	return
+}
+
+// 收缩片段[start, end)使它不切断英文单词，并去掉两端的空白，但保留[keepStart, keepEnd)
+func trimFragment(content string, offsets []int, start, end, keepStart, keepEnd int) (int, int) {
+	runeAt := func(i int) rune {
+		r, _ := utf8.DecodeRuneInString(content[offsets[i]:])
+		return r
+	}
+	isWord := func(i int) bool {
+		r := runeAt(i)
+		return (unicode.IsLetter(r) || unicode.IsDigit(r)) && !unicode.Is(unicode.Han, r)
+	}
+
+	if start > 0 {
+		for start < keepStart && isWord(start-1) && isWord(start) {
+			start++
+		}
+	}
+	for start < keepStart && unicode.IsSpace(runeAt(start)) {
+		start++
+	}
+	if end < len(offsets)-1 {
+		for end > keepEnd && isWord(end-1) && isWord(end) {
+			end--
+		}
+	}
+	for end > keepEnd && unicode.IsSpace(runeAt(end-1)) {
+		end--
+	}
+	return start, end
+}
+
+// 输出字符位置[start, end)之间的文本，在spans前后插入标签
+func renderFragment(content string, offsets []int, start, end int, spans []highlightSpan,
+	options *types.HighlightOptions) string {
+	escape := func(text string) string {
+		if options.EscapeHTML {
+			return html.EscapeString(text)
+		}
+		return text
+	}
+
+	var builder strings.Builder
+	position := start
+	for _, span := range spans {
+		builder.WriteString(escape(content[offsets[position]:offsets[span.start]]))
+		builder.WriteString(options.PreTag)
+		builder.WriteString(escape(content[offsets[span.start]:offsets[span.end]]))
+		builder.WriteString(options.PostTag)
+		position = span.end
+	}
+	builder.WriteString(escape(content[offsets[position]:offsets[end]]))
+	return builder.String()
+}
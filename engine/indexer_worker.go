@@ -1,6 +1,8 @@
 package engine
 
 import (
+	"context"
+
 	"github.com/huichen/wukong/types"
 	"sync/atomic"
 )
@@ -8,16 +10,23 @@ import (
 type indexerAddDocumentRequest struct {
 	document    *types.DocumentIndex
 	forceUpdate bool
+
+	// 批量索引的最后一个请求，见Engine.IndexDocuments
+	batch *indexBatch
 }
 
 type indexerLookupRequest struct {
+	ctx                 context.Context
 	countDocsOnly       bool
 	tokens              []string
 	labels              []string
+	query               types.Query
 	docIds              map[uint64]bool
 	options             types.RankOptions
 	rankerReturnChannel chan rankerReturnRequest
 	orderless           bool
+	facets              []types.FacetRequest
+	filters             []types.AttributeFilter
 }
 
 type indexerRemoveDocRequest struct {
@@ -27,51 +36,111 @@ type indexerRemoveDocRequest struct {
 
 func (engine *Engine) indexerAddDocumentWorker(shard int) {
 	for {
-		request := <-engine.indexerAddDocChannels[shard]
+		var request indexerAddDocumentRequest
+		select {
+		case request = <-engine.indexerAddDocChannels[shard]:
+		case <-engine.done:
+			return
+		}
+		engine.shardsLock.RLock()
 		engine.indexers[shard].AddDocumentToCache(request.document, request.forceUpdate)
 		if request.document != nil {
 			atomic.AddUint64(&engine.numTokenIndexAdded,
 				uint64(len(request.document.Keywords)))
 			atomic.AddUint64(&engine.numDocumentsIndexed, 1)
 		}
+		engine.shardsLock.RUnlock()
 		if request.forceUpdate {
 			atomic.AddUint64(&engine.numDocumentsForceUpdated, 1)
 		}
+		if request.batch != nil {
+			request.batch.finishStep()
+		}
+		engine.progress.notify()
 	}
 }
 
 func (engine *Engine) indexerRemoveDocWorker(shard int) {
 	for {
-		request := <-engine.indexerRemoveDocChannels[shard]
+		var request indexerRemoveDocRequest
+		select {
+		case request = <-engine.indexerRemoveDocChannels[shard]:
+		case <-engine.done:
+			return
+		}
+		engine.shardsLock.RLock()
 		engine.indexers[shard].RemoveDocumentToCache(request.docId, request.forceUpdate)
 		if request.docId != 0 {
 			atomic.AddUint64(&engine.numDocumentsRemoved, 1)
 		}
+		engine.shardsLock.RUnlock()
 		if request.forceUpdate {
 			atomic.AddUint64(&engine.numDocumentsForceUpdated, 1)
 		}
+		engine.progress.notify()
 	}
 }
 
 func (engine *Engine) indexerLookupWorker(shard int) {
 	for {
-		request := <-engine.indexerLookupChannels[shard]
+		var request indexerLookupRequest
+		select {
+		case request = <-engine.indexerLookupChannels[shard]:
+		case <-engine.done:
+			return
+		}
 
+		// 搜索已经超时或者被取消时不再查找
+		if request.ctx.Err() != nil {
+			continue
+		}
+
+		// 分面统计和属性过滤需要全部文档
+		countDocsOnly := request.countDocsOnly && len(request.facets) == 0 && len(request.filters) == 0
 		var docs []types.IndexedDocument
 		var numDocs int
-		if request.docIds == nil {
-			docs, numDocs = engine.indexers[shard].Lookup(request.tokens, request.labels, nil, request.countDocsOnly)
+		var err error
+		// 发送结果之前释放读锁，否则等待写锁的Restore会阻塞排序器，造成死锁
+		engine.shardsLock.RLock()
+		if request.query != nil {
+			docs, numDocs, err = engine.indexers[shard].LookupQueryContext(
+				request.ctx, request.query, request.docIds, countDocsOnly)
 		} else {
-			docs, numDocs = engine.indexers[shard].Lookup(request.tokens, request.labels, request.docIds, request.countDocsOnly)
+			docs, numDocs, err = engine.indexers[shard].LookupContext(
+				request.ctx, request.tokens, request.labels, request.docIds, countDocsOnly)
+		}
+
+		if err == nil && len(request.filters) > 0 {
+			docs, err = engine.rankers[shard].Filter(docs, request.filters)
+			numDocs = len(docs)
+		}
+
+		var facets map[string]map[string]int
+		if err == nil && len(request.facets) > 0 {
+			docIds := make([]uint64, len(docs))
+			for i, d := range docs {
+				docIds[i] = d.DocId
+			}
+			facets, err = engine.indexers[shard].CountFacets(docIds, request.facets)
+		}
+		engine.shardsLock.RUnlock()
+
+		if request.ctx.Err() != nil {
+			// Search不会再等待这个分片的结果
+			continue
+		}
+		if err != nil {
+			request.rankerReturnChannel <- rankerReturnRequest{err: err}
+			continue
 		}
 
 		if request.countDocsOnly {
-			request.rankerReturnChannel <- rankerReturnRequest{numDocs: numDocs}
+			request.rankerReturnChannel <- rankerReturnRequest{numDocs: numDocs, facets: facets}
 			continue
 		}
 
 		if len(docs) == 0 {
-			request.rankerReturnChannel <- rankerReturnRequest{}
+			request.rankerReturnChannel <- rankerReturnRequest{facets: facets}
 			continue
 		}
 
@@ -86,16 +155,24 @@ func (engine *Engine) indexerLookupWorker(shard int) {
 			request.rankerReturnChannel <- rankerReturnRequest{
 				docs:    outputDocs,
 				numDocs: len(outputDocs),
+				facets:  facets,
 			}
 			continue
 		}
 
 		rankerRequest := rankerRankRequest{
+			ctx:                 request.ctx,
 			countDocsOnly:       request.countDocsOnly,
 			docs:                docs,
 			options:             request.options,
 			rankerReturnChannel: request.rankerReturnChannel,
+			facets:              facets,
+		}
+		// 超时的搜索不会等待排序结果，此时引擎可能已经关闭
+		select {
+		case engine.rankerRankChannels[shard] <- rankerRequest:
+		case <-engine.done:
+			return
 		}
-		engine.rankerRankChannels[shard] <- rankerRequest
 	}
 }
@@ -0,0 +1,70 @@
+package engine
+
+import (
+	"container/heap"
+
+	"github.com/huichen/wukong/types"
+)
+
+// 多路归并各个分片排好序的文档，limit为0时输出全部文档
+func mergeScoredDocs(outputs []types.ScoredDocuments, limit int, reverse bool) types.ScoredDocuments {
+	total := 0
+	for _, docs := range outputs {
+		total += len(docs)
+	}
+	if limit == 0 || limit > total {
+		limit = total
+	}
+
+	merged := make(types.ScoredDocuments, 0, limit)
+	if len(outputs) == 1 {
+		return append(merged, outputs[0][:limit]...)
+	}
+	h := &mergeHeap{outputs: outputs, reverse: reverse}
+	for i, docs := range outputs {
+		if len(docs) > 0 {
+			h.cursors = append(h.cursors, mergeCursor{shard: i})
+		}
+	}
+	heap.Init(h)
+	for len(merged) < limit {
+		cursor := &h.cursors[0]
+		merged = append(merged, outputs[cursor.shard][cursor.position])
+		cursor.position++
+		if cursor.position == len(outputs[cursor.shard]) {
+			heap.Pop(h)
+		} else {
+			heap.Fix(h, 0)
+		}
+	}
+	return merged
+}
+
+type mergeCursor struct {
+	shard    int
+	position int
+}
+
+// 堆顶为当前排在最前的分片
+type mergeHeap struct {
+	outputs []types.ScoredDocuments
+	cursors []mergeCursor
+	reverse bool
+}
+
+func (h *mergeHeap) Len() int { return len(h.cursors) }
+func (h *mergeHeap) Less(i, j int) bool {
+	a := h.outputs[h.cursors[i].shard][h.cursors[i].position].Scores
+	b := h.outputs[h.cursors[j].shard][h.cursors[j].position].Scores
+	if h.reverse {
+		return types.ScoresMore(b, a)
+	}
+	return types.ScoresMore(a, b)
+}
+func (h *mergeHeap) Swap(i, j int)      { h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i] }
+func (h *mergeHeap) Push(x interface{}) { h.cursors = append(h.cursors, x.(mergeCursor)) }
+func (h *mergeHeap) Pop() interface{} {
+	cursor := h.cursors[len(h.cursors)-1]
+	h.cursors = h.cursors[:len(h.cursors)-1]
+	return cursor
+}
@@ -1,48 +1,123 @@
 package engine
 
 import (
-	"bytes"
 	"encoding/binary"
-	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/huichen/wukong/storage"
 	"github.com/huichen/wukong/types"
+	"log"
 	"sync/atomic"
 )
 
 type persistentStorageIndexDocumentRequest struct {
 	docId uint64
-	data  types.DocumentIndexData
+
+	// 编码后的文档，见encodeDocument
+	value []byte
+
+	// 为true时只用data.Fields替换存储中文档的评分字段，见Engine.UpdateFields
+	fieldsOnly bool
+	data       types.DocumentIndexData
+
+	// 为true时从存储中删除文档，见Engine.RemoveDocument
+	remove bool
+
+	// 批量索引时为所属的批次，此时在一个事务中写入documents，见Engine.IndexDocuments
+	batch     *indexBatch
+	documents []encodedDocument
 }
 
 func (engine *Engine) persistentStorageIndexDocumentWorker(shard int) {
 	for {
-		request := <-engine.persistentStorageIndexDocumentChannels[shard]
+		var request persistentStorageIndexDocumentRequest
+		select {
+		case request = <-engine.persistentStorageIndexDocumentChannels[shard]:
+		case <-engine.done:
+			return
+		}
 
-		// 得到key
-		b := make([]byte, 10)
-		length := binary.PutUvarint(b, request.docId)
+		if request.batch != nil {
+			if err := engine.storeDocuments(shard, request.documents); err != nil {
+				request.batch.fail(engine.storageWriteError(err))
+			}
+			atomic.AddUint64(&engine.numDocumentsStored, uint64(len(request.documents)))
+			request.batch.finishStep()
+			engine.progress.notify()
+			continue
+		}
 
-		// 得到value
-		var buf bytes.Buffer
-		enc := gob.NewEncoder(&buf)
-		err := enc.Encode(request.data)
-		if err != nil {
-			atomic.AddUint64(&engine.numDocumentsStored, 1)
+		if request.remove {
+			if err := engine.dbs[shard].Delete(storageKey(request.docId)); err != nil {
+				engine.storageWriteError(fmt.Errorf("无法删除文档%d: %w", request.docId, err))
+			}
+			atomic.AddUint64(&engine.numDocumentsUnstored, 1)
+			engine.progress.notify()
 			continue
 		}
 
-		// 将key-value写入数据库
-		engine.dbs[shard].Set(b[0:length], buf.Bytes())
-		atomic.AddUint64(&engine.numDocumentsStored, 1)
+		if err := engine.storeDocument(shard, request); err != nil {
+			engine.storageWriteError(fmt.Errorf("无法写入文档%d: %w", request.docId, err))
+		}
+		if request.fieldsOnly {
+			atomic.AddUint64(&engine.numFieldUpdatesStored, 1)
+		} else {
+			atomic.AddUint64(&engine.numDocumentsStored, 1)
+		}
+		engine.progress.notify()
+	}
+}
+
+func (engine *Engine) storeDocument(shard int, request persistentStorageIndexDocumentRequest) error {
+	value := request.value
+	if request.fieldsOnly {
+		// 同一文档的写入都在这个线程中按顺序进行，因此读出的是最新的数据
+		stored, err := engine.getStoredDocument(request.docId)
+		if err != nil {
+			return err
+		}
+		stored.Fields = request.data.Fields
+		if value, err = engine.encodeDocument(&stored); err != nil {
+			return err
+		}
 	}
+
+	// 将key-value写入数据库
+	return engine.dbs[shard].Set(storageKey(request.docId), value)
+}
+
+// 记录持久存储写入失败：计入NumStorageErrors并记录日志，返回包装了types.ErrStorageWrite的错误
+// 失败的写入仍然计入完成的操作数，FlushIndex不会一直等待
+func (engine *Engine) storageWriteError(err error) error {
+	atomic.AddUint64(&engine.numStorageErrors, 1)
+	log.Printf("%v: %v", types.ErrStorageWrite, err)
+	return fmt.Errorf("%w: %v", types.ErrStorageWrite, err)
 }
 
-func (engine *Engine) persistentStorageRemoveDocumentWorker(docId uint64, shard uint32) {
-	// 得到key
-	b := make([]byte, 10)
-	length := binary.PutUvarint(b, docId)
+// 写入一批文档，存储支持时在一个事务中完成
+func (engine *Engine) storeDocuments(shard int, documents []encodedDocument) error {
+	keys := make([][]byte, len(documents))
+	values := make([][]byte, len(documents))
+	for i, document := range documents {
+		keys[i] = storageKey(document.DocId)
+		values[i] = document.Value
+	}
+
+	if db, ok := engine.dbs[shard].(storage.BatchStorage); ok {
+		return db.SetBatch(keys, values)
+	}
+	for i := range keys {
+		if err := engine.dbs[shard].Set(keys[i], values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	// 从数据库删除该key
-	engine.dbs[shard].Delete(b[0:length])
+// 文档在持久存储中的键
+func storageKey(docId uint64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	return b[:binary.PutUvarint(b, docId)]
 }
 
 func (engine *Engine) persistentStorageInitWorker(shard int) {
@@ -51,11 +126,8 @@ func (engine *Engine) persistentStorageInitWorker(shard int) {
 		// 得到docID
 		docId, _ := binary.Uvarint(key)
 
-		// 得到data
-		buf := bytes.NewReader(value)
-		dec := gob.NewDecoder(buf)
-		var data types.DocumentIndexData
-		err := dec.Decode(&data)
+		// 得到data，无法解码的文档计入NumDecodeErrors后跳过
+		data, err := engine.decodeDocument(value)
 		if err == nil {
 			// 添加索引
 			engine.internalIndexDocument(docId, data, false)
@@ -64,3 +136,36 @@ func (engine *Engine) persistentStorageInitWorker(shard int) {
 	})
 	engine.persistentStorageInitChannel <- true
 }
+
+// 从持久存储中读出文档，文档不存在时返回types.ErrDocumentNotFound
+func (engine *Engine) getStoredDocument(docId uint64) (data types.DocumentIndexData, err error) {
+	if !engine.initOptions.UsePersistentStorage {
+		err = types.ErrPersistentStorageDisabled
+		return
+	}
+
+	value, err := engine.dbs[engine.storageShard(docId)].Get(storageKey(docId))
+	if err != nil {
+		return
+	}
+	if value == nil {
+		err = types.ErrDocumentNotFound
+		return
+	}
+	return engine.decodeDocument(value)
+}
+
+// 为搜索结果读出持久存储中的文档，持久存储中没有的文档（比如尚未写入）跳过
+func (engine *Engine) loadDocuments(docs []types.ScoredDocument) error {
+	for i := range docs {
+		data, err := engine.getStoredDocument(docs[i].DocId)
+		if errors.Is(err, types.ErrDocumentNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		docs[i].Document = &data
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package engine
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// 工作协程处理完请求（更新计数器）后通知等待者，用于FlushIndex等阻塞等待计数器的场合
+//
+// 等待者先取得通知通道再检查条件，条件不满足时在通道上等待；工作协程更新计数器后关闭
+// 通道，唤醒全部等待者重新检查。没有等待者时通知不需要加锁。
+type progressNotifier struct {
+	lock    sync.Mutex
+	channel chan struct{}
+	waiters int32
+}
+
+func (notifier *progressNotifier) getChannel() chan struct{} {
+	notifier.lock.Lock()
+	defer notifier.lock.Unlock()
+	if notifier.channel == nil {
+		notifier.channel = make(chan struct{})
+	}
+	return notifier.channel
+}
+
+// 必须在更新计数器之后调用
+func (notifier *progressNotifier) notify() {
+	if atomic.LoadInt32(&notifier.waiters) == 0 {
+		return
+	}
+	notifier.lock.Lock()
+	if notifier.channel != nil {
+		close(notifier.channel)
+		notifier.channel = nil
+	}
+	notifier.lock.Unlock()
+}
+
+// 阻塞等待直到condition返回true或者ctx结束
+func (notifier *progressNotifier) waitUntil(ctx context.Context, condition func() bool) error {
+	atomic.AddInt32(&notifier.waiters, 1)
+	defer atomic.AddInt32(&notifier.waiters, -1)
+	for {
+		channel := notifier.getChannel()
+		if condition() {
+			return nil
+		}
+		select {
+		case <-channel:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
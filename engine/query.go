@@ -0,0 +1,267 @@
+package engine
+
+import (
+	"github.com/huichen/wukong/core"
+	"github.com/huichen/wukong/types"
+)
+
+// 对搜索文本分词，并剔除停用词
+func (engine *Engine) segmentQueryText(text string) []string {
+	tokens := []string{}
+	for _, token := range engine.tokenizer.Tokenize(text) {
+		if !engine.stopTokens.IsStopToken(token.Text) {
+			tokens = append(tokens, token.Text)
+		}
+	}
+	return tokens
+}
+
+// 对短语文本分词，并剔除停用词
+// 返回的gaps为相邻关键词在文本中的字节间隔，见types.PhraseQuery
+func (engine *Engine) segmentPhrase(text string) (tokens []string, gaps []int) {
+	end := -1
+	for _, token := range engine.tokenizer.Tokenize(text) {
+		if engine.stopTokens.IsStopToken(token.Text) {
+			continue
+		}
+		if end >= 0 {
+			gaps = append(gaps, token.Start-end)
+		}
+		tokens = append(tokens, token.Text)
+		end = token.End
+	}
+	return
+}
+
+// 对查询语法树中的TermQuery和PhraseQuery分词，得到索引器可以直接查找的语法树
+//
+// 一个TermQuery分出多个关键词时变为这些关键词的AndQuery。只含停用词的子查询
+// 会被剔除，整个查询都被剔除时返回nil。
+func (engine *Engine) analyzeQuery(query types.Query) types.Query {
+	switch q := query.(type) {
+	case types.TermQuery:
+		if engine.tokenizer == nil {
+			if q.Text == "" {
+				return nil
+			}
+			return q
+		}
+		tokens := engine.segmentQueryText(q.Text)
+		switch len(tokens) {
+		case 0:
+			return nil
+		case 1:
+			return types.TermQuery{Text: tokens[0], Weight: q.Weight}
+		}
+		and := types.AndQuery{}
+		for _, token := range tokens {
+			and.Queries = append(and.Queries, types.TermQuery{Text: token, Weight: q.Weight})
+		}
+		return and
+	case types.LabelQuery:
+		return q
+	case types.FuzzyQuery:
+		if engine.tokenizer == nil {
+			if q.Text == "" {
+				return nil
+			}
+			return q
+		}
+		tokens := engine.segmentQueryText(q.Text)
+		switch len(tokens) {
+		case 0:
+			return nil
+		case 1:
+			return types.FuzzyQuery{Text: tokens[0], MaxDistance: q.MaxDistance}
+		}
+		and := types.AndQuery{}
+		for _, token := range tokens {
+			and.Queries = append(and.Queries, types.FuzzyQuery{Text: token, MaxDistance: q.MaxDistance})
+		}
+		return and
+	case types.PrefixQuery:
+		if q.Prefix == "" {
+			return nil
+		}
+		return q
+	case types.PhraseQuery:
+		if engine.tokenizer == nil {
+			if len(q.Terms) == 0 {
+				return nil
+			}
+			return q
+		}
+		phrase := types.PhraseQuery{Slop: q.Slop}
+		for _, term := range q.Terms {
+			tokens, gaps := engine.segmentPhrase(term)
+			if len(tokens) == 0 {
+				continue
+			}
+			if len(phrase.Terms) > 0 {
+				// Terms的多个元素之间视为紧邻
+				phrase.Gaps = append(phrase.Gaps, 0)
+			}
+			phrase.Terms = append(phrase.Terms, tokens...)
+			phrase.Gaps = append(phrase.Gaps, gaps...)
+		}
+		switch len(phrase.Terms) {
+		case 0:
+			return nil
+		case 1:
+			return types.TermQuery{Text: phrase.Terms[0]}
+		}
+		return phrase
+	case types.AndQuery:
+		queries := engine.analyzeQueries(q.Queries)
+		if len(queries) == 0 {
+			return nil
+		}
+		return types.AndQuery{Queries: queries}
+	case types.OrQuery:
+		queries := engine.analyzeQueries(q.Queries)
+		if len(queries) == 0 {
+			return nil
+		}
+		return types.OrQuery{Queries: queries}
+	case types.NotQuery:
+		sub := engine.analyzeQuery(q.Query)
+		if sub == nil {
+			return nil
+		}
+		return types.NotQuery{Query: sub}
+	}
+	return nil
+}
+
+func (engine *Engine) analyzeQueries(queries []types.Query) (output []types.Query) {
+	for _, query := range queries {
+		if analyzed := engine.analyzeQuery(query); analyzed != nil {
+			output = append(output, analyzed)
+		}
+	}
+	return
+}
+
+// 关键词中是否有词带有同义词
+func (engine *Engine) hasSynonyms(tokens []string) bool {
+	for _, token := range tokens {
+		if len(engine.synonyms.Lookup(token)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// 将分词后的查询语法树中的TermQuery扩展为它和同义词的OrQuery，短语和标签不扩展
+//
+// 同义词和搜索文本一样分词，权重为原关键词的权重乘以SynonymWeight。
+func (engine *Engine) expandQuery(query types.Query) types.Query {
+	switch q := query.(type) {
+	case types.TermQuery:
+		synonyms := engine.synonyms.Lookup(q.Text)
+		if len(synonyms) == 0 {
+			return q
+		}
+		weight := engine.initOptions.SynonymWeight
+		if q.Weight != 0 {
+			weight *= q.Weight
+		}
+		or := types.OrQuery{Queries: []types.Query{q}}
+		for _, synonym := range synonyms {
+			if expanded := engine.analyzeQuery(types.TermQuery{Text: synonym, Weight: weight}); expanded != nil {
+				or.Queries = append(or.Queries, expanded)
+			}
+		}
+		return or
+	case types.AndQuery:
+		and := types.AndQuery{}
+		for _, sub := range q.Queries {
+			and.Queries = append(and.Queries, engine.expandQuery(sub))
+		}
+		return and
+	case types.OrQuery:
+		or := types.OrQuery{}
+		for _, sub := range q.Queries {
+			or.Queries = append(or.Queries, engine.expandQuery(sub))
+		}
+		return or
+	case types.NotQuery:
+		return types.NotQuery{Query: engine.expandQuery(q.Query)}
+	}
+	return query
+}
+
+// 将查询语法树中的PrefixQuery扩展为全部分片中以前缀开头的搜索键的OrQuery，FuzzyQuery扩展为
+// 全部分片中满足编辑距离的搜索键的OrQuery
+//
+// 前缀匹配的搜索键按全部分片的文档频率取舍，编辑距离为d的搜索键权重为types.FuzzyWeight(d)。
+// 模糊匹配的扩展结果记录在expansions中，键为模糊匹配的关键词。所有分片使用同样的扩展结果，
+// 因此各个分片的评分是一致的，返回的关键词位置也和SearchResponse.Tokens对应。
+func (engine *Engine) expandPrefixAndFuzzyQueries(
+	query types.Query, expansions map[string][]string) (types.Query, error) {
+	switch q := query.(type) {
+	case types.PrefixQuery:
+		frequencies := make(map[string]int)
+		err := engine.forEachIndexer(func(indexer *core.Indexer) error {
+			keywords, err := indexer.PrefixKeywords(q.Prefix)
+			for keyword, frequency := range keywords {
+				frequencies[keyword] += frequency
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return types.ExpandPrefixKeywords(frequencies), nil
+	case types.FuzzyQuery:
+		if q.MaxDistance <= 0 {
+			return types.TermQuery{Text: q.Text}, nil
+		}
+
+		distances := make(map[string]int)
+		err := engine.forEachIndexer(func(indexer *core.Indexer) error {
+			keywords, err := indexer.FuzzyKeywords(q.Text, q.MaxDistance)
+			for keyword, distance := range keywords {
+				distances[keyword] = distance
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(distances) == 0 {
+			// 没有匹配的搜索键，保留原关键词使查询不匹配任何文档
+			return types.TermQuery{Text: q.Text}, nil
+		}
+		keywords, expanded := types.ExpandFuzzyKeywords(distances)
+		expansions[q.Text] = keywords
+		return expanded, nil
+	case types.AndQuery:
+		and := types.AndQuery{}
+		for _, sub := range q.Queries {
+			expanded, err := engine.expandPrefixAndFuzzyQueries(sub, expansions)
+			if err != nil {
+				return nil, err
+			}
+			and.Queries = append(and.Queries, expanded)
+		}
+		return and, nil
+	case types.OrQuery:
+		or := types.OrQuery{}
+		for _, sub := range q.Queries {
+			expanded, err := engine.expandPrefixAndFuzzyQueries(sub, expansions)
+			if err != nil {
+				return nil, err
+			}
+			or.Queries = append(or.Queries, expanded)
+		}
+		return or, nil
+	case types.NotQuery:
+		expanded, err := engine.expandPrefixAndFuzzyQueries(q.Query, expansions)
+		if err != nil {
+			return nil, err
+		}
+		return types.NotQuery{Query: expanded}, nil
+	}
+	return query, nil
+}
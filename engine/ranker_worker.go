@@ -1,24 +1,33 @@
 package engine
 
 import (
+	"context"
+	"sync/atomic"
+
 	"github.com/huichen/wukong/types"
 )
 
 type rankerAddDocRequest struct {
-	docId  uint64
-	fields interface{}
+	docId      uint64
+	fields     interface{}
+	attributes map[string]types.AttributeValue
+	batch      *indexBatch
 }
 
 type rankerRankRequest struct {
+	ctx                 context.Context
 	docs                []types.IndexedDocument
 	options             types.RankOptions
 	rankerReturnChannel chan rankerReturnRequest
 	countDocsOnly       bool
+	facets              map[string]map[string]int
 }
 
 type rankerReturnRequest struct {
 	docs    types.ScoredDocuments
 	numDocs int
+	facets  map[string]map[string]int
+	err     error
 }
 
 type rankerRemoveDocRequest struct {
@@ -27,26 +36,61 @@ type rankerRemoveDocRequest struct {
 
 func (engine *Engine) rankerAddDocWorker(shard int) {
 	for {
-		request := <-engine.rankerAddDocChannels[shard]
-		engine.rankers[shard].AddDoc(request.docId, request.fields)
+		var request rankerAddDocRequest
+		select {
+		case request = <-engine.rankerAddDocChannels[shard]:
+		case <-engine.done:
+			return
+		}
+		engine.shardsLock.RLock()
+		engine.rankers[shard].AddDocWithAttributes(request.docId, request.fields, request.attributes)
+		atomic.AddUint64(&engine.numDocumentsRanked, 1)
+		engine.shardsLock.RUnlock()
+		if request.batch != nil {
+			request.batch.finishStep()
+		}
+		engine.progress.notify()
 	}
 }
 
 func (engine *Engine) rankerRankWorker(shard int) {
 	for {
-		request := <-engine.rankerRankChannels[shard]
+		var request rankerRankRequest
+		select {
+		case request = <-engine.rankerRankChannels[shard]:
+		case <-engine.done:
+			return
+		}
+		if request.ctx.Err() != nil {
+			continue
+		}
 		if request.options.MaxOutputs != 0 {
 			request.options.MaxOutputs += request.options.OutputOffset
 		}
 		request.options.OutputOffset = 0
-		outputDocs, numDocs := engine.rankers[shard].Rank(request.docs, request.options, request.countDocsOnly)
-		request.rankerReturnChannel <- rankerReturnRequest{docs: outputDocs, numDocs: numDocs}
+		engine.shardsLock.RLock()
+		outputDocs, numDocs, err := engine.rankers[shard].RankContext(
+			request.ctx, request.docs, request.options, request.countDocsOnly)
+		engine.shardsLock.RUnlock()
+		if request.ctx.Err() != nil {
+			// Search不会再等待这个分片的结果
+			continue
+		}
+		request.rankerReturnChannel <- rankerReturnRequest{
+			docs: outputDocs, numDocs: numDocs, facets: request.facets, err: err}
 	}
 }
 
 func (engine *Engine) rankerRemoveDocWorker(shard int) {
 	for {
-		request := <-engine.rankerRemoveDocChannels[shard]
+		var request rankerRemoveDocRequest
+		select {
+		case request = <-engine.rankerRemoveDocChannels[shard]:
+		case <-engine.done:
+			return
+		}
+		engine.shardsLock.RLock()
 		engine.rankers[shard].RemoveDoc(request.docId)
+		engine.shardsLock.RUnlock()
 	}
 }
@@ -9,11 +9,46 @@ type segmenterRequest struct {
 	hash        uint32
 	data        types.DocumentIndexData
 	forceUpdate bool
+
+	// 批量索引时为所属的批次，此时documents为一块待分词的文档，见Engine.IndexDocuments
+	batch     *indexBatch
+	documents []types.IndexItem
+}
+
+// 剔除停用词，再用IndexTokenFilters处理
+func (engine *Engine) filterIndexTokens(tokens []types.Token) []types.Token {
+	filtered := make([]types.Token, 0, len(tokens))
+	for _, token := range tokens {
+		if !engine.stopTokens.IsStopToken(token.Text) {
+			filtered = append(filtered, token)
+		}
+	}
+	for _, filter := range engine.initOptions.IndexTokenFilters {
+		filtered = filter.Filter(filtered)
+	}
+	return filtered
 }
 
 func (engine *Engine) segmenterWorker() {
 	for {
-		request := <-engine.segmenterChannel
+		var request segmenterRequest
+		select {
+		case request = <-engine.segmenterChannel:
+		case <-engine.done:
+			return
+		}
+		if request.batch != nil {
+			for _, item := range request.documents {
+				engine.segmentDocument(segmenterRequest{
+					docId: item.DocId,
+					hash:  documentHash(item.DocId, item.Data.Content),
+					data:  item.Data,
+					batch: request.batch,
+				})
+			}
+			engine.finishBatchChunk(request.batch)
+			continue
+		}
 		if request.docId == 0 {
 			if request.forceUpdate {
 				for i := 0; i < engine.initOptions.NumShards; i++ {
@@ -22,76 +57,79 @@ func (engine *Engine) segmenterWorker() {
 			}
 			continue
 		}
+		engine.segmentDocument(request)
+	}
+}
 
-		shard := engine.getShard(request.hash)
-		tokensMap := make(map[string][]int)
-		numTokens := 0
-		if !engine.initOptions.NotUsingSegmenter && request.data.Content != "" {
-			// 当文档正文不为空时，优先从内容分词中得到关键词
-			segments := engine.segmenter.Segment([]byte(request.data.Content))
-			for _, segment := range segments {
-				token := segment.Token().Text()
-				if !engine.stopTokens.IsStopToken(token) {
-					tokensMap[token] = append(tokensMap[token], segment.Start())
-				}
-			}
-			numTokens = len(segments)
-		} else {
-			// 否则载入用户输入的关键词
-			for _, t := range request.data.Tokens {
-				if !engine.stopTokens.IsStopToken(t.Text) {
-					tokensMap[t.Text] = t.Locations
-				}
+// 对文档分词，并发送给所在分片的索引器和排序器
+func (engine *Engine) segmentDocument(request segmenterRequest) {
+	shard := engine.getShard(request.hash)
+	tokensMap := make(map[string][]int)
+	numTokens := 0
+	if engine.tokenizer != nil && request.data.Content != "" {
+		// 当文档正文不为空时，优先从内容分词中得到关键词
+		tokens := engine.tokenizer.Tokenize(request.data.Content)
+		numTokens = len(tokens)
+		for _, token := range engine.filterIndexTokens(tokens) {
+			tokensMap[token.Text] = append(tokensMap[token.Text], token.Start)
+		}
+	} else {
+		// 否则载入用户输入的关键词
+		for _, t := range request.data.Tokens {
+			if !engine.stopTokens.IsStopToken(t.Text) {
+				tokensMap[t.Text] = t.Locations
 			}
-			numTokens = len(request.data.Tokens)
 		}
+		numTokens = len(request.data.Tokens)
+	}
 
-		// 加入非分词的文档标签
-		for _, label := range request.data.Labels {
-			if !engine.initOptions.NotUsingSegmenter {
-				if !engine.stopTokens.IsStopToken(label) {
-					//当正文中已存在关键字时，若不判断，位置信息将会丢失
-					if _, ok := tokensMap[label]; !ok {
-						tokensMap[label] = []int{}
-					}
-				}
-			} else {
+	// 加入非分词的文档标签
+	for _, label := range request.data.Labels {
+		if !engine.initOptions.NotUsingSegmenter {
+			if !engine.stopTokens.IsStopToken(label) {
 				//当正文中已存在关键字时，若不判断，位置信息将会丢失
 				if _, ok := tokensMap[label]; !ok {
 					tokensMap[label] = []int{}
 				}
 			}
+		} else {
+			//当正文中已存在关键字时，若不判断，位置信息将会丢失
+			if _, ok := tokensMap[label]; !ok {
+				tokensMap[label] = []int{}
+			}
 		}
+	}
 
-		indexerRequest := indexerAddDocumentRequest{
-			document: &types.DocumentIndex{
-				DocId:       request.docId,
-				TokenLength: float32(numTokens),
-				Keywords:    make([]types.KeywordIndex, len(tokensMap)),
-			},
-			forceUpdate: request.forceUpdate,
-		}
-		iTokens := 0
-		for k, v := range tokensMap {
-			indexerRequest.document.Keywords[iTokens] = types.KeywordIndex{
-				Text: k,
-				// 非分词标注的词频设置为0，不参与tf-idf计算
-				Frequency: float32(len(v)),
-				Starts:    v}
-			iTokens++
-		}
+	indexerRequest := indexerAddDocumentRequest{
+		document: &types.DocumentIndex{
+			DocId:       request.docId,
+			TokenLength: float32(numTokens),
+			Keywords:    make([]types.KeywordIndex, len(tokensMap)),
+		},
+		forceUpdate: request.forceUpdate,
+	}
+	iTokens := 0
+	for k, v := range tokensMap {
+		indexerRequest.document.Keywords[iTokens] = types.KeywordIndex{
+			Text: k,
+			// 非分词标注的词频设置为0，不参与tf-idf计算
+			Frequency: float32(len(v)),
+			Starts:    v}
+		iTokens++
+	}
 
-		engine.indexerAddDocChannels[shard] <- indexerRequest
-		if request.forceUpdate {
-			for i := 0; i < engine.initOptions.NumShards; i++ {
-				if i == shard {
-					continue
-				}
-				engine.indexerAddDocChannels[i] <- indexerAddDocumentRequest{forceUpdate: true}
+	engine.indexerAddDocChannels[shard] <- indexerRequest
+	if request.forceUpdate {
+		for i := 0; i < engine.initOptions.NumShards; i++ {
+			if i == shard {
+				continue
 			}
+			engine.indexerAddDocChannels[i] <- indexerAddDocumentRequest{forceUpdate: true}
 		}
-		rankerRequest := rankerAddDocRequest{
-			docId: request.docId, fields: request.data.Fields}
-		engine.rankerAddDocChannels[shard] <- rankerRequest
 	}
+	// 属性已经在IndexDocument中检查过
+	attributes, _ := types.NewAttributeValues(request.data.Attributes)
+	rankerRequest := rankerAddDocRequest{
+		docId: request.docId, fields: request.data.Fields, attributes: attributes, batch: request.batch}
+	engine.rankerAddDocChannels[shard] <- rankerRequest
 }
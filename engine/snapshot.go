@@ -0,0 +1,211 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+
+	"github.com/huichen/wukong/core"
+	"github.com/huichen/wukong/types"
+)
+
+// 快照依次为：snapshotMagic、版本号和分片数（varint），引擎的计数器（varint，见snapshotCounters，
+// 版本1中没有），然后是每个分片的索引器和排序器快照，格式见core.Indexer.Snapshot和
+// core.Ranker.Snapshot
+const (
+	snapshotMagic   = "wukong.snapshot"
+	snapshotVersion = 2
+)
+
+// 快照中保存的计数器，载入快照时和分片一起恢复
+type snapshotCounters struct {
+	numDocumentsIndexed uint64
+	numRemovingRequests uint64
+	numTokenIndexAdded  uint64
+}
+
+// 将全部分片的反向索引表和排序器（评分字段、数值属性）写入w，用Restore或者
+// EngineInitOptions.SnapshotFile载入时不需要重新分词
+//
+// 写入前先刷新索引（见FlushIndex）。写入期间不要修改索引，否则各个分片可能处于不同的时刻。
+// 快照中同时保存NumDocumentsIndexed等计数器。
+// 快照不包含持久存储中的文档数据。评分字段用gob编码，其类型必须在gob中注册。
+func (engine *Engine) Snapshot(w io.Writer) error {
+	if err := engine.enter(); err != nil {
+		return err
+	}
+	defer engine.requests.Done()
+	if err := engine.flushIndex(context.Background()); err != nil {
+		return err
+	}
+	return engine.writeSnapshot(w)
+}
+
+func (engine *Engine) writeSnapshot(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(snapshotMagic)
+	buffer := make([]byte, binary.MaxVarintLen64)
+	bw.Write(buffer[:binary.PutUvarint(buffer, snapshotVersion)])
+	bw.Write(buffer[:binary.PutUvarint(buffer, uint64(engine.initOptions.NumShards))])
+
+	engine.shardsLock.RLock()
+	defer engine.shardsLock.RUnlock()
+	for _, counter := range []uint64{
+		atomic.LoadUint64(&engine.numDocumentsIndexed),
+		atomic.LoadUint64(&engine.numDocumentsRemoved) / uint64(engine.initOptions.NumShards),
+		atomic.LoadUint64(&engine.numTokenIndexAdded),
+	} {
+		bw.Write(buffer[:binary.PutUvarint(buffer, counter)])
+	}
+	for shard := 0; shard < engine.initOptions.NumShards; shard++ {
+		if err := engine.indexers[shard].Snapshot(bw); err != nil {
+			return err
+		}
+		if err := engine.rankers[shard].Snapshot(bw); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// 用Snapshot写入的快照替换全部分片的反向索引表和排序器
+//
+// NumShards和索引类型必须和写入快照时相同，否则返回types.ErrInvalidSnapshot。快照全部读出
+// 之后才替换，返回错误时索引保持不变。NumDocumentsIndexed等计数器恢复为写入快照时的值。
+// 持久存储不受影响。
+//
+// 恢复前先刷新索引（见FlushIndex），替换分片期间搜索和索引请求会等待，恢复期间发出的
+// 写操作在替换之后执行。
+func (engine *Engine) Restore(r io.Reader) error {
+	if err := engine.enter(); err != nil {
+		return err
+	}
+	defer engine.requests.Done()
+	if err := engine.flushIndex(context.Background()); err != nil {
+		return err
+	}
+	return engine.restore(r)
+}
+
+func (engine *Engine) restore(r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != snapshotMagic {
+		return fmt.Errorf("%w: 不是悟空的快照", types.ErrInvalidSnapshot)
+	}
+	version, err := binary.ReadUvarint(br)
+	if err != nil || version == 0 || version > snapshotVersion {
+		return fmt.Errorf("%w: 不支持的版本%d", types.ErrInvalidSnapshot, version)
+	}
+	numShards, err := binary.ReadUvarint(br)
+	if err != nil || numShards != uint64(engine.initOptions.NumShards) {
+		return fmt.Errorf("%w: 分片数不一致", types.ErrInvalidSnapshot)
+	}
+	var counters *snapshotCounters
+	if version >= 2 {
+		counters = &snapshotCounters{}
+		for _, counter := range []*uint64{
+			&counters.numDocumentsIndexed, &counters.numRemovingRequests, &counters.numTokenIndexAdded} {
+			if *counter, err = binary.ReadUvarint(br); err != nil {
+				return fmt.Errorf("%w: %v", types.ErrInvalidSnapshot, err)
+			}
+		}
+	}
+
+	indexers := make([]*core.Indexer, engine.initOptions.NumShards)
+	rankers := make([]*core.Ranker, engine.initOptions.NumShards)
+	for shard := 0; shard < engine.initOptions.NumShards; shard++ {
+		indexers[shard] = &core.Indexer{}
+		indexers[shard].Init(*engine.initOptions.IndexerInitOptions)
+		if err := indexers[shard].Restore(br); err != nil {
+			return err
+		}
+		rankers[shard] = &core.Ranker{}
+		rankers[shard].Init()
+		if err := rankers[shard].Restore(br); err != nil {
+			return err
+		}
+	}
+
+	// 工作协程使用分片时持有读锁，替换期间不会访问旧的分片
+	engine.shardsLock.Lock()
+	defer engine.shardsLock.Unlock()
+	for shard := 0; shard < engine.initOptions.NumShards; shard++ {
+		engine.indexers[shard].Close()
+		engine.indexers[shard] = indexers[shard]
+		engine.rankers[shard].Close()
+		engine.rankers[shard] = rankers[shard]
+	}
+	if counters != nil {
+		engine.restoreCounters(counters)
+	}
+	return nil
+}
+
+// 将计数器恢复为快照中的值
+//
+// 已经发出但是还没有执行的请求在锁释放后才会执行，因此请求数和完成数同时加上相同的差值，
+// 保持它们之间的差，FlushIndex仍能等到这些请求完成。调用者持有shardsLock的写锁。
+func (engine *Engine) restoreCounters(counters *snapshotCounters) {
+	numShards := uint64(engine.initOptions.NumShards)
+	// 差值可能为负，无符号整数溢出后相加的结果仍然正确
+	indexed := counters.numDocumentsIndexed - atomic.LoadUint64(&engine.numDocumentsIndexed)
+	for _, counter := range []*uint64{&engine.numIndexingRequests, &engine.numDocumentsIndexed,
+		&engine.numDocumentsRanked, &engine.numDocumentsStored} {
+		atomic.AddUint64(counter, indexed)
+	}
+	removed := counters.numRemovingRequests - atomic.LoadUint64(&engine.numDocumentsRemoved)/numShards
+	atomic.AddUint64(&engine.numRemovingRequests, removed)
+	atomic.AddUint64(&engine.numDocumentsUnstored, removed)
+	atomic.AddUint64(&engine.numDocumentsRemoved, removed*numShards)
+	atomic.AddUint64(&engine.numTokenIndexAdded,
+		counters.numTokenIndexAdded-atomic.LoadUint64(&engine.numTokenIndexAdded))
+	engine.progress.notify()
+}
+
+// 从EngineInitOptions.SnapshotFile载入索引，载入后删除快照文件
+// 快照不存在或者无效时返回false，此时需要从持久存储恢复
+func (engine *Engine) restoreSnapshotFile() bool {
+	file, err := os.Open(engine.initOptions.SnapshotFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("无法打开快照%s: %v", engine.initOptions.SnapshotFile, err)
+		}
+		return false
+	}
+	err = engine.restore(file)
+	file.Close()
+	os.Remove(engine.initOptions.SnapshotFile)
+	if err != nil {
+		log.Printf("无法载入快照%s: %v", engine.initOptions.SnapshotFile, err)
+		return false
+	}
+	return true
+}
+
+// 将索引写入EngineInitOptions.SnapshotFile，先写入临时文件再改名，不会留下不完整的快照
+func (engine *Engine) writeSnapshotFile() error {
+	path := engine.initOptions.SnapshotFile
+	file, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = engine.writeSnapshot(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,213 @@
+package engine
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/huichen/wukong/core"
+	"github.com/huichen/wukong/types"
+)
+
+const (
+	// 最多返回多少个拼写建议
+	maxSpellingSuggestions = 3
+
+	// 每个关键词最多保留多少个改正候选
+	maxSpellingCandidates = 3
+)
+
+type spellingCandidate struct {
+	keyword string
+	score   float64
+}
+
+// "您是不是要找"：为没有搜索到文档的关键词生成改正后的搜索文本
+//
+// 每个关键词的候选为词典中和它编辑距离足够小的搜索键（见spellingCandidates）。依次尝试
+// 每个关键词都取最好的候选、以及只把其中一个关键词换成次好候选得到的查询，返回能搜索到
+// 文档的前几个。pinyin为true时关键词是拼音关键词，返回的文本去掉拼音前缀。
+func (engine *Engine) spellingSuggestions(tokens []string, labels []string, pinyin bool) ([]string, error) {
+	candidates := make([][]spellingCandidate, len(tokens))
+	for i, token := range tokens {
+		tokenCandidates, err := engine.spellingCandidates(token)
+		if err != nil {
+			return nil, err
+		}
+		if len(tokenCandidates) == 0 {
+			// 有关键词找不到候选时无法改正
+			return nil, nil
+		}
+		candidates[i] = tokenCandidates
+	}
+
+	best := make([]string, len(tokens))
+	for i := range tokens {
+		best[i] = candidates[i][0].keyword
+	}
+	queries := [][]string{best}
+
+	// 次好候选按得分相对最好候选的比例排序
+	type variant struct {
+		index int
+		ratio float64
+		spellingCandidate
+	}
+	var variants []variant
+	for i := range tokens {
+		for _, candidate := range candidates[i][1:] {
+			variants = append(variants, variant{i, candidate.score / candidates[i][0].score, candidate})
+		}
+	}
+	sort.SliceStable(variants, func(i, j int) bool {
+		return variants[i].ratio > variants[j].ratio
+	})
+	for _, v := range variants {
+		query := append([]string{}, best...)
+		query[v.index] = v.keyword
+		queries = append(queries, query)
+	}
+
+	var suggestions []string
+	for _, query := range queries {
+		if equalStrings(query, tokens) {
+			continue
+		}
+		numDocs, err := engine.countKeywordDocs(query, labels)
+		if err != nil {
+			return nil, err
+		}
+		if numDocs == 0 {
+			continue
+		}
+		suggestions = append(suggestions, joinSuggestion(query, pinyin))
+		if len(suggestions) == maxSpellingSuggestions {
+			break
+		}
+	}
+	return suggestions, nil
+}
+
+// 关键词的改正候选，按得分从大到小排序
+//
+// 候选为词典中和关键词编辑距离不超过1（关键词超过4个字符时为2，只有1个字符时为0）的搜索键，
+// 得分为文档频率除以(1+编辑距离)的平方。对含有汉字的关键词，和它拼音相同的候选（同音字）
+// 编辑距离按0.5计算。
+func (engine *Engine) spellingCandidates(token string) ([]spellingCandidate, error) {
+	maxDistance := 1
+	if length := utf8.RuneCountInString(strings.TrimPrefix(token, types.PinyinPrefix)); length <= 1 {
+		maxDistance = 0
+	} else if length > 4 {
+		maxDistance = 2
+	}
+
+	distances := make(map[string]int)
+	err := engine.forEachIndexer(func(indexer *core.Indexer) error {
+		keywords, err := indexer.FuzzyKeywords(token, maxDistance)
+		for keyword, distance := range keywords {
+			distances[keyword] = distance
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(distances) == 0 {
+		return nil, nil
+	}
+
+	keywords := make([]string, 0, len(distances))
+	for keyword := range distances {
+		keywords = append(keywords, keyword)
+	}
+	frequencies := make(map[string]int)
+	err = engine.forEachIndexer(func(indexer *core.Indexer) error {
+		shardFrequencies, err := indexer.DocumentFrequencies(keywords)
+		for keyword, frequency := range shardFrequencies {
+			frequencies[keyword] += frequency
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tokenPinyin, _, hasHan := types.ToPinyin(token)
+	candidates := make([]spellingCandidate, 0, len(keywords))
+	for _, keyword := range keywords {
+		if frequencies[keyword] == 0 {
+			continue
+		}
+		distance := float64(distances[keyword])
+		if hasHan && distance > 0 {
+			if keywordPinyin, _, ok := types.ToPinyin(keyword); ok && keywordPinyin == tokenPinyin {
+				distance = 0.5
+			}
+		}
+		candidates = append(candidates, spellingCandidate{
+			keyword: keyword,
+			score:   float64(frequencies[keyword]) / ((1 + distance) * (1 + distance)),
+		})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].keyword < candidates[j].keyword
+	})
+	if len(candidates) > maxSpellingCandidates {
+		candidates = candidates[:maxSpellingCandidates]
+	}
+	return candidates, nil
+}
+
+// 同时含有全部关键词和标签的文档数
+func (engine *Engine) countKeywordDocs(keywords []string, labels []string) (int, error) {
+	query := types.AndQuery{}
+	for _, keyword := range keywords {
+		query.Queries = append(query.Queries, types.TermQuery{Text: keyword})
+	}
+	for _, label := range labels {
+		query.Queries = append(query.Queries, types.LabelQuery{Label: label})
+	}
+
+	numDocs := 0
+	err := engine.forEachIndexer(func(indexer *core.Indexer) error {
+		_, shardNumDocs, err := indexer.LookupQuery(query, nil, true)
+		numDocs += shardNumDocs
+		return err
+	})
+	return numDocs, err
+}
+
+// 将关键词拼接为搜索文本，只在两个非汉字字符之间加空格
+func joinSuggestion(keywords []string, pinyin bool) string {
+	var builder strings.Builder
+	for i, keyword := range keywords {
+		if pinyin {
+			keyword = strings.TrimPrefix(keyword, types.PinyinPrefix)
+		}
+		if i > 0 {
+			last, _ := utf8.DecodeLastRuneInString(builder.String())
+			first, _ := utf8.DecodeRuneInString(keyword)
+			if !unicode.Is(unicode.Han, last) && !unicode.Is(unicode.Han, first) {
+				builder.WriteByte(' ')
+			}
+		}
+		builder.WriteString(keyword)
+	}
+	return builder.String()
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
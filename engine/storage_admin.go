@@ -0,0 +1,109 @@
+package engine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/huichen/wukong/storage"
+	"github.com/huichen/wukong/types"
+)
+
+// 持久存储的管理：统计、检查和压缩
+//
+// 这些函数不启动引擎，直接打开options.PersistentStorageFolder中的各个分片，只使用
+// PersistentStorageFolder、PersistentStorageShards和Codec三个选项，存储引擎由环境变量
+// WUKONG_STORAGE_ENGINE选择。调用时不能有引擎在使用这个目录，否则bolt会一直等待文件锁。
+
+type adminStorage interface {
+	storage.Storage
+	storage.AdminStorage
+}
+
+// 分片的数据库文件
+func storagePath(folder string, shard int) string {
+	return folder + "/" + PersistentStorageFilePrefix + "." + strconv.Itoa(shard)
+}
+
+// 持久存储各个分片的文档数和占用的磁盘空间
+func StorageStats(options types.EngineInitOptions) ([]types.StorageShardStats, error) {
+	return forEachStorageShard(&options, func(db adminStorage, stats *types.StorageShardStats) error {
+		return nil
+	})
+}
+
+// 检查持久存储中的每个文档能否用options.Codec（或者内置的编码方式）解码，除了统计信息，
+// 返回值还包括无法解码的文档。评分字段为自定义类型时，gob编码需要先注册类型，BinaryCodec
+// 和JSONCodec需要设置NewFields。预写日志中尚未写入持久存储的操作不在检查范围内
+func CheckStorage(options types.EngineInitOptions) ([]types.StorageShardStats, error) {
+	return forEachStorageShard(&options, func(db adminStorage, stats *types.StorageShardStats) error {
+		return db.ForEach(func(k, v []byte) error {
+			docId, n := binary.Uvarint(k)
+			if n <= 0 || n != len(k) {
+				stats.NumInvalidKeys++
+			} else if _, err := decodeDocument(options.Codec, v); err != nil {
+				stats.InvalidDocIds = append(stats.InvalidDocIds, docId)
+			}
+			return nil
+		})
+	})
+}
+
+// 将持久存储的每个分片复制到新文件再替换原文件，释放删除文档后留下的空间，返回压缩后的
+// 统计信息。中途出错时已经压缩的分片保持压缩后的状态，其它分片不变
+func CompactStorage(options types.EngineInitOptions) ([]types.StorageShardStats, error) {
+	return forEachStorageShard(&options, func(db adminStorage, stats *types.StorageShardStats) error {
+		return db.Compact()
+	})
+}
+
+// 依次打开每个分片并调用fn，然后统计文档数和磁盘空间。options中没有设置的选项改为默认值
+// 分片不存在时返回错误，不会新建数据库
+func forEachStorageShard(
+	options *types.EngineInitOptions,
+	fn func(db adminStorage, stats *types.StorageShardStats) error,
+) ([]types.StorageShardStats, error) {
+	// 只需要持久存储相关选项的默认值
+	options.NotUsingSegmenter = true
+	if err := options.Init(); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(options.PersistentStorageFolder); err != nil {
+		return nil, fmt.Errorf("无法打开目录%s: %w", options.PersistentStorageFolder, err)
+	}
+
+	allStats := make([]types.StorageShardStats, 0, options.PersistentStorageShards)
+	for shard := 0; shard < options.PersistentStorageShards; shard++ {
+		path := storagePath(options.PersistentStorageFolder, shard)
+		if _, err := os.Stat(path); err != nil {
+			return allStats, fmt.Errorf("无法打开数据库%s: %w", path, err)
+		}
+		db, err := storage.OpenStorage(path)
+		if db == nil || err != nil {
+			return allStats, fmt.Errorf("无法打开数据库%s: %w", path, err)
+		}
+		admin, ok := db.(adminStorage)
+		if !ok {
+			db.Close()
+			return allStats, fmt.Errorf("数据库%s: 存储引擎不支持统计和压缩", path)
+		}
+
+		stats := types.StorageShardStats{Shard: shard, Path: path}
+		err = fn(admin, &stats)
+		if err == nil {
+			stats.NumDocuments, err = admin.NumKeys()
+		}
+		if err == nil {
+			stats.Size, err = admin.Size()
+		}
+		if closeErr := db.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return allStats, fmt.Errorf("数据库%s: %w", path, err)
+		}
+		allStats = append(allStats, stats)
+	}
+	return allStats, nil
+}
@@ -0,0 +1,46 @@
+package engine
+
+import (
+	"sort"
+
+	"github.com/huichen/wukong/core"
+	"github.com/huichen/wukong/types"
+)
+
+// 输入提示：返回以prefix开头的搜索键中文档数最多的n个，文档数相同时按搜索键排序
+//
+// prefix不分词，应当是索引中搜索键的形式。搜索键包括文档的标签，以及
+// 使用PinyinFilter时的拼音关键词。n小于等于零时返回全部。
+func (engine *Engine) Suggest(prefix string, n int) ([]types.KeywordCount, error) {
+	if err := engine.enter(); err != nil {
+		return nil, err
+	}
+	defer engine.requests.Done()
+
+	counts := make(map[string]int)
+	err := engine.forEachIndexer(func(indexer *core.Indexer) error {
+		keywords, err := indexer.PrefixKeywords(prefix)
+		for keyword, count := range keywords {
+			counts[keyword] += count
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	output := make([]types.KeywordCount, 0, len(counts))
+	for keyword, count := range counts {
+		output = append(output, types.KeywordCount{Keyword: keyword, NumDocs: count})
+	}
+	sort.Slice(output, func(i, j int) bool {
+		if output[i].NumDocs != output[j].NumDocs {
+			return output[i].NumDocs > output[j].NumDocs
+		}
+		return output[i].Keyword < output[j].Keyword
+	})
+	if n > 0 && len(output) > n {
+		output = output[:n]
+	}
+	return output, nil
+}
@@ -0,0 +1,241 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/huichen/wukong/types"
+)
+
+// 预写日志（write-ahead log），见EngineInitOptions.UseWAL
+//
+// 每条记录为一次写操作：4字节长度、4字节CRC32校验和，以及gob编码的walRecord，其中的文档
+// 已经用EngineInitOptions.Codec编码（见encodeDocument）。写操作
+// 在日志锁内先追加记录，再发送给索引流水线和持久存储，因此持久存储收到的操作和日志中
+// 的顺序一致。启动时先将日志中的操作按顺序重放到持久存储，再从持久存储恢复索引；持久
+// 存储追上日志之后清空日志（FlushIndex、Close，以及日志超过EngineInitOptions.WALCheckpointSize时）。
+
+const walFileName = PersistentStorageFilePrefix + ".wal"
+
+// 日志记录的操作
+const (
+	walIndexDocuments = iota + 1
+	walRemoveDocument
+	walUpdateFields
+)
+
+type walRecord struct {
+	// 序号，同一个日志文件中逐条加一
+	Seq uint64
+	Op  int
+
+	// walIndexDocuments为全部文档；walRemoveDocument只有DocId；walUpdateFields的文档
+	// 只有评分字段
+	Documents []encodedDocument
+}
+
+type writeAheadLog struct {
+	// 保证写操作按日志的顺序执行
+	lock sync.Mutex
+
+	file   *os.File
+	noSync bool
+
+	// 最后一条记录的序号和文件长度
+	seq  uint64
+	size int64
+}
+
+// 打开或者创建日志，返回其中完整的记录。崩溃时写了一半的记录及之后的内容会被截掉
+func openWriteAheadLog(path string, noSync bool) (*writeAheadLog, []walRecord, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	wal := &writeAheadLog{file: file, noSync: noSync}
+
+	var records []walRecord
+	reader := bufio.NewReader(file)
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+		payload := make([]byte, binary.LittleEndian.Uint32(header))
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:]) {
+			break
+		}
+		var record walRecord
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&record); err != nil {
+			break
+		}
+		if len(records) > 0 && record.Seq != wal.seq+1 {
+			break
+		}
+		records = append(records, record)
+		wal.seq = record.Seq
+		wal.size += int64(len(header) + len(payload))
+	}
+
+	if err := file.Truncate(wal.size); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return wal, records, nil
+}
+
+// 追加一条记录，调用者必须持有wal.lock
+func (wal *writeAheadLog) append(op int, documents []encodedDocument) error {
+	record := walRecord{Seq: wal.seq + 1, Op: op, Documents: documents}
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 8))
+	if err := gob.NewEncoder(&buf).Encode(record); err != nil {
+		return err
+	}
+	b := buf.Bytes()
+	binary.LittleEndian.PutUint32(b, uint32(len(b)-8))
+	binary.LittleEndian.PutUint32(b[4:], crc32.ChecksumIEEE(b[8:]))
+
+	if _, err := wal.file.Write(b); err != nil {
+		// 去掉可能写了一半的记录
+		wal.file.Truncate(wal.size)
+		return err
+	}
+	if !wal.noSync {
+		if err := wal.file.Sync(); err != nil {
+			wal.file.Truncate(wal.size)
+			return err
+		}
+	}
+	wal.seq = record.Seq
+	wal.size += int64(len(b))
+	return nil
+}
+
+func (wal *writeAheadLog) lastSeq() uint64 {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	return wal.seq
+}
+
+// 持久存储已经包含序号不超过seq的全部操作时调用，之后没有新记录时清空日志
+func (wal *writeAheadLog) checkpoint(seq uint64) error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	if wal.seq != seq {
+		return nil
+	}
+	return wal.truncate()
+}
+
+// 清空日志，调用者必须持有wal.lock
+func (wal *writeAheadLog) truncate() error {
+	if wal.size == 0 {
+		return nil
+	}
+	if err := wal.file.Truncate(0); err != nil {
+		return err
+	}
+	wal.size = 0
+	return wal.file.Sync()
+}
+
+func (wal *writeAheadLog) close() error {
+	return wal.file.Close()
+}
+
+// 在日志锁内记录操作并执行apply，没有打开预写日志或者documents为空时直接执行apply
+// 记录写入失败时不执行apply并返回错误
+func (engine *Engine) writeAhead(op int, documents []encodedDocument, apply func()) error {
+	if engine.wal == nil || len(documents) == 0 {
+		apply()
+		return nil
+	}
+	engine.wal.lock.Lock()
+	defer engine.wal.lock.Unlock()
+	if err := engine.wal.append(op, documents); err != nil {
+		return err
+	}
+	apply()
+	engine.checkpointFullWAL()
+	return nil
+}
+
+// 日志超过EngineInitOptions.WALCheckpointSize时，等待持久存储执行完日志中的全部操作后清空
+// 日志。调用者必须持有wal.lock并且已经发出了日志中的全部操作，因此等待期间不会有新的记录
+// 写操作已经成功，清空失败时只记录日志，下次超过大小时再试
+//
+// 持久存储写入出过错时（见NumStorageErrors）不再清空日志，下次启动时重放日志补上失败的写入
+func (engine *Engine) checkpointFullWAL() {
+	if engine.wal.size < engine.initOptions.WALCheckpointSize {
+		return
+	}
+	engine.progress.waitUntil(context.Background(), engine.storageCaughtUp)
+	if atomic.LoadUint64(&engine.numStorageErrors) > 0 {
+		return
+	}
+	if err := engine.wal.truncate(); err != nil {
+		log.Printf("无法清空预写日志: %v", err)
+	}
+}
+
+// 打开预写日志并将其中的操作按顺序重放到持久存储，然后清空日志
+// 返回重放的记录数。任何一条记录重放失败时返回错误并保留日志，下次启动时重新重放
+func (engine *Engine) recoverFromWAL() (int, error) {
+	path := engine.initOptions.PersistentStorageFolder + "/" + walFileName
+	wal, records, err := openWriteAheadLog(path, engine.initOptions.WALNoSync)
+	if err != nil {
+		return 0, err
+	}
+	engine.wal = wal
+
+	for _, record := range records {
+		if err := engine.replayWALRecord(record); err != nil {
+			return 0, fmt.Errorf("无法重放第%d条日志记录: %w", record.Seq, err)
+		}
+	}
+	return len(records), wal.checkpoint(wal.seq)
+}
+
+func (engine *Engine) replayWALRecord(record walRecord) error {
+	for _, document := range record.Documents {
+		shard := engine.storageShard(document.DocId)
+		var err error
+		switch record.Op {
+		case walIndexDocuments:
+			err = engine.storeDocument(shard, persistentStorageIndexDocumentRequest{
+				docId: document.DocId, value: document.Value})
+		case walRemoveDocument:
+			err = engine.dbs[shard].Delete(storageKey(document.DocId))
+		case walUpdateFields:
+			var data types.DocumentIndexData
+			if data, err = engine.decodeDocument(document.Value); err != nil {
+				break
+			}
+			err = engine.storeDocument(shard, persistentStorageIndexDocumentRequest{
+				docId: document.DocId, data: data, fieldsOnly: true})
+			if errors.Is(err, types.ErrDocumentNotFound) {
+				// 文档在之后的记录中被删除并已经写入存储
+				err = nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
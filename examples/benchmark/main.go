@@ -19,6 +19,9 @@ import (
 
 const (
 	numRepeatQuery = 1000
+
+	// 比较部分排序和全排序时每个关键词搜索的次数
+	numRepeatRankQuery = 100
 )
 
 var (
@@ -47,6 +50,7 @@ var (
 	use_persistent            = flag.Bool("use_persistent", false, "是否使用持久存储")
 	persistent_storage_folder = flag.String("persistent_storage_folder", "benchmark.persistent", "持久存储数据库保存的目录")
 	persistent_storage_shards = flag.Int("persistent_storage_shards", 0, "持久数据库存储裂分数目")
+	max_outputs               = flag.Int("max_outputs", 100, "每次搜索最多输出的文档数，为0时对全部文档排序")
 
 	searcher = engine.Engine{}
 	options  = types.RankOptions{
@@ -62,12 +66,13 @@ var (
 func main() {
 	// 解析命令行参数
 	flag.Parse()
+	options.MaxOutputs = *max_outputs
 	searchQueries = strings.Split(*queries, ",")
 	log.Printf("待搜索的关键词为\"%s\"", searchQueries)
 
 	// 初始化
 	tBeginInit := time.Now()
-	searcher.Init(types.EngineInitOptions{
+	if err := searcher.Init(types.EngineInitOptions{
 		SegmenterDictionaries: *dictionaries,
 		StopTokenFile:         *stop_token_file,
 		IndexerInitOptions: &types.IndexerInitOptions{
@@ -78,7 +83,9 @@ func main() {
 		UsePersistentStorage:    *use_persistent,
 		PersistentStorageFolder: *persistent_storage_folder,
 		PersistentStorageShards: *persistent_storage_shards,
-	})
+	}); err != nil {
+		log.Fatal(err)
+	}
 	tEndInit := time.Now()
 	defer searcher.Close()
 
@@ -196,11 +203,20 @@ func main() {
 	}
 	recordResponse.RUnlock()
 
+	// 比较只保留前max_outputs个文档（堆）和对全部文档排序的搜索时间
+	if *max_outputs > 0 {
+		tTopK := timeSearch(*max_outputs)
+		tFullSort := timeSearch(0)
+		log.Printf("输出前 %d 个文档时搜索平均响应时间 %v 毫秒", *max_outputs, tTopK)
+		log.Printf("对全部文档排序时搜索平均响应时间 %v 毫秒", tFullSort)
+		log.Printf("部分排序的速度是全排序的 %.2f 倍", tFullSort/tTopK)
+	}
+
 	if *use_persistent {
 		searcher.Close()
 		t6 := time.Now()
 		searcher1 := engine.Engine{}
-		searcher1.Init(types.EngineInitOptions{
+		if err := searcher1.Init(types.EngineInitOptions{
 			SegmenterDictionaries: *dictionaries,
 			StopTokenFile:         *stop_token_file,
 			IndexerInitOptions: &types.IndexerInitOptions{
@@ -211,7 +227,9 @@ func main() {
 			UsePersistentStorage:    *use_persistent,
 			PersistentStorageFolder: *persistent_storage_folder,
 			PersistentStorageShards: *persistent_storage_shards,
-		})
+		}); err != nil {
+			log.Fatal(err)
+		}
 		defer searcher1.Close()
 		t7 := time.Now()
 		t := t7.Sub(t6).Seconds() - tEndInit.Sub(tBeginInit).Seconds()
@@ -224,6 +242,19 @@ func main() {
 	//os.RemoveAll(*persistent_storage_folder)
 }
 
+// 单线程搜索全部关键词，返回平均响应时间（毫秒），maxOutputs为0时对全部文档排序
+func timeSearch(maxOutputs int) float64 {
+	rankOptions := options
+	rankOptions.MaxOutputs = maxOutputs
+	t := time.Now()
+	for i := 0; i < numRepeatRankQuery; i++ {
+		for _, query := range searchQueries {
+			searcher.Search(types.SearchRequest{Text: query, RankOptions: &rankOptions})
+		}
+	}
+	return time.Since(t).Seconds() * 1000 / float64(numRepeatRankQuery*len(searchQueries))
+}
+
 type recordResponseLock struct {
 	sync.RWMutex
 	count map[string]int
@@ -232,7 +263,7 @@ type recordResponseLock struct {
 func search(ch chan bool, record *recordResponseLock) {
 	for i := 0; i < numRepeatQuery; i++ {
 		for _, query := range searchQueries {
-			output := searcher.Search(types.SearchRequest{Text: query})
+			output, _ := searcher.Search(types.SearchRequest{Text: query})
 			record.RLock()
 			if _, found := record.count[query]; !found {
 				record.RUnlock()
@@ -118,7 +118,7 @@ type JsonResponse struct {
 
 func JsonRpcServer(w http.ResponseWriter, req *http.Request) {
 	query := req.URL.Query().Get("query")
-	output := searcher.Search(types.SearchRequest{
+	output, err := searcher.Search(types.SearchRequest{
 		Text: query,
 		RankOptions: &types.RankOptions{
 			ScoringCriteria: &WeiboScoringCriteria{},
@@ -126,13 +126,24 @@ func JsonRpcServer(w http.ResponseWriter, req *http.Request) {
 			MaxOutputs:      100,
 		},
 	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	// 整理为输出格式
 	docs := []*Weibo{}
 	for _, doc := range output.Docs {
 		wb := wbs[doc.DocId]
-		for _, t := range output.Tokens {
-			wb.Text = strings.Replace(wb.Text, t, "<font color=red>"+t+"</font>", -1)
+		// 微博不超过140字，高亮全文
+		fragments, _ := searcher.Highlight(wb.Text, output.Tokens, &types.HighlightOptions{
+			PreTag:       "<font color=red>",
+			PostTag:      "</font>",
+			FragmentSize: 140,
+			EscapeHTML:   true,
+		})
+		if len(fragments) > 0 {
+			wb.Text = fragments[0]
 		}
 		docs = append(docs, &wb)
 	}
@@ -152,7 +163,7 @@ func main() {
 	// 初始化
 	gob.Register(WeiboScoringFields{})
 	log.Print("引擎开始初始化")
-	searcher.Init(types.EngineInitOptions{
+	if err := searcher.Init(types.EngineInitOptions{
 		SegmenterDictionaries: *dictFile,
 		StopTokenFile:         *stopTokenFile,
 		IndexerInitOptions: &types.IndexerInitOptions{
@@ -163,7 +174,9 @@ func main() {
 		// 请修改 WUKONG_STORAGE_ENGINE 环境变量
 		// UsePersistentStorage: true,
 		// PersistentStorageFolder: "weibo_search",
-	})
+	}); err != nil {
+		log.Fatal(err)
+	}
 	log.Print("引擎初始化完毕")
 	wbs = make(map[uint64]Weibo)
 
@@ -99,14 +99,16 @@ func main() {
 
 	// 初始化
 	gob.Register(WeiboScoringFields{})
-	searcher.Init(types.EngineInitOptions{
+	if err := searcher.Init(types.EngineInitOptions{
 		SegmenterDictionaries: *dictionaries,
 		StopTokenFile:         *stop_token_file,
 		IndexerInitOptions: &types.IndexerInitOptions{
 			IndexType: types.LocationsIndex,
 		},
 		DefaultRankOptions: &options,
-	})
+	}); err != nil {
+		log.Fatal(err)
+	}
 	defer searcher.Close()
 
 	// 读入微博数据
@@ -150,7 +152,7 @@ func main() {
 
 	// 搜索
 	log.Printf("开始查询")
-	output := searcher.Search(types.SearchRequest{Text: *query})
+	output, _ := searcher.Search(types.SearchRequest{Text: *query})
 
 	// 显示
 	fmt.Println()
@@ -20,8 +20,10 @@ var (
 
 func main() {
 	// 初始化
-	searcher.Init(types.EngineInitOptions{
-		SegmenterDictionaries: "../../data/dictionary.txt"})
+	if err := searcher.Init(types.EngineInitOptions{
+		SegmenterDictionaries: "../../data/dictionary.txt"}); err != nil {
+		log.Fatal(err)
+	}
 	defer searcher.Close()
 
 	// 将文档加入索引，docId 从1开始
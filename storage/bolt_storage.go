@@ -2,6 +2,7 @@ package storage
 
 import (
 	"github.com/boltdb/bolt"
+	"os"
 	"time"
 )
 
@@ -37,9 +38,24 @@ func (s *boltStorage) Set(k []byte, v []byte) error {
 	})
 }
 
+func (s *boltStorage) SetBatch(keys, values [][]byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(wukong_documents)
+		for i := range keys {
+			if err := bucket.Put(keys[i], values[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func (s *boltStorage) Get(k []byte) (b []byte, err error) {
 	err = s.db.View(func(tx *bolt.Tx) error {
-		b = tx.Bucket(wukong_documents).Get(k)
+		// 返回的切片只在事务内有效，因此需要复制
+		if v := tx.Bucket(wukong_documents).Get(k); v != nil {
+			b = append([]byte{}, v...)
+		}
 		return nil
 	})
 	return
@@ -64,6 +80,42 @@ func (s *boltStorage) ForEach(fn func(k, v []byte) error) error {
 	})
 }
 
+func (s *boltStorage) NumKeys() (n int, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(wukong_documents).Stats().KeyN
+		return nil
+	})
+	return
+}
+
+func (s *boltStorage) Size() (int64, error) {
+	return fileSize(s.db.Path())
+}
+
+// bolt删除数据后不会缩小文件，压缩时复制到新文件再改名
+func (s *boltStorage) Compact() error {
+	path := s.db.Path()
+	if err := copyStorage(s, path+".compact", openBoltStorage); err != nil {
+		return err
+	}
+	if err := s.db.Close(); err != nil {
+		os.Remove(path + ".compact")
+		return err
+	}
+	renameErr := os.Rename(path+".compact", path)
+	if renameErr != nil {
+		os.Remove(path + ".compact")
+	}
+
+	// 改名失败时重新打开原文件
+	db, err := openBoltStorage(path)
+	if err != nil {
+		return err
+	}
+	s.db = db.(*boltStorage).db
+	return renameErr
+}
+
 func (s *boltStorage) Close() error {
 	return s.db.Close()
 }
@@ -1,7 +1,9 @@
 package storage
 
 import (
+	"fmt"
 	"github.com/huichen/wukong/utils"
+	"math/rand"
 	"os"
 	"testing"
 )
@@ -26,3 +28,78 @@ func TestOpenOrCreateBolt(t *testing.T) {
 	os.Remove(walFile)
 	os.Remove("bolt_test")
 }
+
+func TestSetBatchBolt(t *testing.T) {
+	db, err := openBoltStorage("bolt_batch_test")
+	utils.Expect(t, "<nil>", err)
+
+	err = db.(BatchStorage).SetBatch(
+		[][]byte{[]byte("key1"), []byte("key2")},
+		[][]byte{[]byte("value1"), []byte("value2")})
+	utils.Expect(t, "<nil>", err)
+
+	buffer, err := db.Get([]byte("key1"))
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "value1", string(buffer))
+	buffer, err = db.Get([]byte("key2"))
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "value2", string(buffer))
+
+	walFile := db.WALName()
+	db.Close()
+	os.Remove(walFile)
+	os.Remove("bolt_batch_test")
+}
+
+func TestCompactBolt(t *testing.T) {
+	db, err := openBoltStorage("bolt_compact_test")
+	utils.Expect(t, "<nil>", err)
+
+	// 随机数据不能被压缩
+	value := make([]byte, 1000)
+	for i := 0; i < 2000; i++ {
+		rand.Read(value)
+		err = db.Set([]byte(fmt.Sprintf("key%d", i)), value)
+		utils.Expect(t, "<nil>", err)
+	}
+	for i := 0; i < 1990; i++ {
+		err = db.Delete([]byte(fmt.Sprintf("key%d", i)))
+		utils.Expect(t, "<nil>", err)
+	}
+	admin := db.(AdminStorage)
+	numKeys, err := admin.NumKeys()
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "10", numKeys)
+	sizeBefore, err := admin.Size()
+	utils.Expect(t, "<nil>", err)
+
+	err = admin.Compact()
+	utils.Expect(t, "<nil>", err)
+	numKeys, err = admin.NumKeys()
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "10", numKeys)
+	sizeAfter, err := admin.Size()
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "true", sizeAfter < sizeBefore)
+
+	// 压缩后仍然可以读写，重新打开后数据不变
+	err = db.Set([]byte("key2000"), []byte("value2000"))
+	utils.Expect(t, "<nil>", err)
+	db.Close()
+	db, err = openBoltStorage("bolt_compact_test")
+	utils.Expect(t, "<nil>", err)
+	numKeys, err = db.(AdminStorage).NumKeys()
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "11", numKeys)
+	buffer, err := db.Get([]byte("key1999"))
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "1000", len(buffer))
+	buffer, err = db.Get([]byte("key2000"))
+	utils.Expect(t, "<nil>", err)
+	utils.Expect(t, "value2000", string(buffer))
+
+	walFile := db.WALName()
+	db.Close()
+	os.Remove(walFile)
+	os.Remove("bolt_compact_test")
+}
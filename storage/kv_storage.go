@@ -3,6 +3,7 @@ package storage
 import (
 	"github.com/cznic/kv"
 	"io"
+	"os"
 )
 
 type kvStorage struct {
@@ -30,6 +31,19 @@ func (s *kvStorage) Set(k []byte, v []byte) error {
 	return s.db.Set(k, v)
 }
 
+func (s *kvStorage) SetBatch(keys, values [][]byte) error {
+	if err := s.db.BeginTransaction(); err != nil {
+		return err
+	}
+	for i := range keys {
+		if err := s.db.Set(keys[i], values[i]); err != nil {
+			s.db.Rollback()
+			return err
+		}
+	}
+	return s.db.Commit()
+}
+
 func (s *kvStorage) Get(k []byte) ([]byte, error) {
 	return s.db.Get(nil, k)
 }
@@ -59,6 +73,47 @@ func (s *kvStorage) ForEach(fn func(k, v []byte) error) error {
 	return nil
 }
 
+func (s *kvStorage) NumKeys() (n int, err error) {
+	err = s.ForEach(func(k, v []byte) error {
+		n++
+		return nil
+	})
+	return
+}
+
+func (s *kvStorage) Size() (int64, error) {
+	// 打开期间写入的数据可能还没有落到文件上，因此不能用文件的大小
+	size, err := s.db.Size()
+	if err != nil {
+		return 0, err
+	}
+	walSize, err := fileSize(s.db.WALName())
+	return size + walSize, err
+}
+
+func (s *kvStorage) Compact() error {
+	path := s.db.Name()
+	if err := copyStorage(s, path+".compact", openKVStorage); err != nil {
+		return err
+	}
+	if err := s.db.Close(); err != nil {
+		os.Remove(path + ".compact")
+		return err
+	}
+	renameErr := os.Rename(path+".compact", path)
+	if renameErr != nil {
+		os.Remove(path + ".compact")
+	}
+
+	// 改名失败时重新打开原文件
+	db, err := openKVStorage(path)
+	if err != nil {
+		return err
+	}
+	s.db = db.(*kvStorage).db
+	return renameErr
+}
+
 func (s *kvStorage) Close() error {
 	return s.db.Close()
 }
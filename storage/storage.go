@@ -25,6 +25,78 @@ type Storage interface {
 	WALName() string
 }
 
+// 可以在一个事务中写入多个键值的存储，keys和values一一对应
+type BatchStorage interface {
+	SetBatch(keys, values [][]byte) error
+}
+
+// 可以统计和压缩的存储，内置的bolt和kv都实现了这个接口
+// 这些函数不能和其它读写同时调用
+type AdminStorage interface {
+	// 键的个数
+	NumKeys() (int, error)
+
+	// 占用的磁盘空间（字节），包括日志文件
+	Size() (int64, error)
+
+	// 将全部键值复制到新文件并替换原文件，释放删除数据后留下的空间
+	Compact() error
+}
+
+// 压缩时每个事务复制的键值数
+const compactBatchSize = 1000
+
+// 新建path处的存储并复制src中的全部键值，完成后关闭新存储。出错时删除新文件
+func copyStorage(src Storage, path string, open func(path string) (Storage, error)) error {
+	os.Remove(path)
+	dst, err := open(path)
+	if err != nil {
+		return err
+	}
+
+	var keys, values [][]byte
+	flush := func() error {
+		err := dst.(BatchStorage).SetBatch(keys, values)
+		keys, values = keys[:0], values[:0]
+		return err
+	}
+	err = src.ForEach(func(k, v []byte) error {
+		// k和v只在ForEach的回调中有效，因此需要复制
+		keys = append(keys, append([]byte{}, k...))
+		values = append(values, append([]byte{}, v...))
+		if len(keys) == compactBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil && len(keys) > 0 {
+		err = flush()
+	}
+
+	walName := dst.WALName()
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if walName != path {
+		os.Remove(walName)
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// 文件的字节数，文件不存在时为0
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
 func OpenStorage(path string) (Storage, error) {
 	wse := os.Getenv("WUKONG_STORAGE_ENGINE")
 	if wse == "" {
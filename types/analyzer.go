@@ -0,0 +1,208 @@
+package types
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// 字符过滤器，分词前逐个字符地处理文本
+type CharFilter interface {
+	FilterRune(r rune) rune
+}
+
+// 可以改变字符个数的字符过滤器，比如把一个字符展开为多个或者把多个字符合并为一个
+// Analyzer使用FilterText而不是FilterRune。offsets[i]为text第i个字节对应的原文本位置，
+// 最后多一个元素为原文本末尾，返回过滤后的文本和对应的offsets
+type TextCharFilter interface {
+	CharFilter
+	FilterText(text string, offsets []int) (string, []int)
+}
+
+// 关键词过滤器，处理分词得到的关键词，可以修改、删除或者增加关键词
+type TokenFilter interface {
+	Filter(tokens []Token) []Token
+}
+
+// 分析器，依次用字符过滤器处理文本、分词、用关键词过滤器处理关键词
+//
+// Analyzer也是一个Tokenizer。关键词的位置总是对应字符过滤器处理之前的原文本，
+// 关键词的字符串则是过滤之后的结果。
+type Analyzer struct {
+	CharFilters  []CharFilter
+	Tokenizer    Tokenizer
+	TokenFilters []TokenFilter
+}
+
+func (analyzer *Analyzer) Tokenize(text string) []Token {
+	tokens := analyzer.tokenize(text)
+	for _, filter := range analyzer.TokenFilters {
+		tokens = filter.Filter(tokens)
+	}
+	return tokens
+}
+
+func (analyzer *Analyzer) tokenize(text string) []Token {
+	if len(analyzer.CharFilters) == 0 {
+		return analyzer.Tokenizer.Tokenize(text)
+	}
+
+	// 过滤后字符的字节长度可能改变，offsets[i]为过滤后文本第i个字节对应的原文本位置
+	offsets := make([]int, len(text)+1)
+	for i := range offsets {
+		offsets[i] = i
+	}
+	// 连续的逐字符过滤器在一次遍历中完成
+	var runeFilters []CharFilter
+	for _, filter := range analyzer.CharFilters {
+		if textFilter, ok := filter.(TextCharFilter); ok {
+			text, offsets = filterRunes(runeFilters, text, offsets)
+			runeFilters = nil
+			text, offsets = textFilter.FilterText(text, offsets)
+			continue
+		}
+		runeFilters = append(runeFilters, filter)
+	}
+	text, offsets = filterRunes(runeFilters, text, offsets)
+
+	tokens := analyzer.Tokenizer.Tokenize(text)
+	for i := range tokens {
+		tokens[i].Start = offsets[tokens[i].Start]
+		tokens[i].End = offsets[tokens[i].End]
+	}
+	return tokens
+}
+
+func filterRunes(filters []CharFilter, text string, offsets []int) (string, []int) {
+	if len(filters) == 0 {
+		return text, offsets
+	}
+	var builder strings.Builder
+	builder.Grow(len(text))
+	filteredOffsets := make([]int, 0, len(text)+1)
+	for i, r := range text {
+		for _, filter := range filters {
+			r = filter.FilterRune(r)
+		}
+		builder.WriteRune(r)
+		for j := utf8.RuneLen(r); j > 0; j-- {
+			filteredOffsets = append(filteredOffsets, offsets[i])
+		}
+	}
+	filteredOffsets = append(filteredOffsets, offsets[len(text)])
+	return builder.String(), filteredOffsets
+}
+
+// 将全角字母、数字、标点和空格转换为半角
+type FullWidthFilter struct{}
+
+func (FullWidthFilter) FilterRune(r rune) rune {
+	switch {
+	case r == '　':
+		return ' '
+	case r >= '！' && r <= '～':
+		return r - 0xfee0
+	}
+	return r
+}
+
+// NFKC规范化，比如把"ﬁ"展开为"fi"，"①"变为"1"，半角片假名"ｶﾞ"合并为"ガ"，全角字母变为半角
+// 展开或者合并得到的字符的位置都对应原文本中的第一个字符
+type NFKCFilter struct{}
+
+// 只能处理规范化后仍是一个字符的情况，Analyzer使用FilterText
+func (NFKCFilter) FilterRune(r rune) rune {
+	s := norm.NFKC.String(string(r))
+	if utf8.RuneCountInString(s) == 1 {
+		r, _ = utf8.DecodeRuneInString(s)
+	}
+	return r
+}
+
+func (NFKCFilter) FilterText(text string, offsets []int) (string, []int) {
+	var builder strings.Builder
+	builder.Grow(len(text))
+	filteredOffsets := make([]int, 0, len(text)+1)
+	var iter norm.Iter
+	iter.InitString(norm.NFKC, text)
+	for !iter.Done() {
+		offset := offsets[iter.Pos()]
+		segment := iter.Next()
+		builder.Write(segment)
+		for range segment {
+			filteredOffsets = append(filteredOffsets, offset)
+		}
+	}
+	filteredOffsets = append(filteredOffsets, offsets[len(text)])
+	return builder.String(), filteredOffsets
+}
+
+// 按映射表替换字符，比如将繁体字转换为简体字
+type CharMappingFilter struct {
+	mapping map[rune]rune
+}
+
+// 从mappingFile中读入字符映射，每行为空格分隔的两个字符，比如
+//
+//	國 国
+//
+// data/traditional_to_simplified.txt为常用繁体字到简体字的映射
+func LoadCharMappingFilter(mappingFile string) (*CharMappingFilter, error) {
+	file, err := os.Open(mappingFile)
+	if err != nil {
+		return nil, fmt.Errorf("无法载入字符映射文件\"%s\": %w", mappingFile, err)
+	}
+	defer file.Close()
+
+	filter := &CharMappingFilter{mapping: make(map[rune]rune)}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 ||
+			utf8.RuneCountInString(fields[0]) != 1 || utf8.RuneCountInString(fields[1]) != 1 {
+			return nil, fmt.Errorf("字符映射文件\"%s\"第%d行格式错误", mappingFile, line)
+		}
+		from, _ := utf8.DecodeRuneInString(fields[0])
+		to, _ := utf8.DecodeRuneInString(fields[1])
+		filter.mapping[from] = to
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+func (filter *CharMappingFilter) FilterRune(r rune) rune {
+	if to, found := filter.mapping[r]; found {
+		return to
+	}
+	return r
+}
+
+// 将关键词转换为小写
+type LowercaseFilter struct{}
+
+func (LowercaseFilter) Filter(tokens []Token) []Token {
+	for i := range tokens {
+		tokens[i].Text = strings.ToLower(tokens[i].Text)
+	}
+	return tokens
+}
+
+// 提取英文单词的词干，比如"apples"变为"appl"，见PorterStem
+// 需要放在LowercaseFilter之后
+type PorterStemFilter struct{}
+
+func (PorterStemFilter) Filter(tokens []Token) []Token {
+	for i := range tokens {
+		tokens[i].Text = PorterStem(tokens[i].Text)
+	}
+	return tokens
+}
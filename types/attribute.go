@@ -0,0 +1,84 @@
+package types
+
+import (
+	"fmt"
+)
+
+// 文档的一个数值属性值，为整数或者浮点数
+type AttributeValue struct {
+	IsFloat bool
+	Int     int64
+	Float   float64
+}
+
+// 将整数或者浮点数转换为AttributeValue，其它类型返回ErrInvalidAttribute
+func NewAttributeValue(value interface{}) (AttributeValue, error) {
+	switch v := value.(type) {
+	case int:
+		return AttributeValue{Int: int64(v)}, nil
+	case int8:
+		return AttributeValue{Int: int64(v)}, nil
+	case int16:
+		return AttributeValue{Int: int64(v)}, nil
+	case int32:
+		return AttributeValue{Int: int64(v)}, nil
+	case int64:
+		return AttributeValue{Int: v}, nil
+	case uint8:
+		return AttributeValue{Int: int64(v)}, nil
+	case uint16:
+		return AttributeValue{Int: int64(v)}, nil
+	case uint32:
+		return AttributeValue{Int: int64(v)}, nil
+	case float32:
+		return AttributeValue{IsFloat: true, Float: float64(v)}, nil
+	case float64:
+		return AttributeValue{IsFloat: true, Float: v}, nil
+	}
+	return AttributeValue{}, fmt.Errorf("%w：%T", ErrInvalidAttribute, value)
+}
+
+// 比较两个属性值，小于、等于、大于other时分别返回-1、0、1
+// 两个都是整数时精确比较，否则转换为浮点数比较
+func (value AttributeValue) Compare(other AttributeValue) int {
+	if !value.IsFloat && !other.IsFloat {
+		switch {
+		case value.Int < other.Int:
+			return -1
+		case value.Int > other.Int:
+			return 1
+		}
+		return 0
+	}
+	a, b := value.toFloat(), other.toFloat()
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func (value AttributeValue) toFloat() float64 {
+	if value.IsFloat {
+		return value.Float
+	}
+	return float64(value.Int)
+}
+
+// 检查文档属性，返回转换后的属性值
+func NewAttributeValues(attributes map[string]interface{}) (map[string]AttributeValue, error) {
+	if len(attributes) == 0 {
+		return nil, nil
+	}
+	values := make(map[string]AttributeValue, len(attributes))
+	for name, attribute := range attributes {
+		value, err := NewAttributeValue(attribute)
+		if err != nil {
+			return nil, fmt.Errorf("属性\"%s\"：%w", name, err)
+		}
+		values[name] = value
+	}
+	return values, nil
+}
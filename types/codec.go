@@ -0,0 +1,331 @@
+package types
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// 持久存储中文档数据（DocumentIndexData）的编码方式，见EngineInitOptions.Codec
+//
+// 引擎在编码结果前面加上格式头（格式版本和编码方式的编号），读取时按编号选择解码方式，
+// 因此更换编码方式之后以前写入的文档仍然可以读出。Encode和Decode会被多个线程同时调用。
+type Codec interface {
+	// 编码方式的编号。内置的GobCodec、JSONCodec和BinaryCodec分别为1、2、3，
+	// 自定义的编码方式请使用128到255
+	ID() byte
+
+	Encode(data *DocumentIndexData) ([]byte, error)
+	Decode(b []byte, data *DocumentIndexData) error
+}
+
+// 内置编码方式的编号
+const (
+	GobCodecID    = 1
+	JSONCodecID   = 2
+	BinaryCodecID = 3
+)
+
+// 用gob编码，引擎默认使用这种编码方式
+// 评分字段的类型必须用gob.Register注册，并且类型改名后无法解码以前写入的文档
+type GobCodec struct{}
+
+func (GobCodec) ID() byte {
+	return GobCodecID
+}
+
+func (GobCodec) Encode(data *DocumentIndexData) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Decode(b []byte, data *DocumentIndexData) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(data)
+}
+
+// 用JSON编码，评分字段按字段名编码，和类型名无关
+type JSONCodec struct {
+	// 返回评分字段类型的指针，比如func() interface{} { return &MyFields{} }，解码得到的评分
+	// 字段为该指针指向的值。为nil时评分字段解码为map[string]interface{}等JSON的默认类型
+	NewFields func() interface{}
+}
+
+func (JSONCodec) ID() byte {
+	return JSONCodecID
+}
+
+func (JSONCodec) Encode(data *DocumentIndexData) ([]byte, error) {
+	return json.Marshal(data)
+}
+
+func (codec JSONCodec) Decode(b []byte, data *DocumentIndexData) error {
+	var raw struct {
+		Content    string
+		Tokens     []TokenData
+		Labels     []string
+		Fields     json.RawMessage
+		Attributes map[string]json.Number
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	*data = DocumentIndexData{Content: raw.Content, Tokens: raw.Tokens, Labels: raw.Labels}
+
+	if len(raw.Fields) > 0 && string(raw.Fields) != "null" {
+		if codec.NewFields != nil {
+			fields := codec.NewFields()
+			if err := json.Unmarshal(raw.Fields, fields); err != nil {
+				return err
+			}
+			data.Fields = reflect.ValueOf(fields).Elem().Interface()
+		} else if err := json.Unmarshal(raw.Fields, &data.Fields); err != nil {
+			return err
+		}
+	}
+
+	// 整数属性解码为int64，其它为float64
+	if raw.Attributes != nil {
+		data.Attributes = make(map[string]interface{}, len(raw.Attributes))
+		for name, number := range raw.Attributes {
+			if value, err := number.Int64(); err == nil {
+				data.Attributes[name] = value
+			} else if value, err := number.Float64(); err == nil {
+				data.Attributes[name] = value
+			} else {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 类似protobuf的二进制编码：每个字段为字段编号和类型（varint）加上字段值，解码时跳过不认识的
+// 字段，因此以后增加字段不影响读取以前写入的文档
+//
+// 评分字段必须实现encoding.BinaryMarshaler，编码和类型名无关。
+type BinaryCodec struct {
+	// 返回评分字段类型的指针，该指针必须实现encoding.BinaryUnmarshaler，解码得到的评分字段
+	// 为该指针指向的值。文档没有评分字段时可以为nil
+	NewFields func() interface{}
+}
+
+// BinaryCodec的字段类型
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// BinaryCodec中DocumentIndexData的字段编号
+const (
+	binaryContent   = 1
+	binaryToken     = 2
+	binaryLabel     = 3
+	binaryFields    = 4
+	binaryAttribute = 5
+)
+
+// BinaryCodec中TokenData和属性的字段编号
+const (
+	binaryTokenText = 1
+	binaryLocation  = 2
+
+	binaryAttributeName  = 1
+	binaryAttributeInt   = 2
+	binaryAttributeFloat = 3
+)
+
+type binaryEncoder struct {
+	b      []byte
+	buffer [binary.MaxVarintLen64]byte
+}
+
+func (e *binaryEncoder) uvarint(value uint64) {
+	e.b = append(e.b, e.buffer[:binary.PutUvarint(e.buffer[:], value)]...)
+}
+
+func (e *binaryEncoder) tag(field, wire int) {
+	e.uvarint(uint64(field<<3 | wire))
+}
+
+func (e *binaryEncoder) bytes(field int, value []byte) {
+	e.tag(field, wireBytes)
+	e.uvarint(uint64(len(value)))
+	e.b = append(e.b, value...)
+}
+
+func (e *binaryEncoder) varint(field int, value int64) {
+	e.tag(field, wireVarint)
+	e.b = append(e.b, e.buffer[:binary.PutVarint(e.buffer[:], value)]...)
+}
+
+func (e *binaryEncoder) float64(field int, value float64) {
+	e.tag(field, wireFixed64)
+	binary.LittleEndian.PutUint64(e.buffer[:], math.Float64bits(value))
+	e.b = append(e.b, e.buffer[:8]...)
+}
+
+func (BinaryCodec) ID() byte {
+	return BinaryCodecID
+}
+
+func (BinaryCodec) Encode(data *DocumentIndexData) ([]byte, error) {
+	var e binaryEncoder
+	if data.Content != "" {
+		e.bytes(binaryContent, []byte(data.Content))
+	}
+	for _, token := range data.Tokens {
+		var t binaryEncoder
+		t.bytes(binaryTokenText, []byte(token.Text))
+		for _, location := range token.Locations {
+			t.varint(binaryLocation, int64(location))
+		}
+		e.bytes(binaryToken, t.b)
+	}
+	for _, label := range data.Labels {
+		e.bytes(binaryLabel, []byte(label))
+	}
+	if data.Fields != nil {
+		marshaler, ok := data.Fields.(encoding.BinaryMarshaler)
+		if !ok {
+			return nil, fmt.Errorf("评分字段%T没有实现encoding.BinaryMarshaler", data.Fields)
+		}
+		fields, err := marshaler.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		e.bytes(binaryFields, fields)
+	}
+	for name, value := range data.Attributes {
+		attribute, err := NewAttributeValue(value)
+		if err != nil {
+			return nil, err
+		}
+		var a binaryEncoder
+		a.bytes(binaryAttributeName, []byte(name))
+		if attribute.IsFloat {
+			a.float64(binaryAttributeFloat, attribute.Float)
+		} else {
+			a.varint(binaryAttributeInt, attribute.Int)
+		}
+		e.bytes(binaryAttribute, a.b)
+	}
+	return e.b, nil
+}
+
+var errBinaryTruncated = errors.New("数据不完整")
+
+// 依次读出每个字段，value为varint（wireVarint）、8字节（wireFixed64）或者字段内容（wireBytes）
+func readBinaryFields(b []byte, fn func(field, wire int, value []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errBinaryTruncated
+		}
+		b = b[n:]
+		field, wire := int(tag>>3), int(tag&7)
+		var value []byte
+		switch wire {
+		case wireVarint:
+			_, n = binary.Varint(b)
+			if n <= 0 {
+				return errBinaryTruncated
+			}
+			value, b = b[:n], b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return errBinaryTruncated
+			}
+			value, b = b[:8], b[8:]
+		case wireBytes:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || length > uint64(len(b)-n) {
+				return errBinaryTruncated
+			}
+			value, b = b[n:n+int(length)], b[n+int(length):]
+		default:
+			return fmt.Errorf("未知的字段类型%d", wire)
+		}
+		if err := fn(field, wire, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (codec BinaryCodec) Decode(b []byte, data *DocumentIndexData) error {
+	*data = DocumentIndexData{}
+	return readBinaryFields(b, func(field, wire int, value []byte) error {
+		if wire != wireBytes {
+			return nil
+		}
+		switch field {
+		case binaryContent:
+			data.Content = string(value)
+		case binaryToken:
+			var token TokenData
+			err := readBinaryFields(value, func(field, wire int, value []byte) error {
+				switch {
+				case field == binaryTokenText && wire == wireBytes:
+					token.Text = string(value)
+				case field == binaryLocation && wire == wireVarint:
+					location, _ := binary.Varint(value)
+					token.Locations = append(token.Locations, int(location))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			data.Tokens = append(data.Tokens, token)
+		case binaryLabel:
+			data.Labels = append(data.Labels, string(value))
+		case binaryFields:
+			if codec.NewFields == nil {
+				return errors.New("解码评分字段需要设置BinaryCodec.NewFields")
+			}
+			fields := codec.NewFields()
+			unmarshaler, ok := fields.(encoding.BinaryUnmarshaler)
+			if !ok {
+				return fmt.Errorf("评分字段%T没有实现encoding.BinaryUnmarshaler", fields)
+			}
+			if err := unmarshaler.UnmarshalBinary(value); err != nil {
+				return err
+			}
+			data.Fields = reflect.ValueOf(fields).Elem().Interface()
+		case binaryAttribute:
+			var name string
+			var attribute interface{}
+			err := readBinaryFields(value, func(field, wire int, value []byte) error {
+				switch {
+				case field == binaryAttributeName && wire == wireBytes:
+					name = string(value)
+				case field == binaryAttributeInt && wire == wireVarint:
+					attribute, _ = binary.Varint(value)
+				case field == binaryAttributeFloat && wire == wireFixed64:
+					attribute = math.Float64frombits(binary.LittleEndian.Uint64(value))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if attribute != nil {
+				if data.Attributes == nil {
+					data.Attributes = make(map[string]interface{})
+				}
+				data.Attributes[name] = attribute
+			}
+		}
+		return nil
+	})
+}
@@ -15,6 +15,18 @@ type DocumentIndexData struct {
 
 	// 文档的评分字段，可以接纳任何类型的结构体
 	Fields interface{}
+
+	// 文档的数值属性，用于SearchRequest.Filters的过滤
+	// 值只能是整数（int、int32、int64等）或者浮点数（float32、float64）
+	Attributes map[string]interface{}
+}
+
+// 批量索引的一个文档，见Engine.IndexDocuments
+type IndexItem struct {
+	// 文档编号，必须大于0
+	DocId uint64
+
+	Data DocumentIndexData
 }
 
 // 文档的一个关键词
@@ -1,7 +1,7 @@
 package types
 
 import (
-	"log"
+	"fmt"
 	"runtime"
 
 	"github.com/huichen/sego"
@@ -27,25 +27,48 @@ var (
 		B:  0.75,
 	}
 	defaultPersistentStorageShards = 8
+	defaultWALCheckpointSize       = int64(64 << 20)
+	defaultSynonymWeight           = float32(0.8)
 )
 
 type EngineInitOptions struct {
 	// 是否使用分词器
-	// 默认使用，否则在启动阶段跳过SegmenterDictionaries和StopTokenFile设置
+	// 默认使用，否则在启动阶段跳过Tokenizer、Segmenter、SegmenterDictionaries和StopTokenFile设置
 	// 如果你不需要在引擎内分词，可以将这个选项设为true
-	// 注意，如果你不用分词器，那么在调用IndexDocument时DocumentIndexData中的Content会被忽略
+	// 注意，如果你不用分词器，那么在调用IndexDocument时DocumentIndexData中的Content会被忽略，
+	// 搜索时也不对SearchRequest.Text和Query中的文本分词
 	NotUsingSegmenter bool
 
+	// 自定义的分词器，索引和搜索时都用它分词
+	// 为 nil 时使用sego分词：优先使用下面外部传入的 Segmenter，否则从字典文件载入
+	Tokenizer Tokenizer
+
 	// 尝试使用外部传入的 segmenter，如果为 nil 则使用下面的字典文件
 	Segmenter *sego.Segmenter
 	// 半角逗号分隔的字典文件，具体用法见
 	// sego.Segmenter.LoadDictionary函数的注释
 	SegmenterDictionaries string
 
+	// 分词前后对文本和关键词的处理，比如转换全角字符、繁体字和大小写，见analyzer.go
+	// 索引和搜索时同样处理，停用词在这些处理之后剔除
+	CharFilters  []CharFilter
+	TokenFilters []TokenFilter
+
+	// 只在索引时使用的关键词过滤器，在上面的处理和剔除停用词之后执行，用于为文档增加额外的
+	// 关键词，比如PinyinFilter。增加的关键词不计入文档的关键词长度
+	IndexTokenFilters []TokenFilter
+
 	// 停用词文件，如果为 nil 则尝试从下面的文件载入
 	StopTokens    *StopTokens
 	StopTokenFile string
 
+	// 同义词，如果为 nil 则尝试从下面的文件载入，文件为空时不扩展同义词
+	Synonyms    *Synonyms
+	SynonymFile string
+
+	// 同义词匹配在BM25中的权重，默认为0.8，即同义词匹配的得分略低于原词匹配
+	SynonymWeight float32
+
 	// 分词器线程数
 	NumSegmenterThreads int
 
@@ -75,13 +98,34 @@ type EngineInitOptions struct {
 	UsePersistentStorage    bool
 	PersistentStorageFolder string
 	PersistentStorageShards int
+
+	// 使用持久存储时是否打开预写日志（write-ahead log）。写操作（IndexDocument、IndexDocuments、
+	// RemoveDocument和UpdateFields）先按顺序写入日志再返回，引擎崩溃后在Init时按顺序重放日志，
+	// 恢复的索引正好包含全部已经返回的写操作。打开后写操作会串行执行
+	UseWAL bool
+
+	// 为true时写日志后不调用fsync：进程崩溃不会丢失写操作，但操作系统崩溃或者断电时可能丢失
+	// 最近的写操作
+	WALNoSync bool
+
+	// 预写日志超过这个字节数时，写操作返回前等待持久存储执行完日志中的全部操作并清空日志，
+	// 避免日志无限增长。默认为64MB
+	WALCheckpointSize int64
+
+	// 使用持久存储时的快照文件。Close将索引写入快照，下次Init时直接载入快照，不再对持久存储
+	// 中的文档重新分词。快照载入后即被删除，因此引擎没有正常关闭时仍然从持久存储恢复。
+	// 为空时不使用快照
+	SnapshotFile string
+
+	// 持久存储中文档数据的编码方式，默认为GobCodec
+	Codec Codec
 }
 
 // 初始化EngineInitOptions，当用户未设定某个选项的值时用默认值取代
-func (options *EngineInitOptions) Init() {
+func (options *EngineInitOptions) Init() error {
 	if !options.NotUsingSegmenter {
-		if options.Segmenter == nil && options.SegmenterDictionaries == "" {
-			log.Fatal("字典文件不能为空")
+		if options.Tokenizer == nil && options.Segmenter == nil && options.SegmenterDictionaries == "" {
+			return fmt.Errorf("%w：字典文件不能为空", ErrDictionaryNotFound)
 		}
 	}
 
@@ -125,7 +169,20 @@ func (options *EngineInitOptions) Init() {
 		options.DefaultRankOptions.ScoringCriteria = defaultDefaultRankOptions.ScoringCriteria
 	}
 
+	if options.SynonymWeight == 0 {
+		options.SynonymWeight = defaultSynonymWeight
+	}
+
 	if options.PersistentStorageShards == 0 {
 		options.PersistentStorageShards = defaultPersistentStorageShards
 	}
+
+	if options.WALCheckpointSize == 0 {
+		options.WALCheckpointSize = defaultWALCheckpointSize
+	}
+
+	if options.Codec == nil {
+		options.Codec = GobCodec{}
+	}
+	return nil
 }
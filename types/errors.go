@@ -0,0 +1,47 @@
+package types
+
+import (
+	"errors"
+)
+
+// 悟空返回的错误，可以用errors.Is判断
+var (
+	// 引擎、索引器或者排序器尚未初始化
+	ErrNotInitialized = errors.New("尚未初始化")
+
+	// 引擎、索引器或者排序器不能初始化两次
+	ErrAlreadyInitialized = errors.New("不能重复初始化")
+
+	// 引擎已经关闭
+	ErrClosed = errors.New("引擎已关闭")
+
+	// 无法载入分词器词典
+	ErrDictionaryNotFound = errors.New("无法载入字典文件")
+
+	// 无法载入停用词文件
+	ErrStopTokenFileNotFound = errors.New("无法载入停用词文件")
+
+	// 无法载入同义词文件
+	ErrSynonymFileNotFound = errors.New("无法载入同义词文件")
+
+	// 没有启用持久存储（见EngineInitOptions.UsePersistentStorage）
+	ErrPersistentStorageDisabled = errors.New("没有启用持久存储")
+
+	// 持久存储中没有该文档
+	ErrDocumentNotFound = errors.New("文档不存在")
+
+	// 批量索引的文档编号为0
+	ErrInvalidDocId = errors.New("文档编号必须大于0")
+
+	// 持久存储中的文档无法编码或者解码，见EngineInitOptions.Codec
+	ErrDocumentCodec = errors.New("文档编码或者解码失败")
+
+	// 写入持久存储失败，见Engine.NumStorageErrors
+	ErrStorageWrite = errors.New("持久存储写入失败")
+
+	// 快照已损坏，或者和引擎的设置（分片数、索引类型等）不一致
+	ErrInvalidSnapshot = errors.New("快照无效")
+
+	// 文档属性或者过滤条件的值不是整数或者浮点数
+	ErrInvalidAttribute = errors.New("属性值必须是整数或者浮点数")
+)
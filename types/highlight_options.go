@@ -0,0 +1,16 @@
+package types
+
+// 高亮选项，见Engine.Highlight
+type HighlightOptions struct {
+	// 插入在关键词前后的标签，都为空时为"<em>"和"</em>"
+	PreTag, PostTag string
+
+	// 每个片段的长度，单位为字符（而非字节），为0时为100
+	FragmentSize int
+
+	// 最多返回多少个片段，为0时为1
+	NumFragments int
+
+	// 为true时对片段中的文本做HTML转义，插入的标签不转义
+	EscapeHTML bool
+}
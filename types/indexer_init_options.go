@@ -26,6 +26,9 @@ type IndexerInitOptions struct {
 
 	// BM25参数
 	BM25Parameters *BM25Parameters
+
+	// 是否压缩反向索引表，压缩后占用内存更少，但查找时需要解码，索引和查找会变慢
+	CompressPostings bool
 }
 
 // 见http://en.wikipedia.org/wiki/Okapi_BM25
@@ -0,0 +1,7 @@
+package types
+
+// 搜索键和含有它的文档数，见Engine.Suggest
+type KeywordCount struct {
+	Keyword string
+	NumDocs int
+}
@@ -0,0 +1,160 @@
+package types
+
+import (
+	_ "embed"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PinyinFilter生成的拼音关键词的前缀，用来和原关键词区分
+const PinyinPrefix = "pinyin:"
+
+// 常用汉字（U+4E00至U+9FA5）的拼音表，每行为一个拼音和读这个音的全部汉字
+// 拼音不带声调，ü写作v（lue、nue除外），多音字只收录最常用的读音
+// 由ICU的Han-Latin转换生成
+//
+//go:embed pinyin_dict.txt
+var pinyinDictData string
+
+var (
+	pinyinDict     map[rune]string
+	pinyinDictOnce sync.Once
+)
+
+func loadPinyinDict() {
+	pinyinDict = make(map[rune]string)
+	for _, line := range strings.Split(pinyinDictData, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		for _, r := range fields[1] {
+			pinyinDict[r] = fields[0]
+		}
+	}
+}
+
+// 返回汉字的拼音，不是汉字或者拼音表中没有时返回空字符串
+func Pinyin(r rune) string {
+	pinyinDictOnce.Do(loadPinyinDict)
+	return pinyinDict[r]
+}
+
+// 将文本转换为全拼和拼音首字母，比如"北京"返回"beijing"和"bj"
+// 英文字母转为小写，数字保留，其它字符忽略。文本中没有汉字时ok为false
+func ToPinyin(text string) (full string, initials string, ok bool) {
+	var fullBuilder, initialsBuilder strings.Builder
+	for _, r := range text {
+		if pinyin := Pinyin(r); pinyin != "" {
+			fullBuilder.WriteString(pinyin)
+			initialsBuilder.WriteByte(pinyin[0])
+			ok = true
+		} else if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			r = unicode.ToLower(r)
+			fullBuilder.WriteRune(r)
+			initialsBuilder.WriteRune(r)
+		}
+	}
+	return fullBuilder.String(), initialsBuilder.String(), ok
+}
+
+// PinyinFilter为一个关键词生成拼音关键词时，连续片段最多包含的音节数，整个关键词总是生成
+const maxPinyinSpan = 4
+
+// 为含有汉字的关键词增加拼音关键词，用于拼音搜索（见SearchRequest.Pinyin）
+//
+// 含有汉字的关键词中每个汉字为一个音节，连续的英文字母和数字为一个整体。对关键词中每个不超过
+// maxPinyinSpan个音节的连续片段（以及整个关键词）增加全拼和拼音首字母两个关键词，
+// 位置为片段在文本中的位置。比如"北京大学"增加"pinyin:beijingdaxue"、"pinyin:bjdx"、
+// "pinyin:beijing"、"pinyin:bj"、"pinyin:daxue"、"pinyin:bei"、"pinyin:b"等，因此
+// 即使"北京大学"被分为一个词，也可以用"beijing"或者"bj"搜到。应当放在
+// EngineInitOptions.IndexTokenFilters中，只在索引时使用。
+type PinyinFilter struct{}
+
+// 关键词中的一个音节，start和end为在文本中的字节位置
+type pinyinSyllable struct {
+	full, initial string
+	start, end    int
+}
+
+func (PinyinFilter) Filter(tokens []Token) []Token {
+	n := len(tokens)
+	for i := 0; i < n; i++ {
+		syllables, ok := pinyinSyllables(tokens[i])
+		if !ok {
+			continue
+		}
+		added := make(map[Token]bool)
+		for first := range syllables {
+			var full, initials strings.Builder
+			for last := first; last < len(syllables); last++ {
+				full.WriteString(syllables[last].full)
+				initials.WriteString(syllables[last].initial)
+				if last-first >= maxPinyinSpan {
+					// 超过长度的片段只保留整个关键词
+					if first > 0 {
+						break
+					}
+					if last < len(syllables)-1 {
+						continue
+					}
+				}
+				for _, text := range []string{full.String(), initials.String()} {
+					token := Token{
+						Text:  PinyinPrefix + text,
+						Start: syllables[first].start,
+						End:   syllables[last].end,
+					}
+					if !added[token] {
+						added[token] = true
+						tokens = append(tokens, token)
+					}
+				}
+			}
+		}
+	}
+	return tokens
+}
+
+// 将关键词切分为音节，忽略汉字、英文字母和数字以外的字符。关键词中没有汉字时ok为false
+func pinyinSyllables(token Token) (syllables []pinyinSyllable, ok bool) {
+	ascii := false
+	for offset, r := range token.Text {
+		start := token.Start + offset
+		end := start + utf8.RuneLen(r)
+		if pinyin := Pinyin(r); pinyin != "" {
+			syllables = append(syllables, pinyinSyllable{pinyin, pinyin[:1], start, end})
+			ascii = false
+			ok = true
+		} else if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			text := string(unicode.ToLower(r))
+			if ascii {
+				last := &syllables[len(syllables)-1]
+				last.full += text
+				last.initial = last.full
+				last.end = end
+			} else {
+				syllables = append(syllables, pinyinSyllable{text, text, start, end})
+			}
+			ascii = true
+		} else {
+			ascii = false
+		}
+	}
+	return syllables, ok
+}
+
+// 将用户输入的拼音（全拼或者首字母）转换为拼音关键词，空格分隔的每个词为一个关键词
+// 比如"Beijing daxue"返回["pinyin:beijing" "pinyin:daxue"]
+func PinyinKeywords(text string) []string {
+	keywords := []string{}
+	for _, word := range strings.Fields(text) {
+		full, _, _ := ToPinyin(word)
+		if full != "" {
+			keywords = append(keywords, PinyinPrefix+full)
+		}
+	}
+	return keywords
+}
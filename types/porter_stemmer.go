@@ -0,0 +1,236 @@
+package types
+
+// Porter词干提取算法，见 https://tartarus.org/martin/PorterStemmer/
+//
+// 只处理小写英文字母组成的单词，其它字符串原样返回。
+func PorterStem(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	for i := 0; i < len(word); i++ {
+		if word[i] < 'a' || word[i] > 'z' {
+			return word
+		}
+	}
+
+	s := &porterStemmer{b: []byte(word)}
+	s.step1ab()
+	if len(s.b) > 1 {
+		s.step1c()
+		s.step2()
+		s.step3()
+		s.step4()
+		s.step5()
+	}
+	return string(s.b)
+}
+
+type porterStemmer struct {
+	b []byte
+}
+
+// b[i]是否为辅音
+func (s *porterStemmer) cons(i int) bool {
+	switch s.b[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !s.cons(i-1)
+	}
+	return true
+}
+
+// b[:end]中辅音-元音序列的个数，即
+//
+//	[C](VC){m}[V]
+//
+// 中的m
+func (s *porterStemmer) measure(end int) int {
+	n, i := 0, 0
+	for i < end && s.cons(i) {
+		i++
+	}
+	for i < end {
+		for i < end && !s.cons(i) {
+			i++
+		}
+		if i >= end {
+			break
+		}
+		n++
+		for i < end && s.cons(i) {
+			i++
+		}
+	}
+	return n
+}
+
+// b[:end]中是否含有元音
+func (s *porterStemmer) vowelInStem(end int) bool {
+	for i := 0; i < end; i++ {
+		if !s.cons(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// b[i-1:i+1]是否为两个相同的辅音
+func (s *porterStemmer) doubleCons(i int) bool {
+	return i >= 1 && s.b[i] == s.b[i-1] && s.cons(i)
+}
+
+// b[i-2:i+1]是否为辅音-元音-辅音，且最后的辅音不是w、x或者y
+func (s *porterStemmer) cvc(i int) bool {
+	if i < 2 || !s.cons(i) || s.cons(i-1) || !s.cons(i-2) {
+		return false
+	}
+	switch s.b[i] {
+	case 'w', 'x', 'y':
+		return false
+	}
+	return true
+}
+
+func (s *porterStemmer) ends(suffix string) bool {
+	return len(s.b) >= len(suffix) && string(s.b[len(s.b)-len(suffix):]) == suffix
+}
+
+// 将后缀suffix替换为replacement
+func (s *porterStemmer) replace(suffix, replacement string) {
+	s.b = append(s.b[:len(s.b)-len(suffix)], replacement...)
+}
+
+// 一组后缀替换规则，按顺序找到第一个匹配的后缀，词干满足条件时替换
+type porterRule struct {
+	suffix, replacement string
+}
+
+func (s *porterStemmer) applyRules(rules []porterRule, minMeasure int) {
+	for _, rule := range rules {
+		if s.ends(rule.suffix) {
+			if s.measure(len(s.b)-len(rule.suffix)) > minMeasure {
+				s.replace(rule.suffix, rule.replacement)
+			}
+			return
+		}
+	}
+}
+
+// 去掉复数和-ed、-ing
+func (s *porterStemmer) step1ab() {
+	if s.b[len(s.b)-1] == 's' {
+		if s.ends("sses") {
+			s.replace("sses", "ss")
+		} else if s.ends("ies") {
+			s.replace("ies", "i")
+		} else if s.b[len(s.b)-2] != 's' {
+			s.b = s.b[:len(s.b)-1]
+		}
+	}
+
+	if s.ends("eed") {
+		if s.measure(len(s.b)-3) > 0 {
+			s.b = s.b[:len(s.b)-1]
+		}
+		return
+	}
+	var suffix string
+	if s.ends("ed") {
+		suffix = "ed"
+	} else if s.ends("ing") {
+		suffix = "ing"
+	} else {
+		return
+	}
+	if !s.vowelInStem(len(s.b) - len(suffix)) {
+		return
+	}
+	s.b = s.b[:len(s.b)-len(suffix)]
+	switch {
+	case s.ends("at"):
+		s.replace("at", "ate")
+	case s.ends("bl"):
+		s.replace("bl", "ble")
+	case s.ends("iz"):
+		s.replace("iz", "ize")
+	case s.doubleCons(len(s.b) - 1):
+		switch s.b[len(s.b)-1] {
+		case 'l', 's', 'z':
+		default:
+			s.b = s.b[:len(s.b)-1]
+		}
+	case s.measure(len(s.b)) == 1 && s.cvc(len(s.b)-1):
+		s.b = append(s.b, 'e')
+	}
+}
+
+// 词干中有元音时将结尾的y变为i
+func (s *porterStemmer) step1c() {
+	if s.ends("y") && s.vowelInStem(len(s.b)-1) {
+		s.b[len(s.b)-1] = 'i'
+	}
+}
+
+var porterStep2Rules = []porterRule{
+	{"ational", "ate"}, {"tional", "tion"},
+	{"enci", "ence"}, {"anci", "ance"},
+	{"izer", "ize"},
+	{"abli", "able"}, {"alli", "al"}, {"entli", "ent"}, {"eli", "e"}, {"ousli", "ous"},
+	{"ization", "ize"}, {"ation", "ate"}, {"ator", "ate"},
+	{"alism", "al"}, {"iveness", "ive"}, {"fulness", "ful"}, {"ousness", "ous"},
+	{"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"},
+}
+
+// 将双重后缀变为单一后缀
+func (s *porterStemmer) step2() {
+	s.applyRules(porterStep2Rules, 0)
+}
+
+var porterStep3Rules = []porterRule{
+	{"icate", "ic"}, {"ative", ""}, {"alize", "al"},
+	{"iciti", "ic"},
+	{"ical", "ic"}, {"ful", ""},
+	{"ness", ""},
+}
+
+func (s *porterStemmer) step3() {
+	s.applyRules(porterStep3Rules, 0)
+}
+
+var porterStep4Suffixes = []string{
+	"al", "ance", "ence", "er", "ic", "able", "ible", "ant", "ement", "ment", "ent",
+	"ion", "ou", "ism", "ate", "iti", "ous", "ive", "ize",
+}
+
+// 词干足够长时去掉-ant、-ence等后缀
+func (s *porterStemmer) step4() {
+	for _, suffix := range porterStep4Suffixes {
+		if !s.ends(suffix) {
+			continue
+		}
+		end := len(s.b) - len(suffix)
+		if suffix == "ion" && (end == 0 || (s.b[end-1] != 's' && s.b[end-1] != 't')) {
+			continue
+		}
+		if s.measure(end) > 1 {
+			s.b = s.b[:end]
+		}
+		return
+	}
+}
+
+// 去掉结尾的e，并将结尾的ll变为l
+func (s *porterStemmer) step5() {
+	last := len(s.b) - 1
+	if s.b[last] == 'e' {
+		m := s.measure(last)
+		if m > 1 || (m == 1 && !s.cvc(last-1)) {
+			s.b = s.b[:last]
+		}
+	}
+	last = len(s.b) - 1
+	if s.b[last] == 'l' && s.doubleCons(last) && s.measure(len(s.b)) > 1 {
+		s.b = s.b[:last]
+	}
+}
@@ -0,0 +1,224 @@
+package types
+
+import (
+	"sort"
+)
+
+// 查询语法树的节点
+//
+// 查询由TermQuery、LabelQuery、PrefixQuery、FuzzyQuery、PhraseQuery五种叶子节点和AndQuery、OrQuery、NotQuery三种组合
+// 节点构成。可以手工构造，也可以用ParseQuery从查询字符串解析得到。
+// 注意节点均以值（而非指针）的形式使用。
+type Query interface {
+	isQuery()
+}
+
+// 关键词节点
+// 搜索时Text会被分词，参与BM25和紧邻距离的计算
+type TermQuery struct {
+	Text string
+
+	// 关键词在BM25中的权重，为0时视为1
+	// 同义词扩展得到的关键词权重为EngineInitOptions.SynonymWeight
+	Weight float32
+}
+
+// 标签节点
+// 标签不分词，也不参与BM25和紧邻距离的计算
+type LabelQuery struct {
+	Label string
+}
+
+// 前缀节点：匹配以Prefix开头的搜索键，比如搜索框的输入提示
+// Prefix不分词，应当是索引中搜索键的形式（比如使用了LowercaseFilter时应当是小写）。
+// 匹配的搜索键很多时只保留全部分片中文档频率最高的MaxPrefixExpansions个
+type PrefixQuery struct {
+	Prefix string
+}
+
+// 一个PrefixQuery最多扩展为多少个搜索键
+const MaxPrefixExpansions = 64
+
+// 将前缀匹配的搜索键及其文档频率扩展为OrQuery，超过MaxPrefixExpansions个时保留文档频率最高的
+// 搜索键按字典序排列，使各个分片使用同样的扩展结果时关键词的顺序一致
+func ExpandPrefixKeywords(frequencies map[string]int) Query {
+	keywords := make([]string, 0, len(frequencies))
+	for keyword := range frequencies {
+		keywords = append(keywords, keyword)
+	}
+	if len(keywords) > MaxPrefixExpansions {
+		sort.Slice(keywords, func(i, j int) bool {
+			if frequencies[keywords[i]] != frequencies[keywords[j]] {
+				return frequencies[keywords[i]] > frequencies[keywords[j]]
+			}
+			return keywords[i] < keywords[j]
+		})
+		keywords = keywords[:MaxPrefixExpansions]
+	}
+	sort.Strings(keywords)
+
+	or := OrQuery{}
+	for _, keyword := range keywords {
+		or.Queries = append(or.Queries, TermQuery{Text: keyword})
+	}
+	return or
+}
+
+// 模糊节点：匹配和Text的编辑距离（Levenshtein距离）不超过MaxDistance的搜索键，用于容错拼写
+// 错误的英文或者拼音
+//
+// 搜索时Text会被分词，每个关键词分别做模糊匹配。编辑距离为d的搜索键在BM25中的权重为
+// FuzzyWeight(d)，匹配的搜索键很多时只保留编辑距离最小的一部分，扩展结果见SearchResponse.Expansions
+type FuzzyQuery struct {
+	Text string
+
+	// 允许的最大编辑距离，最大为MaxFuzzyDistance，为0时等价于TermQuery
+	MaxDistance int
+}
+
+const (
+	// FuzzyQuery允许的最大编辑距离
+	MaxFuzzyDistance = 2
+
+	// 一个FuzzyQuery最多扩展为多少个搜索键
+	MaxFuzzyExpansions = 64
+)
+
+// 模糊匹配中编辑距离为distance的搜索键在BM25中的权重
+func FuzzyWeight(distance int) float32 {
+	return 1 / float32(1+distance)
+}
+
+// 由模糊匹配到的搜索键及其编辑距离得到FuzzyQuery的扩展结果
+//
+// 搜索键按编辑距离从小到大、再按字典序排序，最多保留MaxFuzzyExpansions个。返回保留的
+// 搜索键和它们的OrQuery，其中每个TermQuery的权重为FuzzyWeight(编辑距离)。
+func ExpandFuzzyKeywords(distances map[string]int) ([]string, Query) {
+	keywords := make([]string, 0, len(distances))
+	for keyword := range distances {
+		keywords = append(keywords, keyword)
+	}
+	sort.Slice(keywords, func(i, j int) bool {
+		if distances[keywords[i]] != distances[keywords[j]] {
+			return distances[keywords[i]] < distances[keywords[j]]
+		}
+		return keywords[i] < keywords[j]
+	})
+	if len(keywords) > MaxFuzzyExpansions {
+		keywords = keywords[:MaxFuzzyExpansions]
+	}
+
+	or := OrQuery{}
+	for _, keyword := range keywords {
+		or.Queries = append(or.Queries, TermQuery{Text: keyword, Weight: FuzzyWeight(distances[keyword])})
+	}
+	return keywords, or
+}
+
+// 短语节点：关键词必须在文档中按顺序紧邻出现
+//
+// 假定第i个关键词首字节出现在文本中的位置为P_i，长度L_i，文档满足短语查询当且仅当
+// 存在一组P_i使得每个间隔G_i = P_(i+1) - P_i - L_i >= 0，并且
+//
+//	Sum(Abs(G_i - Gaps[i])) <= Slop
+//
+// 短语查询需要关键词的位置信息，仅当索引类型为LocationsIndex时有效，其它索引类型下
+// 退化为关键词的与查询。
+type PhraseQuery struct {
+	// 短语文本，搜索时每个元素都会被分词，分词结果按顺序组成短语，多个元素之间视为紧邻
+	Terms []string
+
+	// 相邻关键词之间期望的字节间隔，长度为分词后关键词数减一，为nil时全部为0。
+	// 搜索时由分词结果自动计算（比如被剔除的停用词和空格所占的字节），一般不需要设置
+	Gaps []int
+
+	// 允许的误差，单位为字节，为0时要求关键词严格紧邻
+	Slop int
+}
+
+// 与：文档必须满足全部子查询
+type AndQuery struct {
+	Queries []Query
+}
+
+// 或：文档满足任一子查询即可
+type OrQuery struct {
+	Queries []Query
+}
+
+// 非：文档不能满足子查询
+type NotQuery struct {
+	Query Query
+}
+
+func (TermQuery) isQuery()   {}
+func (LabelQuery) isQuery()  {}
+func (PrefixQuery) isQuery() {}
+func (FuzzyQuery) isQuery()  {}
+func (PhraseQuery) isQuery() {}
+func (AndQuery) isQuery()    {}
+func (OrQuery) isQuery()     {}
+func (NotQuery) isQuery()    {}
+
+// 收集查询中参与评分的关键词，即不在NotQuery之下的TermQuery和PhraseQuery中的关键词
+// 返回的关键词已去重，并保持在查询中首次出现的顺序
+func CollectTerms(query Query) []string {
+	terms := []string{}
+	found := make(map[string]bool)
+	var collect func(q Query)
+	collect = func(q Query) {
+		switch q := q.(type) {
+		case TermQuery:
+			if !found[q.Text] {
+				found[q.Text] = true
+				terms = append(terms, q.Text)
+			}
+		case PhraseQuery:
+			for _, term := range q.Terms {
+				collect(TermQuery{Text: term})
+			}
+		case AndQuery:
+			for _, sub := range q.Queries {
+				collect(sub)
+			}
+		case OrQuery:
+			for _, sub := range q.Queries {
+				collect(sub)
+			}
+		}
+	}
+	collect(query)
+	return terms
+}
+
+// 收集查询中参与评分的关键词在BM25中的权重，同一关键词多次出现时取最大的权重
+func CollectTermWeights(query Query) map[string]float32 {
+	weights := make(map[string]float32)
+	var collect func(q Query)
+	collect = func(q Query) {
+		switch q := q.(type) {
+		case TermQuery:
+			weight := q.Weight
+			if weight == 0 {
+				weight = 1
+			}
+			if weight > weights[q.Text] {
+				weights[q.Text] = weight
+			}
+		case PhraseQuery:
+			for _, term := range q.Terms {
+				collect(TermQuery{Text: term})
+			}
+		case AndQuery:
+			for _, sub := range q.Queries {
+				collect(sub)
+			}
+		case OrQuery:
+			for _, sub := range q.Queries {
+				collect(sub)
+			}
+		}
+	}
+	collect(query)
+	return weights
+}
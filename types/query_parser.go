@@ -0,0 +1,358 @@
+package types
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// 查询字符串中标签的前缀，比如 label:百度
+const LabelQueryPrefix = "label:"
+
+// 从查询字符串解析出查询语法树
+//
+// 语法类似Lucene：
+//
+//	苹果 香蕉            空格分隔的子查询之间为与关系
+//	苹果 AND 香蕉        同上
+//	苹果 OR 香蕉         或关系，优先级低于与
+//	NOT 手机             非
+//	+苹果 -手机          +表示所在括号层级必须满足，-表示所在括号层级必须不满足
+//	(苹果 OR 香蕉) 水果  括号分组
+//	label:百度           标签
+//	苹果*                前缀，匹配以"苹果"开头的搜索键，见PrefixQuery
+//	iphnoe~2             模糊匹配，允许2个字符的编辑距离，见FuzzyQuery
+//	"苹果手机"           短语，关键词必须按顺序紧邻出现
+//	"苹果手机"~6         允许6个字节误差的短语，见PhraseQuery
+//
+// 因此"苹果 OR 香蕉 -手机"等价于"(苹果 OR 香蕉) AND NOT 手机"。
+// 用反斜杠可以转义上面的特殊字符。
+func ParseQuery(text string) (Query, error) {
+	lexer := queryLexer{input: []rune(text)}
+	tokens, err := lexer.lex()
+	if err != nil {
+		return nil, err
+	}
+	parser := queryParser{tokens: tokens}
+	query, err := parser.parseGroup()
+	if err != nil {
+		return nil, err
+	}
+	if parser.peek().kind != queryTokenEOF {
+		return nil, fmt.Errorf("查询语法错误：多余的\"%s\"", parser.peek().text)
+	}
+	if query == nil {
+		return nil, fmt.Errorf("查询语法错误：查询为空")
+	}
+	return query, nil
+}
+
+const (
+	queryTokenEOF = iota
+	queryTokenWord
+	queryTokenQuoted
+	queryTokenLabel
+	queryTokenPrefix
+	queryTokenFuzzy
+	queryTokenAnd
+	queryTokenOr
+	queryTokenNot
+	queryTokenMust
+	queryTokenMustNot
+	queryTokenLeftParen
+	queryTokenRightParen
+)
+
+type queryToken struct {
+	kind int
+	text string
+	slop int
+}
+
+type queryLexer struct {
+	input  []rune
+	cursor int
+}
+
+func (lexer *queryLexer) lex() (tokens []queryToken, err error) {
+	// 只有在词首的+和-才是修饰符
+	atWordStart := true
+	for lexer.cursor < len(lexer.input) {
+		r := lexer.input[lexer.cursor]
+		switch {
+		case unicode.IsSpace(r):
+			lexer.cursor++
+			atWordStart = true
+			continue
+		case r == '(':
+			tokens = append(tokens, queryToken{kind: queryTokenLeftParen, text: "("})
+			lexer.cursor++
+			atWordStart = true
+			continue
+		case r == ')':
+			tokens = append(tokens, queryToken{kind: queryTokenRightParen, text: ")"})
+			lexer.cursor++
+			atWordStart = true
+			continue
+		case atWordStart && r == '+':
+			tokens = append(tokens, queryToken{kind: queryTokenMust, text: "+"})
+			lexer.cursor++
+			continue
+		case atWordStart && r == '-':
+			tokens = append(tokens, queryToken{kind: queryTokenMustNot, text: "-"})
+			lexer.cursor++
+			continue
+		case r == '"':
+			text, err := lexer.readQuoted()
+			if err != nil {
+				return nil, err
+			}
+			slop, err := lexer.readSlop()
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, queryToken{kind: queryTokenQuoted, text: text, slop: slop})
+		default:
+			text, isPrefix := lexer.readWord()
+			isFuzzy := lexer.cursor < len(lexer.input) && lexer.input[lexer.cursor] == '~'
+			distance, err := lexer.readSlop()
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case isFuzzy:
+				if text == "" || isPrefix {
+					return nil, fmt.Errorf("查询语法错误：~前缺少关键词")
+				}
+				tokens = append(tokens, queryToken{kind: queryTokenFuzzy, text: text, slop: distance})
+			case text == "AND":
+				tokens = append(tokens, queryToken{kind: queryTokenAnd, text: text})
+			case text == "OR":
+				tokens = append(tokens, queryToken{kind: queryTokenOr, text: text})
+			case text == "NOT":
+				tokens = append(tokens, queryToken{kind: queryTokenNot, text: text})
+			case strings.HasPrefix(text, LabelQueryPrefix):
+				label := text[len(LabelQueryPrefix):]
+				if label == "" && lexer.cursor < len(lexer.input) && lexer.input[lexer.cursor] == '"' {
+					label, err = lexer.readQuoted()
+					if err != nil {
+						return nil, err
+					}
+				}
+				if label == "" {
+					return nil, fmt.Errorf("查询语法错误：标签为空")
+				}
+				tokens = append(tokens, queryToken{kind: queryTokenLabel, text: label})
+			case isPrefix:
+				tokens = append(tokens, queryToken{kind: queryTokenPrefix, text: text})
+			default:
+				tokens = append(tokens, queryToken{kind: queryTokenWord, text: text})
+			}
+		}
+		atWordStart = false
+	}
+	tokens = append(tokens, queryToken{kind: queryTokenEOF})
+	return
+}
+
+// 读入一个词，直到空白、括号、引号或者~为止
+// 词以没有转义的*结尾时为前缀，返回去掉*的前缀和true
+func (lexer *queryLexer) readWord() (string, bool) {
+	var word []rune
+	escaped := false
+	for lexer.cursor < len(lexer.input) {
+		r := lexer.input[lexer.cursor]
+		if unicode.IsSpace(r) || r == '(' || r == ')' || r == '"' || r == '~' {
+			break
+		}
+		escaped = r == '\\' && lexer.cursor+1 < len(lexer.input)
+		if escaped {
+			lexer.cursor++
+			r = lexer.input[lexer.cursor]
+		}
+		word = append(word, r)
+		lexer.cursor++
+	}
+	if len(word) > 1 && word[len(word)-1] == '*' && !escaped {
+		return string(word[:len(word)-1]), true
+	}
+	return string(word), false
+}
+
+// 读入引号内的文本，调用时cursor指向左引号
+func (lexer *queryLexer) readQuoted() (string, error) {
+	var text []rune
+	lexer.cursor++
+	for lexer.cursor < len(lexer.input) {
+		r := lexer.input[lexer.cursor]
+		lexer.cursor++
+		if r == '"' {
+			return string(text), nil
+		}
+		if r == '\\' && lexer.cursor < len(lexer.input) {
+			r = lexer.input[lexer.cursor]
+			lexer.cursor++
+		}
+		text = append(text, r)
+	}
+	return "", fmt.Errorf("查询语法错误：引号未闭合")
+}
+
+// 读入短语或者词后面可选的"~N"，返回N
+func (lexer *queryLexer) readSlop() (int, error) {
+	if lexer.cursor >= len(lexer.input) || lexer.input[lexer.cursor] != '~' {
+		return 0, nil
+	}
+	lexer.cursor++
+	slop, digits := 0, 0
+	for lexer.cursor < len(lexer.input) && lexer.input[lexer.cursor] >= '0' && lexer.input[lexer.cursor] <= '9' {
+		slop = slop*10 + int(lexer.input[lexer.cursor]-'0')
+		lexer.cursor++
+		digits++
+	}
+	if digits == 0 {
+		return 0, fmt.Errorf("查询语法错误：~后缺少数字")
+	}
+	return slop, nil
+}
+
+type queryParser struct {
+	tokens []queryToken
+	cursor int
+}
+
+func (parser *queryParser) peek() queryToken {
+	return parser.tokens[parser.cursor]
+}
+
+func (parser *queryParser) next() queryToken {
+	token := parser.tokens[parser.cursor]
+	if token.kind != queryTokenEOF {
+		parser.cursor++
+	}
+	return token
+}
+
+// 解析一个括号层级，直到右括号或者结尾为止
+// 返回nil表示该层级为空
+func (parser *queryParser) parseGroup() (Query, error) {
+	var (
+		must, mustNot []Query
+		orQueries     []Query
+		andQueries    []Query
+	)
+	flush := func() {
+		if len(andQueries) == 1 {
+			orQueries = append(orQueries, andQueries[0])
+		} else if len(andQueries) > 1 {
+			orQueries = append(orQueries, AndQuery{Queries: andQueries})
+		}
+		andQueries = nil
+	}
+
+	for {
+		token := parser.peek()
+		if token.kind == queryTokenEOF || token.kind == queryTokenRightParen {
+			break
+		}
+		switch token.kind {
+		case queryTokenOr:
+			parser.next()
+			if len(andQueries) == 0 {
+				return nil, fmt.Errorf("查询语法错误：OR前缺少查询")
+			}
+			if next := parser.peek().kind; next == queryTokenEOF || next == queryTokenRightParen || next == queryTokenOr {
+				return nil, fmt.Errorf("查询语法错误：OR后缺少查询")
+			}
+			flush()
+		case queryTokenAnd:
+			parser.next()
+			if len(andQueries) == 0 {
+				return nil, fmt.Errorf("查询语法错误：AND前缺少查询")
+			}
+			if next := parser.peek().kind; next == queryTokenEOF || next == queryTokenRightParen ||
+				next == queryTokenOr || next == queryTokenAnd {
+				return nil, fmt.Errorf("查询语法错误：AND后缺少查询")
+			}
+		case queryTokenMust:
+			parser.next()
+			query, err := parser.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			must = append(must, query)
+		case queryTokenMustNot:
+			parser.next()
+			query, err := parser.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			mustNot = append(mustNot, query)
+		default:
+			query, err := parser.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			andQueries = append(andQueries, query)
+		}
+	}
+	flush()
+
+	var queries []Query
+	if len(orQueries) == 1 {
+		queries = append(queries, orQueries[0])
+	} else if len(orQueries) > 1 {
+		queries = append(queries, OrQuery{Queries: orQueries})
+	}
+	queries = append(queries, must...)
+	for _, query := range mustNot {
+		queries = append(queries, NotQuery{Query: query})
+	}
+	switch len(queries) {
+	case 0:
+		return nil, nil
+	case 1:
+		return queries[0], nil
+	}
+	return AndQuery{Queries: queries}, nil
+}
+
+func (parser *queryParser) parseUnary() (Query, error) {
+	token := parser.next()
+	switch token.kind {
+	case queryTokenNot:
+		query, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return NotQuery{Query: query}, nil
+	case queryTokenLeftParen:
+		query, err := parser.parseGroup()
+		if err != nil {
+			return nil, err
+		}
+		if parser.next().kind != queryTokenRightParen {
+			return nil, fmt.Errorf("查询语法错误：括号未闭合")
+		}
+		if query == nil {
+			return nil, fmt.Errorf("查询语法错误：括号内为空")
+		}
+		return query, nil
+	case queryTokenWord:
+		return TermQuery{Text: token.text}, nil
+	case queryTokenQuoted:
+		return PhraseQuery{Terms: []string{token.text}, Slop: token.slop}, nil
+	case queryTokenLabel:
+		return LabelQuery{Label: token.text}, nil
+	case queryTokenPrefix:
+		return PrefixQuery{Prefix: token.text}, nil
+	case queryTokenFuzzy:
+		if token.slop == 0 {
+			return TermQuery{Text: token.text}, nil
+		}
+		return FuzzyQuery{Text: token.text, MaxDistance: token.slop}, nil
+	case queryTokenEOF:
+		return nil, fmt.Errorf("查询语法错误：查询不完整")
+	}
+	return nil, fmt.Errorf("查询语法错误：意外的\"%s\"", token.text)
+}
@@ -12,6 +12,33 @@ type SearchRequest struct {
 	// 文档标签（必须是UTF-8格式），标签不存在文档文本中，但也属于搜索键的一种
 	Labels []string
 
+	// 设为true时将Text分词得到的关键词（或者Tokens）作为短语查询，即文档中这些关键词
+	// 必须按顺序紧邻出现，见PhraseQuery。仅当索引类型为LocationsIndex时有效
+	Phrase bool
+
+	// 短语查询允许的误差，单位为字节，见PhraseQuery
+	Slop int
+
+	// 设为true时Text为拼音（全拼或者首字母，比如"beijing"或者"bj"），空格分隔的每个词
+	// 查找PinyinFilter生成的一个拼音关键词，此时忽略Tokens和Phrase
+	// 需要在EngineInitOptions.IndexTokenFilters中加入PinyinFilter
+	//
+	// 每个拼音词可以对应文档中关键词的一部分连续音节，比如"北京大学"被分为一个词时，
+	// "beijing"、"bj"、"daxue"和"beijingdaxue"都能搜到。同一个词中不能混用全拼和首字母（比如"beij"）
+	Pinyin bool
+
+	// 模糊匹配允许的最大编辑距离，大于0时Text分词得到的每个关键词（或者Tokens、拼音关键词）
+	// 匹配编辑距离不超过该值的搜索键，见FuzzyQuery。Phrase为true时无效
+	Fuzziness int
+
+	// 设为true时，如果没有搜索到文档，根据词典中相近的搜索键给出改正后的搜索文本，
+	// 见SearchResponse.Suggestions。Query不为nil或者Phrase为true时无效
+	Suggest bool
+
+	// 查询语法树，可以由ParseQuery从查询字符串解析得到
+	// 当不为nil时忽略上面的Text、Tokens、Labels和Phrase，查询中的TermQuery和PhraseQuery会被分词
+	Query Query
+
 	// 当不为nil时，仅从这些DocIds包含的键中搜索（忽略值）
 	DocIds map[uint64]bool
 
@@ -19,7 +46,7 @@ type SearchRequest struct {
 	RankOptions *RankOptions
 
 	// 超时，单位毫秒（千分之一秒）。此值小于等于零时不设超时。
-	// 搜索超时的情况下仍有可能返回部分排序结果。
+	// 搜索超时的情况下仍有可能返回部分排序结果。也可以用Engine.SearchContext设置截止时间。
 	Timeout int
 
 	// 设为true时仅统计搜索到的文档个数，不返回具体的文档
@@ -28,6 +55,53 @@ type SearchRequest struct {
 	// 不排序，对于可在引擎外部（比如客户端）排序情况适用
 	// 对返回文档很多的情况打开此选项可以有效节省时间
 	Orderless bool
+
+	// 设为true时从持久存储中读出返回文档的数据（正文、评分字段等），见ScoredDocument.Document
+	// 需要打开EngineInitOptions.UsePersistentStorage，评分字段的类型需要用gob.Register注册
+	LoadDocuments bool
+
+	// 分面统计，结果保存在SearchResponse.Facets中
+	Facets []FacetRequest
+
+	// 按文档的数值属性过滤，文档必须满足全部过滤条件。过滤在评分之前进行
+	Filters []AttributeFilter
+}
+
+// 数值属性的范围过滤条件，见DocumentIndexData.Attributes
+//
+// Min和Max为nil时表示该方向没有限制，Min和Max相等时即为等于过滤。没有该属性的文档
+// 不满足过滤条件。整数和浮点数之间可以比较。
+type AttributeFilter struct {
+	// 属性名
+	Name string
+
+	// 下限和上限，只能是整数或者浮点数
+	Min, Max interface{}
+
+	// 为true时不包括下限（上限）本身
+	ExcludeMin, ExcludeMax bool
+}
+
+// 分面统计请求：统计搜索到的文档中各个标签出现的文档数
+type FacetRequest struct {
+	// 分面名，用作SearchResponse.Facets的键，为空时使用Prefix
+	Name string
+
+	// 统计全部以此为前缀的标签，比如"category:"
+	Prefix string
+
+	// 统计这些标签，不为空时忽略Prefix。没有文档带有的标签也会返回，其文档数为0
+	Labels []string
+
+	// 最多返回文档数最多的多少个标签，为0时无限制
+	TopN int
+}
+
+func (facet FacetRequest) GetName() string {
+	if facet.Name != "" {
+		return facet.Name
+	}
+	return facet.Prefix
 }
 
 type RankOptions struct {
@@ -16,6 +16,25 @@ type SearchResponse struct {
 
 	// 搜索到的文档个数。注意这是全部文档中满足条件的个数，可能比返回的文档数要大
 	NumDocs int
+
+	// 模糊匹配的扩展结果，键为模糊匹配的关键词，值为匹配的搜索键，按编辑距离从小到大排序
+	// 没有模糊匹配时为nil
+	Expansions map[string][]string
+
+	// "您是不是要找"：改正拼写后能搜索到文档的搜索文本，最好的在前
+	// 仅当SearchRequest.Suggest为true且没有搜索到文档时不为空
+	Suggestions []string
+
+	// 分面统计结果，键为FacetRequest的分面名，标签按文档数从大到小排序
+	// 统计的是索引器找到的全部文档，不受分页和评分规则剔除文档的影响
+	Facets map[string][]FacetCount
+}
+
+type FacetCount struct {
+	Label string
+
+	// 带有该标签的文档数
+	Count int
 }
 
 type ScoredDocument struct {
@@ -32,6 +51,9 @@ type ScoredDocument struct {
 	// 关键词出现的位置
 	// 只有当IndexType == LocationsIndex时不为空
 	TokenLocations [][]int
+
+	// 持久存储中的文档数据，仅当SearchRequest.LoadDocuments为true时不为nil
+	Document *DocumentIndexData
 }
 
 // 为了方便排序
@@ -46,12 +68,17 @@ func (docs ScoredDocuments) Swap(i, j int) {
 }
 func (docs ScoredDocuments) Less(i, j int) bool {
 	// 为了从大到小排序，这实际上实现的是More的功能
-	for iScore := 0; iScore < utils.MinInt(len(docs[i].Scores), len(docs[j].Scores)); iScore++ {
-		if docs[i].Scores[iScore] > docs[j].Scores[iScore] {
+	return ScoresMore(docs[i].Scores, docs[j].Scores)
+}
+
+// 先比较第一个分值，相同时比较第二个，依次类推，a大于b时返回true
+func ScoresMore(a, b []float32) bool {
+	for iScore := 0; iScore < utils.MinInt(len(a), len(b)); iScore++ {
+		if a[iScore] > b[iScore] {
 			return true
-		} else if docs[i].Scores[iScore] < docs[j].Scores[iScore] {
+		} else if a[iScore] < b[iScore] {
 			return false
 		}
 	}
-	return len(docs[i].Scores) > len(docs[j].Scores)
+	return len(a) > len(b)
 }
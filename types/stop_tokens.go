@@ -2,7 +2,7 @@ package types
 
 import (
 	"bufio"
-	"log"
+	"fmt"
 	"os"
 )
 
@@ -12,15 +12,15 @@ type StopTokens struct {
 
 // 从stopTokenFile中读入停用词，一个词一行
 // 文档索引建立时会跳过这些停用词
-func (st *StopTokens) Init(stopTokenFile string) {
+func (st *StopTokens) Init(stopTokenFile string) error {
 	st.stopTokens = make(map[string]bool)
 	if stopTokenFile == "" {
-		return
+		return nil
 	}
 
 	file, err := os.Open(stopTokenFile)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("%w \"%s\": %v", ErrStopTokenFileNotFound, stopTokenFile, err)
 	}
 	defer file.Close()
 
@@ -31,10 +31,13 @@ func (st *StopTokens) Init(stopTokenFile string) {
 			st.stopTokens[text] = true
 		}
 	}
-
+	return scanner.Err()
 }
 
 func (st *StopTokens) IsStopToken(token string) bool {
+	if st == nil {
+		return false
+	}
 	_, found := st.stopTokens[token]
 	return found
 }
@@ -0,0 +1,16 @@
+package types
+
+// 持久存储一个分片的统计信息，见engine.StorageStats和engine.CheckStorage
+type StorageShardStats struct {
+	// 分片编号和数据库文件
+	Shard int
+	Path  string
+
+	// 文档数和占用的磁盘空间（字节）
+	NumDocuments int
+	Size         int64
+
+	// 以下只由engine.CheckStorage填写：无法解码的文档编号，以及无法解析为文档编号的键的个数
+	InvalidDocIds  []uint64
+	NumInvalidKeys int
+}
@@ -0,0 +1,74 @@
+package types
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type Synonyms struct {
+	synonyms map[string][]string
+}
+
+// 从synonymFile中读入同义词，一行为空格分隔的一组同义词，比如
+//
+//	手机 移动电话 手提电话
+//
+// 搜索时关键词会扩展为它的全部同义词。同义词应当是分词和过滤之后的形式，
+// 比如使用了LowercaseFilter时应当是小写。
+func (s *Synonyms) Init(synonymFile string) error {
+	s.synonyms = make(map[string][]string)
+	if synonymFile == "" {
+		return nil
+	}
+
+	file, err := os.Open(synonymFile)
+	if err != nil {
+		return fmt.Errorf("%w \"%s\": %v", ErrSynonymFileNotFound, synonymFile, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		s.AddGroup(strings.Fields(scanner.Text())...)
+	}
+	return scanner.Err()
+}
+
+// 加入一组同义词
+// 一个词出现在多组中时，它的同义词为这些组的并集
+func (s *Synonyms) AddGroup(words ...string) {
+	if s.synonyms == nil {
+		s.synonyms = make(map[string][]string)
+	}
+	for _, word := range words {
+		for _, synonym := range words {
+			if synonym != word && !containsString(s.synonyms[word], synonym) {
+				s.synonyms[word] = append(s.synonyms[word], synonym)
+			}
+		}
+	}
+}
+
+// 返回token的同义词，不包括token本身
+func (s *Synonyms) Lookup(token string) []string {
+	if s == nil {
+		return nil
+	}
+	return s.synonyms[token]
+}
+
+// 释放资源
+func (s *Synonyms) Close() {
+	s.synonyms = nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, str := range list {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
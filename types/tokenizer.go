@@ -0,0 +1,95 @@
+package types
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/huichen/sego"
+)
+
+// 分词得到的一个关键词
+type Token struct {
+	// 关键词的字符串
+	Text string
+
+	// 关键词在文本中的起始字节位置
+	Start int
+
+	// 关键词在文本中的结束字节位置（不包括该位置）
+	End int
+}
+
+// 分词器，将文本切分为关键词
+//
+// 索引文档和搜索时使用同一个分词器，因此同一段文本总是得到同样的关键词。
+// Tokenize会被多个线程同时调用，实现时需要保证线程安全。
+type Tokenizer interface {
+	Tokenize(text string) []Token
+}
+
+// 使用sego分词的分词器，引擎默认使用这个分词器
+type SegoTokenizer struct {
+	segmenter *sego.Segmenter
+}
+
+// 用已经载入词典的sego.Segmenter创建分词器
+func NewSegoTokenizer(segmenter *sego.Segmenter) *SegoTokenizer {
+	return &SegoTokenizer{segmenter: segmenter}
+}
+
+// 从半角逗号分隔的词典文件载入sego分词器，具体用法见
+// sego.Segmenter.LoadDictionary函数的注释
+func LoadSegoTokenizer(dictionaries string) (*SegoTokenizer, error) {
+	// sego在词典文件不存在时会直接退出程序，因此预先检查
+	for _, file := range strings.Split(dictionaries, ",") {
+		if _, err := os.Stat(file); err != nil {
+			return nil, fmt.Errorf("%w \"%s\": %v", ErrDictionaryNotFound, file, err)
+		}
+	}
+	segmenter := &sego.Segmenter{}
+	segmenter.LoadDictionary(dictionaries)
+	return NewSegoTokenizer(segmenter), nil
+}
+
+func (tokenizer *SegoTokenizer) Tokenize(text string) []Token {
+	segments := tokenizer.segmenter.Segment([]byte(text))
+	tokens := make([]Token, len(segments))
+	for i, segment := range segments {
+		tokens[i] = Token{
+			Text:  segment.Token().Text(),
+			Start: segment.Start(),
+			End:   segment.End(),
+		}
+	}
+	return tokens
+}
+
+// 释放词典
+func (tokenizer *SegoTokenizer) Close() {
+	tokenizer.segmenter.Close()
+}
+
+// 按单词切分的分词器，适用于英文等以空格分词的文本
+//
+// 连续的字母、数字和下划线构成一个关键词，其它字符都视为分隔符。
+type WordTokenizer struct{}
+
+func (WordTokenizer) Tokenize(text string) []Token {
+	var tokens []Token
+	start := -1
+	for i, r := range text {
+		isWord := unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+		if isWord && start < 0 {
+			start = i
+		} else if !isWord && start >= 0 {
+			tokens = append(tokens, Token{Text: text[start:i], Start: start, End: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, Token{Text: text[start:], Start: start, End: len(text)})
+	}
+	return tokens
+}